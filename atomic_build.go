@@ -0,0 +1,240 @@
+package trainmapdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// ErrIncompleteDatabase is returned when opening a DB whose load didn't complete (crash or error during LoadDatabase).
+var ErrIncompleteDatabase = errors.New("database load did not complete")
+
+const (
+	buildingSuffix = ".building"
+	backupSuffix   = ".bak"
+)
+
+// sidecar files SQLite may leave next to a DB file
+var sqliteSidecarSuffixes = []string{"-journal", "-wal", "-shm"}
+
+// BuildDatabase loads the feeds into a temporary file next to config.DatabasePath, validates it,
+// then atomically moves it into place: readers of DatabasePath only ever see complete DBs.
+// open returns the dialector for a given file path (e.g. sqlite.Open), useMutex and fetcherConfig are passed to NewFetcher.
+// If config.KeepBackup is set, the previous DB is kept at DatabasePath + ".bak" (see RestoreDatabaseBackup).
+// The previous DB's WAL, if any, is checkpointed first: connections still open on it keep reading it, whole, until reopened.
+func BuildDatabase(open func(path string) gorm.Dialector, useMutex bool, config LoaderConfig, fetcherConfig *FetcherConfig) error {
+	finalPath := config.DatabasePath
+	tempPath := finalPath + buildingSuffix
+	//a previous build may have crashed, start over
+	err := removeDatabaseFile(tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = buildTempDatabase(open, useMutex, config, fetcherConfig, tempPath)
+	if err != nil {
+		removeDatabaseFile(tempPath)
+		return err
+	}
+
+	//the previous DB is backed up and replaced without its sidecar files, so it must be whole in its main file
+	err = checkpointDatabase(open, finalPath)
+	if err != nil {
+		return fmt.Errorf("could not checkpoint the previous database: %s", err.Error())
+	}
+	if config.KeepBackup {
+		//the previous DB stays at finalPath until the new one replaces it
+		err = backupDatabaseFile(finalPath, finalPath+backupSuffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not back up the previous database: %s", err.Error())
+		}
+	}
+	err = moveDatabaseFile(tempPath, finalPath)
+	if err != nil {
+		return fmt.Errorf("could not move the new database into place: %s", err.Error())
+	}
+	return nil
+}
+
+func buildTempDatabase(open func(path string) gorm.Dialector, useMutex bool, config LoaderConfig, fetcherConfig *FetcherConfig, tempPath string) error {
+	fetcher, err := NewFetcher(open(tempPath), useMutex, fetcherConfig)
+	if err != nil {
+		return err
+	}
+	sqlDB, err := fetcher.db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close() //the file must be closed before being moved
+
+	config.DatabasePath = tempPath
+	err = fetcher.LoadDatabase(config)
+	if err != nil {
+		return err
+	}
+	fetcher.emitPhase(LoadPhaseValidate)
+	activeFeeds := 0
+	for _, entry := range config.Contents {
+		if entry.Active {
+			activeFeeds++
+		}
+	}
+	err = fetcher.validateDatabase(activeFeeds)
+	if err != nil {
+		return fmt.Errorf("new database is invalid: %s", err.Error())
+	}
+	return sqlDB.Close()
+}
+
+// validateDatabase checks the DB's integrity and that every feed made it in.
+func (f Fetcher) validateDatabase(expectedFeeds int) error {
+	if f.db.Dialector.Name() == "sqlite" {
+		var result string
+		err := f.db.Raw("PRAGMA integrity_check").Scan(&result).Error
+		if err != nil {
+			return err
+		}
+		if result != "ok" {
+			return fmt.Errorf("integrity check failed: %s", result)
+		}
+	}
+
+	var feedSources int64
+	err := f.db.Model(&FeedSource{}).Where("status = ?", FeedStatusComplete).Count(&feedSources).Error
+	if err != nil {
+		return err
+	}
+	if feedSources != int64(expectedFeeds) {
+		return fmt.Errorf("expected %d feeds, found %d", expectedFeeds, feedSources)
+	}
+	if expectedFeeds == 0 {
+		return nil
+	}
+	for _, table := range []string{"stops", "trips", "stop_times"} {
+		var count int64
+		err = f.db.Table(table).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("no rows in %s", table)
+		}
+	}
+	return nil
+}
+
+// RestoreDatabaseBackup rolls back to the DB kept by the last BuildDatabase (see LoaderConfig.KeepBackup).
+// Close every connection to the DB first.
+func RestoreDatabaseBackup(path string) error {
+	_, err := os.Stat(path + backupSuffix)
+	if err != nil {
+		return fmt.Errorf("no backup to restore: %s", err.Error())
+	}
+	return moveDatabaseFile(path+backupSuffix, path)
+}
+
+// checkpointDatabase moves the content of a SQLite DB's WAL into its main file, if it has a WAL.
+// It fails if a reader keeps the WAL from being fully checkpointed.
+func checkpointDatabase(open func(path string) gorm.Dialector, path string) error {
+	_, err := os.Stat(path + "-wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db, err := gorm.Open(open(path), &gorm.Config{})
+	if err != nil {
+		return err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+	var result struct {
+		Busy         int
+		Log          int
+		Checkpointed int
+	}
+	err = db.Raw("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&result).Error
+	if err != nil {
+		return err
+	}
+	if result.Busy != 0 {
+		return fmt.Errorf("the WAL is still in use")
+	}
+	return sqlDB.Close()
+}
+
+// backupDatabaseFile makes the backup a hard link to the DB file (or a copy, where links aren't supported), replacing any previous backup.
+// Sidecar files aren't backed up, checkpoint the DB first. An error wrapping os.ErrNotExist is returned if the DB doesn't exist.
+func backupDatabaseFile(path string, backupPath string) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = removeDatabaseFile(backupPath)
+	if err != nil {
+		return err
+	}
+	err = os.Link(path, backupPath)
+	if err == nil {
+		return nil
+	}
+	return copyFile(path, backupPath)
+}
+
+func copyFile(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destination, source)
+	if err != nil {
+		destination.Close()
+		os.Remove(to)
+		return err
+	}
+	return destination.Close()
+}
+
+// moveDatabaseFile renames a DB file along with its SQLite sidecar files. Sidecar files of the destination
+// the source doesn't have are removed, SQLite would otherwise apply a stale journal or WAL to the moved DB:
+// checkpoint the destination first if it may be in use, or the content of its WAL is lost.
+// The main file is moved last, and an error wrapping os.ErrNotExist is returned if it doesn't exist.
+func moveDatabaseFile(from string, to string) error {
+	_, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range sqliteSidecarSuffixes {
+		err = os.Rename(from+suffix, to+suffix)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.Remove(to + suffix)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(from, to)
+}
+
+// removeDatabaseFile removes a DB file and its SQLite sidecar files, if they exist.
+func removeDatabaseFile(path string) error {
+	for _, suffix := range append([]string{""}, sqliteSidecarSuffixes...) {
+		err := os.Remove(path + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package trainmapdb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestBuildDatabaseKeepBackup(t *testing.T) {
+	databasePath := filepath.Join(t.TempDir(), "trainmap.db")
+	open := func(path string) gorm.Dialector { return sqlite.Open(path) }
+	config := LoaderConfig{
+		DatabasePath: databasePath,
+		Contents:     []LoaderConfigEntry{testFeed(FeedFormatNeTEx, "testdata/netex.xml")},
+		KeepBackup:   true,
+	}
+	err := BuildDatabase(open, true, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a reader of the previous DB left rows in its WAL, they must make it to the backup
+	previous, err := NewFetcher(sqlite.Open(databasePath), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = previous.db.Exec("PRAGMA journal_mode = WAL").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = previous.db.Model(&Feed{}).Where("feed_id = ?", "1").Update("display_name", "previous").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = BuildDatabase(open, true, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var displayName string
+	err = previous.db.Model(&Feed{}).Where("feed_id = ?", "1").Pluck("display_name", &displayName).Error
+	if err != nil || displayName != "previous" {
+		t.Errorf("the open connection should still read the previous DB, got %q and error %v", displayName, err)
+	}
+	sqlDB, err := previous.db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+
+	for path, expected := range map[string]string{databasePath: "netex.xml", databasePath + backupSuffix: "previous"} {
+		fetcher, err := NewFetcher(sqlite.Open(path), true, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err.Error())
+		}
+		err = fetcher.db.Model(&Feed{}).Where("feed_id = ?", "1").Pluck("display_name", &displayName).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if displayName != expected {
+			t.Errorf("%s holds feed %q, expected %q", path, displayName, expected)
+		}
+	}
+}
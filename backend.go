@@ -0,0 +1,72 @@
+package trainmapdb
+
+import (
+	"context"
+	"time"
+)
+
+// A Backend answers the read queries of a Fetcher, the sight engines only go through it.
+// The default backend queries the DB through gorm, a Snapshot is an in-memory one,
+// and apps may provide their own (mocks, cache layers, other storages) with NewBackendFetcher or Fetcher.WithBackend.
+//
+// Methods returning a single element return gorm.ErrRecordNotFound when it doesn't exist.
+type Backend interface {
+	GetAllTrips(ctx context.Context) ([]Trip, error)
+	GetAllStops(ctx context.Context) ([]Stop, error)
+	GetAllAgencies(ctx context.Context) ([]Agency, error)
+	GetFeeds(ctx context.Context) ([]Feed, error)
+	GetFeed(ctx context.Context, feedId string) (Feed, error)
+	GetTrip(ctx context.Context, feedId string, tripId string) (Trip, error)
+	GetRoute(ctx context.Context, feedId string, routeId string) (Route, error)
+	GetStop(ctx context.Context, feedId string, stopId string) (Stop, error)
+	GetStopsLike(ctx context.Context, name string) ([]Stop, error)
+	GetStopTimesAtStop(ctx context.Context, feedId string, stopId string) ([]StopTime, error)
+	GetServicesBetweenDates(ctx context.Context, startDate time.Time, endDate time.Time) ([]ServiceDay, error) //both dates included
+	GetFeededServiceIdTrips(ctx context.Context, feededService FeededService) ([]Trip, error)
+	//GetTripSegmentsWithIntersection returns the trips having a segment (between 2 consecutive stops) whose bounding box
+	//intersects the given box, loaded with the given options (StopTimes are always loaded).
+	GetTripSegmentsWithIntersection(ctx context.Context, box BoundingBox, options TripLoadOptions) ([]TripMatch, error)
+}
+
+// A TripMatch represents a trip and its segments matching a spatial search,
+// as the indexes of the StopTimes starting each segment (in ascending order).
+type TripMatch struct {
+	Trip     Trip
+	Segments []int
+}
+
+var (
+	_ Backend = gormBackend{}
+	_ Backend = (*Snapshot)(nil)
+)
+
+// NewBackendFetcher returns a Fetcher answering queries from the given backend, without any DB.
+// Methods that need a DB (loading, station matching, exports...) return ErrNoDatabase.
+func NewBackendFetcher(backend Backend, config *FetcherConfig) *Fetcher {
+	var fetcherConfig FetcherConfig
+	if config != nil {
+		fetcherConfig = *config
+	} else {
+		fetcherConfig = NewDefaultConfig()
+	}
+	return &Fetcher{Config: fetcherConfig, Realtime: NewRealtimeState(), snapshot: &snapshotHolder{}, customBackend: backend}
+}
+
+// WithBackend returns a copy of the Fetcher answering queries from the given backend (e.g. a cache wrapping f.Backend()).
+// The copy keeps the DB for everything else (loading, station matching, exports...).
+func (f Fetcher) WithBackend(backend Backend) *Fetcher {
+	f.customBackend = backend
+	return &f
+}
+
+// Backend returns the backend currently answering queries: the one given to WithBackend/NewBackendFetcher if any,
+// then the current snapshot if any, then the DB.
+func (f Fetcher) Backend() Backend {
+	if f.customBackend != nil {
+		return f.customBackend
+	}
+	if snapshot := f.CurrentSnapshot(); snapshot != nil {
+		return snapshot
+	}
+	return gormBackend{db: f.db, spatialIndex: f.spatialIndex}
+}
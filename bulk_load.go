@@ -0,0 +1,289 @@
+package trainmapdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+)
+
+// every model stored in the DB, in migration order
+var databaseModels = []any{&Feed{}, &Agency{}, &Calendar{}, &CalendarDate{}, &ServiceDay{}, &Station{}, &Stop{}, &Route{}, &Trip{}, &StopTime{}, &FeedSource{}, &DatabaseInfo{}}
+
+// A bulkLoader holds the dialect specific settings used to speed up a full load, and how to undo them.
+// Dialects without a fast path simply use the regular gorm Create path.
+type bulkLoader struct {
+	db       *gorm.DB
+	dialect  string
+	durable  bool     //keep the DB crash safe during the load, see LoaderConfig.Resume
+	copyMode copyMode //how to use Postgres COPY FROM STDIN, depends on the driver
+	restore  []string //statements run once the load is done
+	maxConn  int      //original max open connections, restored after the load
+	emit     func(LoadEvent)
+}
+
+// copyMode is the way rows are bulk inserted with Postgres COPY FROM STDIN.
+type copyMode int
+
+const (
+	copyNone copyMode = iota //regular inserts
+	copyPgx                  //pgx (gorm's default) CopyFrom, on the raw connection of every writer
+	copyPq                   //lib/pq, through prepared statements
+)
+
+func newBulkLoader(db *gorm.DB) (*bulkLoader, error) {
+	bl := &bulkLoader{db: db, dialect: db.Dialector.Name()}
+	if bl.dialect == "postgres" {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		_, isPgx := sqlDB.Driver().(*stdlib.Driver)
+		switch {
+		case isPgx:
+			bl.copyMode = copyPgx
+		case strings.HasPrefix(fmt.Sprintf("%T", sqlDB.Driver()), "*pq."):
+			bl.copyMode = copyPq
+		}
+	}
+	return bl, nil
+}
+
+// writeDB returns the DB session the writers should use.
+func (bl *bulkLoader) writeDB() *gorm.DB {
+	//prepared statements get reused for every batch of the same size, which is most of them
+	return bl.db.Session(&gorm.Session{PrepareStmt: bl.dialect == "sqlite"})
+}
+
+// start applies the load-time settings.
+func (bl *bulkLoader) start() error {
+	if bl.dialect != "sqlite" {
+		return nil
+	}
+	//PRAGMAs are per connection, so make sure we only use one during the load
+	sqlDB, err := bl.db.DB()
+	if err != nil {
+		return err
+	}
+	bl.maxConn = sqlDB.Stats().MaxOpenConnections
+	sqlDB.SetMaxOpenConns(1)
+
+	var journalMode string
+	var synchronous int
+	err = bl.db.Raw("PRAGMA journal_mode").Scan(&journalMode).Error
+	if err != nil {
+		return err
+	}
+	err = bl.db.Raw("PRAGMA synchronous").Scan(&synchronous).Error
+	if err != nil {
+		return err
+	}
+	bl.restore = []string{
+		fmt.Sprintf("PRAGMA journal_mode = %s", journalMode),
+		fmt.Sprintf("PRAGMA synchronous = %d", synchronous),
+		"PRAGMA temp_store = DEFAULT",
+	}
+	pragmas := []string{
+		"PRAGMA temp_store = MEMORY",
+		"PRAGMA cache_size = -262144", //256MiB
+	}
+	if !bl.durable {
+		//a crash during a load means rebuilding the DB anyway, so durability doesn't matter here,
+		//but the writers' transactions must still be able to roll back, which journal_mode = OFF doesn't allow
+		pragmas = append(pragmas, "PRAGMA journal_mode = MEMORY", "PRAGMA synchronous = OFF")
+	}
+	for _, pragma := range pragmas {
+		err = bl.db.Exec(pragma).Error
+		if err != nil {
+			return fmt.Errorf("could not run %s: %s", pragma, err.Error())
+		}
+	}
+	return nil
+}
+
+// finish restores the settings changed by start, using the given context (which shouldn't be the cancelled one of the load).
+// The connection pool gets its size back even if restoring the other settings fails.
+func (bl *bulkLoader) finish(ctx context.Context) error {
+	if bl.dialect == "sqlite" {
+		sqlDB, err := bl.db.DB()
+		if err != nil {
+			return err
+		}
+		defer sqlDB.SetMaxOpenConns(bl.maxConn)
+	}
+	db := bl.db.WithContext(ctx)
+	for _, statement := range bl.restore {
+		err := db.Exec(statement).Error
+		if err != nil {
+			return fmt.Errorf("could not run %s: %s", statement, err.Error())
+		}
+	}
+	return nil
+}
+
+// dropIndexes removes the secondary indexes, which are much cheaper to build once the data is in.
+func (bl *bulkLoader) dropIndexes() error {
+	return bl.forEachIndex(func(model any, name string) error {
+		if !bl.db.Migrator().HasIndex(model, name) {
+			return nil
+		}
+		return bl.db.Migrator().DropIndex(model, name)
+	})
+}
+
+// createIndexes (re)creates the secondary indexes dropped by dropIndexes.
+func (bl *bulkLoader) createIndexes() error {
+	return bl.forEachIndex(func(model any, name string) error {
+		if bl.db.Migrator().HasIndex(model, name) {
+			return nil
+		}
+		if bl.emit != nil {
+			bl.emit(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseIndexes, Detail: name})
+		}
+		return bl.db.Migrator().CreateIndex(model, name)
+	})
+}
+
+// dropForeignKeys removes the foreign key constraints of an existing DB, since rows aren't inserted in dependency order.
+// The final migration adds them back.
+func (bl *bulkLoader) dropForeignKeys() error {
+	for _, model := range databaseModels {
+		stmt := &gorm.Statement{DB: bl.db}
+		err := stmt.Parse(model)
+		if err != nil {
+			return err
+		}
+		for _, relationship := range stmt.Schema.Relationships.Relations {
+			constraint := relationship.ParseConstraint()
+			if constraint == nil || !bl.db.Migrator().HasConstraint(model, constraint.Name) {
+				continue
+			}
+			err = bl.db.Migrator().DropConstraint(model, constraint.Name)
+			if err != nil {
+				return fmt.Errorf("constraint %s: %s", constraint.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (bl *bulkLoader) forEachIndex(callback func(model any, name string) error) error {
+	for _, model := range databaseModels {
+		stmt := &gorm.Statement{DB: bl.db}
+		err := stmt.Parse(model)
+		if err != nil {
+			return err
+		}
+		for name := range stmt.Schema.ParseIndexes() {
+			err = callback(model, name)
+			if err != nil {
+				return fmt.Errorf("index %s: %s", name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// insertRows inserts the given rows using the fastest path available.
+// conn is the connection tx runs on, only needed by copyPgx.
+func insertRows[T any](tx *gorm.DB, conn *sql.Conn, mode copyMode, rows []T) error {
+	switch mode {
+	case copyPgx:
+		return copyRowsPgx(tx, conn, rows)
+	case copyPq:
+		return copyRows(tx, rows)
+	default:
+		return tx.Create(rows).Error
+	}
+}
+
+// copyColumns returns the table of the rows, its columns (not quoted) and how to get their values from a row.
+func copyColumns[T any](tx *gorm.DB, rows []T) (string, []string, []func(reflect.Value) any, error) {
+	stmt := &gorm.Statement{DB: tx}
+	err := stmt.Parse(&rows[0])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var columns []string
+	var values []func(reflect.Value) any
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" || !field.Creatable {
+			continue
+		}
+		field := field
+		columns = append(columns, field.DBName)
+		values = append(values, func(rv reflect.Value) any {
+			value, _ := field.ValueOf(tx.Statement.Context, rv)
+			return value
+		})
+	}
+	return stmt.Schema.Table, columns, values, nil
+}
+
+// copyRowsPgx inserts the rows using pgx's CopyFrom. The driver only exposes it on its own connection type,
+// so it runs on the raw connection of tx, within its transaction.
+func copyRowsPgx[T any](tx *gorm.DB, conn *sql.Conn, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	table, columns, values, err := copyColumns(tx, rows)
+	if err != nil {
+		return err
+	}
+	return conn.Raw(func(driverConn any) error {
+		pgxConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		source := pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+			rv := reflect.ValueOf(&rows[i]).Elem()
+			rowValues := make([]any, len(values))
+			for j, value := range values {
+				rowValues[j] = value(rv)
+			}
+			return rowValues, nil
+		})
+		_, err := pgxConn.Conn().CopyFrom(tx.Statement.Context, pgx.Identifier{table}, columns, source)
+		return err
+	})
+}
+
+// copyRows inserts the rows using COPY FROM STDIN, as implemented by lib/pq through prepared statements.
+func copyRows[T any](tx *gorm.DB, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	table, columns, values, err := copyColumns(tx, rows)
+	if err != nil {
+		return err
+	}
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = tx.Statement.Quote(column)
+	}
+	copyStatement := fmt.Sprintf("COPY %s (%s) FROM STDIN", tx.Statement.Quote(table), strings.Join(quotedColumns, ", "))
+	prepared, err := tx.Statement.ConnPool.PrepareContext(tx.Statement.Context, copyStatement)
+	if err != nil {
+		return err
+	}
+	defer prepared.Close()
+	rowValues := make([]any, len(values))
+	for i := range rows {
+		rv := reflect.ValueOf(&rows[i]).Elem()
+		for j, value := range values {
+			rowValues[j] = value(rv)
+		}
+		_, err = prepared.ExecContext(tx.Statement.Context, rowValues...)
+		if err != nil {
+			return err
+		}
+	}
+	//an empty Exec flushes the buffered rows
+	_, err = prepared.ExecContext(tx.Statement.Context)
+	return err
+}
@@ -1,64 +1,306 @@
 package trainmapdb
 
 import (
+	"database/sql"
+	"fmt"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"gorm.io/gorm"
 )
 
-// this is a wrapper around the DB so it can be either mutexed (in which case there's an actual mutex) or not (in which case only the waitgroup is implemented).
-// this is terrible, but SQLite had me do some abominations (no concurrency ;-;)
-type syncCompatibleDB interface {
-	getDB() *gorm.DB
-	takeMutex()
-	freeMutex()
-	wgIncrement()
-	wgDone()
-	wgWait()
+// A dbWriter funnels every insert of a load through a bounded queue consumed by a fixed number of writers.
+// Parsers block when the queue is full (backpressure), so parsed rows can't pile up in memory faster than they're written.
+// SQLite must use a single writer (no write concurrency), other DBs may use a pool.
+// Use forFeed to know when the rows of a given feed were all written: a write error only fails the feed it belongs to.
+type dbWriter struct {
+	*writerPool
+	pending  *sync.WaitGroup //batches queued through this writer and not written yet, nil if not tracked
+	feedId   string
+	feedName string
+	feedRows *atomic.Int64 //rows written through this writer
+	feedErr  *writeError   //first write error of the batches queued through this writer
 }
 
-type unmutexedDB struct {
-	db *gorm.DB
-	wg sync.WaitGroup
+// the writerPool is shared by a dbWriter and all its forFeed writers
+type writerPool struct {
+	db       *gorm.DB
+	copyMode copyMode //see bulkLoader
+	emit     func(event LoadEvent)
+	metrics  Metrics
+	batches  chan writeBatch
+	wg       sync.WaitGroup
+	done     chan struct{}
+
+	poolErr writeError //error failing every write, e.g. no connection available
+
+	startTime    time.Time
+	rowsWritten  atomic.Int64
+	batchesCount atomic.Int64
 }
 
-func (u *unmutexedDB) getDB() *gorm.DB {
-	return u.db
+// a writeBatch is a slice of rows of a single table, ready to be inserted.
+type writeBatch struct {
+	table   string
+	rows    int
+	insert  func(tx *gorm.DB, conn *sql.Conn) error //conn is the connection tx runs on, only set for copyPgx
+	done    func(written bool)                      //called once the batch was written or dropped, may be nil
+	feedErr *writeError                             //error slot of the writer the batch was queued through
 }
-func (u *unmutexedDB) takeMutex() {}
-func (u *unmutexedDB) freeMutex() {}
-func (u *unmutexedDB) wgIncrement() {
-	u.wg.Add(1)
+
+// a writeError holds the first error of a set of writes.
+type writeError struct {
+	mutex sync.Mutex
+	err   error
 }
-func (u *unmutexedDB) wgDone() {
-	u.wg.Done()
+
+func (e *writeError) set(err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
 }
-func (u *unmutexedDB) wgWait() {
-	u.wg.Wait()
+
+func (e *writeError) get() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.err
 }
 
-// a mutexedDB is just as ugly and horrible as it sounds (SQLite has forced my hand)
-type mutexedDB struct {
-	db    *gorm.DB
-	mutex sync.Mutex
-	wg    sync.WaitGroup
+// A WriterStats represents the throughput of the DB writers during a load.
+type WriterStats struct {
+	RowsWritten   int64         `json:"rows_written"`
+	Batches       int64         `json:"batches"`
+	Elapsed       time.Duration `json:"elapsed"`
+	RowsPerSecond float64       `json:"rows_per_second"`
+}
+
+const (
+	writerBatchRows      = 10_000 //max rows sent to the writers at once
+	writerQueueSize      = 16     //max batches waiting to be written
+	writerBatchesPerTx   = 8      //max batches grouped in a single transaction
+	writerReportInterval = 5 * time.Second
+)
+
+func newDBWriter(db *gorm.DB, poolSize int, copyMode copyMode, emit func(event LoadEvent), metrics Metrics) *dbWriter {
+	poolSize = max(poolSize, 1)
+	pool := &writerPool{
+		db:        db,
+		copyMode:  copyMode,
+		emit:      emit,
+		metrics:   metrics,
+		batches:   make(chan writeBatch, writerQueueSize),
+		done:      make(chan struct{}),
+		startTime: time.Now(),
+	}
+	pool.wg.Add(poolSize)
+	for range poolSize {
+		go pool.run()
+	}
+	go pool.report()
+	return &dbWriter{writerPool: pool, feedErr: &pool.poolErr}
+}
+
+// forFeed returns a writer sharing the same queue, whose wait method only waits for the batches queued through it.
+// Its events are attributed to the given feed.
+func (w *dbWriter) forFeed(feedId string, feedName string) *dbWriter {
+	return &dbWriter{writerPool: w.writerPool, pending: &sync.WaitGroup{}, feedId: feedId, feedName: feedName, feedRows: &atomic.Int64{}, feedErr: &writeError{}}
+}
+
+// emitFeedEvent reports an event about the writer's feed.
+func (w *dbWriter) emitFeedEvent(event LoadEvent) {
+	event.FeedId = w.feedId
+	event.FeedName = w.feedName
+	w.emit(event)
+}
+
+// wait blocks until every batch queued through a forFeed writer was written, and returns its first write error, if any.
+func (w *dbWriter) wait() error {
+	w.pending.Wait()
+	return w.getError()
+}
+
+// getError returns the first write error of the batches queued through this writer, or of the whole pool.
+func (w *dbWriter) getError() error {
+	err := w.poolErr.get()
+	if err != nil {
+		return err
+	}
+	return w.feedErr.get()
+}
+
+func (w *writerPool) run() {
+	defer w.wg.Done()
+	db, conn, err := w.writerConn()
+	if err != nil {
+		w.poolErr.set(err)
+	}
+	if conn != nil {
+		defer conn.Close()
+	}
+	for batch := range w.batches {
+		//group whatever is already waiting into the same transaction
+		group := []writeBatch{batch}
+	grouping:
+		for len(group) < writerBatchesPerTx {
+			select {
+			case next, ok := <-w.batches:
+				if !ok {
+					break grouping
+				}
+				group = append(group, next)
+			default:
+				break grouping
+			}
+		}
+		w.write(db, conn, group)
+	}
 }
 
-func (m *mutexedDB) getDB() *gorm.DB {
-	return m.db
+// write inserts the batches in a single transaction. If that fails, they're retried one by one,
+// since they may come from several feeds and only the feed of the failing batch should fail.
+func (w *writerPool) write(db *gorm.DB, conn *sql.Conn, group []writeBatch) {
+	//drain the batches of the feeds which already failed without writing them
+	pending := make([]writeBatch, 0, len(group))
+	for _, batch := range group {
+		if w.poolErr.get() != nil || batch.feedErr.get() != nil {
+			batchesDone([]writeBatch{batch}, false)
+			continue
+		}
+		pending = append(pending, batch)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, batch := range pending {
+			err := batch.insert(tx, conn)
+			if err != nil {
+				return fmt.Errorf("could not insert to %s: %s", batch.table, err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if len(pending) > 1 {
+			for _, batch := range pending {
+				w.write(db, conn, []writeBatch{batch})
+			}
+			return
+		}
+		pending[0].feedErr.set(err)
+		batchesDone(pending, false)
+		return
+	}
+	for _, batch := range pending {
+		w.rowsWritten.Add(int64(batch.rows))
+		w.batchesCount.Add(1)
+	}
+	batchesDone(pending, true)
 }
-func (m *mutexedDB) takeMutex() {
-	m.mutex.Lock()
+
+// writerConn returns the DB session a writer should use. With copyPgx, it runs on a dedicated connection, also returned.
+func (w *writerPool) writerConn() (*gorm.DB, *sql.Conn, error) {
+	if w.copyMode != copyPgx {
+		return w.db, nil, nil
+	}
+	sqlDB, err := w.db.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := sqlDB.Conn(w.db.Statement.Context)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get a connection: %s", err.Error())
+	}
+	db := w.db.Session(&gorm.Session{})
+	db.Statement.ConnPool = conn
+	return db, conn, nil
 }
-func (m *mutexedDB) freeMutex() {
-	m.mutex.Unlock()
+
+func batchesDone(group []writeBatch, written bool) {
+	for _, batch := range group {
+		if batch.done != nil {
+			batch.done(written)
+		}
+	}
 }
-func (m *mutexedDB) wgIncrement() {
-	m.wg.Add(1)
+
+// report regularly sends the progress until the writer is closed.
+func (w *writerPool) report() {
+	ticker := time.NewTicker(writerReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			stats := w.stats()
+			w.emit(LoadEvent{Type: LoadEventWriterProgress, Rows: stats.RowsWritten, Duration: stats.Elapsed})
+		}
+	}
 }
-func (m *mutexedDB) wgDone() {
-	m.wg.Done()
+
+func (w *writerPool) stats() WriterStats {
+	elapsed := time.Since(w.startTime)
+	rows := w.rowsWritten.Load()
+	return WriterStats{
+		RowsWritten:   rows,
+		Batches:       w.batchesCount.Load(),
+		Elapsed:       elapsed,
+		RowsPerSecond: float64(rows) / elapsed.Seconds(),
+	}
 }
-func (m *mutexedDB) wgWait() {
-	m.wg.Wait()
+
+// close waits for every queued batch to be written and returns the error which failed the whole pool, if any.
+// Write errors of the forFeed writers are returned by their wait method.
+// Nothing may be added after calling close.
+func (w *writerPool) close() (WriterStats, error) {
+	close(w.batches)
+	w.wg.Wait()
+	close(w.done)
+	return w.stats(), w.poolErr.get()
+}
+
+// addToDB queues the given rows for insertion, blocking while the writers are busy.
+// It returns an error as soon as a previous write of the writer's feed failed, so that parsing can stop early.
+func addToDB[T any](writer *dbWriter, input []T) error {
+	modelName := reflect.TypeFor[T]().Name()
+	for start := 0; start < len(input); start += writerBatchRows {
+		err := writer.getError()
+		if err != nil {
+			return err
+		}
+		//stop parsing as soon as the load is cancelled
+		err = writer.db.Statement.Context.Err()
+		if err != nil {
+			return err
+		}
+		chunk := input[start:min(start+writerBatchRows, len(input))]
+		writer.metrics.Add("loader.rows_parsed."+modelName, int64(len(chunk)))
+		batch := writeBatch{
+			table:   fmt.Sprintf("%T", chunk[0]),
+			rows:    len(chunk),
+			feedErr: writer.feedErr,
+			insert: func(tx *gorm.DB, conn *sql.Conn) error {
+				return insertRows(tx, conn, writer.copyMode, chunk)
+			},
+		}
+		if writer.pending != nil {
+			writer.pending.Add(1)
+			batch.done = func(written bool) {
+				defer writer.pending.Done()
+				if !written {
+					return
+				}
+				writer.feedRows.Add(int64(batch.rows))
+				writer.metrics.Add("loader.rows_inserted."+modelName, int64(batch.rows))
+				writer.emitFeedEvent(LoadEvent{Type: LoadEventRowsWritten, Table: batch.table, Rows: int64(batch.rows)})
+			}
+		}
+		writer.batches <- batch
+	}
+	return nil
 }
@@ -0,0 +1,156 @@
+package trainmapdb
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Cross-border trains often appear in several feeds (one per operator), so the same physical train
+// would be reported several times. This merges those duplicates into a single sight.
+
+const duplicateTripSameStopKm = 1.0 //stops closer than this are considered the same station
+
+// normalizeTrainNumber extracts the train number from a trip short name ("TGV 9203" -> "9203").
+func normalizeTrainNumber(shortName string) string {
+	var digits strings.Builder
+	for _, r := range shortName {
+		if unicode.IsDigit(r) {
+			digits.WriteRune(r)
+		} else if digits.Len() > 0 {
+			break //only keep the first number
+		}
+	}
+	return strings.TrimLeft(digits.String(), "0")
+}
+
+// isSameStop checks whether both stops refer to the same physical station.
+func isSameStop(a *Stop, b *Stop) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.StationId != nil && b.StationId != nil {
+		return *a.StationId == *b.StationId
+	}
+	return a.GetPoint().getDistTo(b.GetPoint()) < duplicateTripSameStopKm
+}
+
+func stopTimeReference(st StopTime) time.Time {
+	if !st.DepartureTime.IsZero() {
+		return st.DepartureTime
+	}
+	return st.ArrivalTime
+}
+
+// tripsAreEquivalent checks whether 2 trips of different feeds represent the same train,
+// i.e. they share at least 2 stops with times within the given tolerance.
+func tripsAreEquivalent(a Trip, b Trip, tolerance time.Duration) bool {
+	const MIN_SHARED_STOPS = 2
+	if a.FeedId == b.FeedId {
+		return false
+	}
+	sharedStops := 0
+	for _, stA := range a.StopTimes {
+		for _, stB := range b.StopTimes {
+			if !isSameStop(stA.Stop, stB.Stop) {
+				continue
+			}
+			diff := stopTimeReference(stA).Sub(stopTimeReference(stB))
+			if diff.Abs() <= tolerance {
+				sharedStops++
+				break
+			}
+		}
+		if sharedStops >= MIN_SHARED_STOPS {
+			return true
+		}
+	}
+	return false
+}
+
+type duplicateKey struct {
+	date        time.Time
+	trainNumber string
+}
+
+// mergeDuplicates merges equivalent sights (same date, same train number, equivalent trips).
+// getTrip returns the trip and date of a sight, merge merges the sources of the second sight into the first one.
+// The remaining sights keep their order (e.g. by timestamp): the main sight of each group stays where the first one was,
+// and takes the content of the most detailed one (the one with the most stop times).
+func mergeDuplicates[T any](sights []T, tolerance time.Duration, getTrip func(*T) (Trip, time.Time), merge func(*T, *T)) []T {
+	if tolerance <= 0 {
+		return sights
+	}
+	groups := make(map[duplicateKey][]int)
+	removed := make([]bool, len(sights))
+	for i := range sights {
+		trip, date := getTrip(&sights[i])
+		trainNumber := normalizeTrainNumber(trip.TripShortName)
+		if trainNumber == "" {
+			continue
+		}
+		key := duplicateKey{date: date, trainNumber: trainNumber}
+		isDuplicate := false
+		for _, j := range groups[key] {
+			otherTrip, _ := getTrip(&sights[j])
+			if tripsAreEquivalent(otherTrip, trip, tolerance) {
+				//the main sight keeps its place, but shows the most detailed trip
+				if len(trip.StopTimes) > len(otherTrip.StopTimes) {
+					merge(&sights[i], &sights[j])
+					sights[j] = sights[i]
+				} else {
+					merge(&sights[j], &sights[i])
+				}
+				removed[i] = true
+				isDuplicate = true
+				break
+			}
+		}
+		if !isDuplicate {
+			groups[key] = append(groups[key], i)
+		}
+	}
+	mergedSights := make([]T, 0, len(sights))
+	for i, sight := range sights {
+		if !removed[i] {
+			mergedSights = append(mergedSights, sight)
+		}
+	}
+	return mergedSights
+}
+
+func mergeSources(main []FeededTrip, other []FeededTrip) []FeededTrip {
+	for _, source := range other {
+		isKnown := false
+		for _, known := range main {
+			if known == source {
+				isKnown = true
+				break
+			}
+		}
+		if !isKnown {
+			main = append(main, source)
+		}
+	}
+	return main
+}
+
+func mergeDuplicateTrainSights(sights []RealTrainSight, tolerance time.Duration) []RealTrainSight {
+	return mergeDuplicates(sights, tolerance,
+		func(rts *RealTrainSight) (Trip, time.Time) {
+			return rts.TrainSight.Trip, rts.Date
+		},
+		func(main *RealTrainSight, other *RealTrainSight) {
+			main.Sources = mergeSources(main.Sources, other.Sources)
+		})
+}
+
+func mergeDuplicateMovingTrainSights(sights []RealMovingTrainSight, tolerance time.Duration) []RealMovingTrainSight {
+	return mergeDuplicates(sights, tolerance,
+		func(rmts *RealMovingTrainSight) (Trip, time.Time) {
+			return rmts.MovingTrainSight.Trip, rmts.Date
+		},
+		func(main *RealMovingTrainSight, other *RealMovingTrainSight) {
+			main.Sources = mergeSources(main.Sources, other.Sources)
+		})
+}
@@ -0,0 +1,93 @@
+package trainmapdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTrainNumber(t *testing.T) {
+	for shortName, expected := range map[string]string{
+		"TGV 9203":   "9203",
+		"009203":     "9203",
+		"EC 151 (1)": "151",
+		"RE":         "",
+	} {
+		if got := normalizeTrainNumber(shortName); got != expected {
+			t.Errorf("got train number %q for %q, expected %q", got, shortName, expected)
+		}
+	}
+}
+
+// testSight returns a sight of the given trip, calling at the given stations every 30 minutes from the given time.
+func testSight(feedId string, shortName string, start time.Time, stationIds ...string) RealTrainSight {
+	trip := Trip{FeedId: feedId, TripId: feedId + "-" + shortName, TripShortName: shortName}
+	for i, stationId := range stationIds {
+		departure := start.Add(time.Duration(i) * 30 * time.Minute)
+		trip.StopTimes = append(trip.StopTimes, StopTime{
+			StopSequence:  uint(i),
+			DepartureTime: departure,
+			Stop:          &Stop{FeedId: feedId, StopId: stationId, StationId: &stationId},
+		})
+	}
+	return RealTrainSight{
+		TrainSight: TrainSight{FeedId: feedId, TripId: trip.TripId, Trip: trip},
+		Timestamp:  start,
+		Date:       start.Truncate(24 * time.Hour),
+		Sources:    []FeededTrip{{FeedId: feedId, TripId: trip.TripId}},
+	}
+}
+
+func sightSources(sights []RealTrainSight) [][]FeededTrip {
+	sources := make([][]FeededTrip, len(sights))
+	for i, sight := range sights {
+		sources[i] = sight.Sources
+	}
+	return sources
+}
+
+func TestMergeDuplicateTrainSights(t *testing.T) {
+	start := time.Date(2024, 5, 14, 8, 0, 0, 0, time.UTC)
+	short := testSight("1", "TGV 9203", start, "paris", "dijon")
+	other := testSight("1", "TER 891100", start.Add(time.Minute), "dijon", "besancon")
+	detailed := testSight("2", "9203", start.Add(2*time.Minute), "paris", "dijon", "basel")
+	late := testSight("2", "9203", start.Add(time.Hour), "paris", "dijon", "basel")
+
+	//the main sight stays where the first one was, with the most detailed trip
+	merged := mergeDuplicateTrainSights([]RealTrainSight{short, other, detailed}, 5*time.Minute)
+	expectedSources := [][]FeededTrip{
+		{{FeedId: "2", TripId: "2-9203"}, {FeedId: "1", TripId: "1-TGV 9203"}},
+		{{FeedId: "1", TripId: "1-TER 891100"}},
+	}
+	if !reflect.DeepEqual(sightSources(merged), expectedSources) {
+		t.Errorf("got sources %v, expected %v", sightSources(merged), expectedSources)
+	}
+	if len(merged) == 2 && len(merged[0].TrainSight.Trip.StopTimes) != 3 {
+		t.Errorf("the main sight should show the most detailed trip, got %d stop times", len(merged[0].TrainSight.Trip.StopTimes))
+	}
+
+	//a less detailed duplicate is merged into the main sight
+	merged = mergeDuplicateTrainSights([]RealTrainSight{detailed, other, short}, 5*time.Minute)
+	expectedSources = [][]FeededTrip{
+		{{FeedId: "2", TripId: "2-9203"}, {FeedId: "1", TripId: "1-TGV 9203"}},
+		{{FeedId: "1", TripId: "1-TER 891100"}},
+	}
+	if !reflect.DeepEqual(sightSources(merged), expectedSources) {
+		t.Errorf("got sources %v, expected %v", sightSources(merged), expectedSources)
+	}
+
+	for _, test := range []struct {
+		name      string
+		sights    []RealTrainSight
+		tolerance time.Duration
+	}{
+		{"times out of tolerance", []RealTrainSight{short, late}, 5 * time.Minute},
+		{"same feed", []RealTrainSight{short, testSight("1", "9203", start, "paris", "dijon", "basel")}, 5 * time.Minute},
+		{"merging disabled", []RealTrainSight{short, detailed}, 0},
+	} {
+		merged := mergeDuplicateTrainSights(test.sights, test.tolerance)
+		if !reflect.DeepEqual(sightSources(merged), sightSources(test.sights)) {
+			t.Errorf("%s: got sources %v, the sights shouldn't be merged", test.name, sightSources(merged))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package trainmapdb
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// A LoadEventType tells what a LoadEvent reports.
+type LoadEventType string
+
+const (
+	LoadEventPhase          LoadEventType = "phase"           //a phase of the load (or of a feed's load) started
+	LoadEventDownloaded     LoadEventType = "downloaded"      //a feed was downloaded (Bytes, Duration)
+	LoadEventFileParsed     LoadEventType = "file_parsed"     //a file of a feed was parsed (File, Rows)
+	LoadEventRowsWritten    LoadEventType = "rows_written"    //a batch of rows of a feed was written (Table, Rows)
+	LoadEventWriterProgress LoadEventType = "writer_progress" //sent regularly during the load (Rows written so far, Duration since the start)
+	LoadEventFeedSkipped    LoadEventType = "feed_skipped"    //a feed was already loaded from the same source, see LoaderConfig.Resume
+	LoadEventRoutesExcluded LoadEventType = "routes_excluded" //summary of the routes of a feed excluded by its rules (Detail, Rows = excluded trips), see LoaderConfigEntry.Routes
+	LoadEventTripsCut       LoadEventType = "trips_cut"       //summary of the trips of a feed shortened or dropped since some of their stops have no location (Detail, Rows = dropped trips)
+	LoadEventFeedDone       LoadEventType = "feed_done"       //a feed was completely written (Rows, Duration)
+	LoadEventFeedFailed     LoadEventType = "feed_failed"     //a feed could not be loaded (Err)
+	LoadEventDone           LoadEventType = "done"            //the whole load is done (Rows, Duration)
+)
+
+// A LoadPhase is a step of a load, or of a single feed's load when the event has a FeedId.
+type LoadPhase string
+
+const (
+	LoadPhaseMigrate         LoadPhase = "migrate"
+	LoadPhaseFetch           LoadPhase = "fetch"  //feeds are downloaded or read from their cache concurrently
+	LoadPhaseResume          LoadPhase = "resume" //removing feeds not in the config anymore or loaded again (Detail = feed ID)
+	LoadPhaseFeeds           LoadPhase = "feeds"  //feeds are parsed and written concurrently
+	LoadPhaseWrite           LoadPhase = "write"  //waiting for the last rows to be written
+	LoadPhasePrune           LoadPhase = "prune"  //see LoaderConfig.DateWindow
+	LoadPhaseTripBounds      LoadPhase = "trip_bounds"
+	LoadPhaseIndexes         LoadPhase = "indexes" //Detail = index name
+	LoadPhaseSpatialIndex    LoadPhase = "spatial_index"
+	LoadPhaseForeignKeys     LoadPhase = "foreign_keys"
+	LoadPhaseSnapshot        LoadPhase = "snapshot"
+	LoadPhaseValidate        LoadPhase = "validate" //see BuildDatabase
+	LoadPhaseSchemaMigration LoadPhase = "schema_migration"
+	LoadPhaseDownload        LoadPhase = "download"   //feed phase, File = URL
+	LoadPhaseReadCache       LoadPhase = "read_cache" //feed phase, File = cached file
+	LoadPhaseParse           LoadPhase = "parse"      //feed phase
+	LoadPhaseClip            LoadPhase = "clip"       //feed phase, see LoaderConfig.Region (Detail = what was kept)
+)
+
+// A LoadEvent reports the progress of a load (or of a schema migration). Only the fields relevant to its Type are set.
+type LoadEvent struct {
+	Type     LoadEventType
+	Time     time.Time
+	FeedId   string //empty for events about the whole load
+	FeedName string //display name of the feed
+	Phase    LoadPhase
+	Detail   string
+	File     string
+	Table    string
+	Rows     int64
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// A LoadObserver receives the events of loads, see FetcherConfig.Observer.
+// Feeds are loaded concurrently, so OnLoadEvent must be safe for concurrent use, and should return quickly.
+type LoadObserver interface {
+	OnLoadEvent(event LoadEvent)
+}
+
+// A LoadObserverFunc is a function used as a LoadObserver.
+type LoadObserverFunc func(event LoadEvent)
+
+func (fn LoadObserverFunc) OnLoadEvent(event LoadEvent) {
+	fn(event)
+}
+
+// NewSlogObserver returns a LoadObserver logging every event to the given logger (failures as errors, batch writes as debug).
+func NewSlogObserver(logger *slog.Logger) LoadObserver {
+	return LoadObserverFunc(func(event LoadEvent) {
+		level := slog.LevelInfo
+		switch event.Type {
+		case LoadEventRowsWritten:
+			level = slog.LevelDebug
+		case LoadEventFeedFailed:
+			level = slog.LevelError
+		}
+		var attrs []slog.Attr
+		for _, attr := range []struct {
+			key   string
+			value string
+		}{
+			{"feed_id", event.FeedId},
+			{"feed", event.FeedName},
+			{"phase", string(event.Phase)},
+			{"detail", event.Detail},
+			{"file", event.File},
+			{"table", event.Table},
+		} {
+			if attr.value != "" {
+				attrs = append(attrs, slog.String(attr.key, attr.value))
+			}
+		}
+		if event.Rows != 0 {
+			attrs = append(attrs, slog.Int64("rows", event.Rows))
+		}
+		if event.Bytes != 0 {
+			attrs = append(attrs, slog.Int64("bytes", event.Bytes))
+		}
+		if event.Duration != 0 {
+			attrs = append(attrs, slog.Duration("duration", event.Duration))
+		}
+		if event.Err != nil {
+			attrs = append(attrs, slog.String("error", event.Err.Error()))
+		}
+		logger.LogAttrs(context.Background(), level, "trainmap load: "+string(event.Type), attrs...)
+	})
+}
+
+// emit sends the event to the configured observer, if any.
+func (f Fetcher) emit(event LoadEvent) {
+	if f.Config.Observer == nil {
+		return
+	}
+	event.Time = time.Now()
+	f.Config.Observer.OnLoadEvent(event)
+}
+
+// emitPhase reports that a phase of the whole load started.
+func (f Fetcher) emitPhase(phase LoadPhase) {
+	f.emit(LoadEvent{Type: LoadEventPhase, Phase: phase})
+}
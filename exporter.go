@@ -0,0 +1,575 @@
+package trainmapdb
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ExportFilter restricts what gets exported to a GTFS file. Zero values mean no restriction.
+type ExportFilter struct {
+	FeedIds     []string     `json:"feed_ids"`
+	BoundingBox *BoundingBox `json:"bounding_box"` //trips whose bounding box intersects this one
+	RouteTypes  []RouteType  `json:"route_types"`
+	StartDate   time.Time    `json:"start_date"` //only services running from that date on (inclusive)
+	EndDate     time.Time    `json:"end_date"`   //only services running up to that date (inclusive)
+}
+
+// ExportGTFSFile writes the (filtered) DB contents to a GTFS zip file at the given path.
+// The file is written next to it first and only moved into place once complete, so a failed export leaves nothing behind.
+func (f Fetcher) ExportGTFSFile(path string, filter ExportFilter) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = f.ExportGTFS(file, filter)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// ExportGTFS writes the (filtered) DB contents as a GTFS zip to the given writer.
+// When several feeds are exported, all IDs get prefixed by their feed ID to avoid collisions.
+func (f Fetcher) ExportGTFS(w io.Writer, filter ExportFilter) error {
+	if f.db == nil {
+		return ErrNoDatabase
+	}
+	exporter := gtfsExporter{
+		fetcher:       f,
+		filter:        filter,
+		zipWriter:     zip.NewWriter(w),
+		tripIds:       make(map[string][]string),
+		serviceIds:    make(map[FeededService]bool),
+		routeIds:      make(map[string]map[string]bool),
+		stopIds:       make(map[string]map[string]bool),
+		agencyIds:     make(map[string]map[string]bool),
+		feedAgencyIds: make(map[string]string),
+	}
+	feeds, err := exporter.getFeeds()
+	if err != nil {
+		return err
+	}
+	exporter.prefixIds = len(feeds) > 1
+
+	steps := []func() error{
+		exporter.writeTrips,
+		exporter.writeStopTimes,
+		exporter.writeStops,
+		exporter.writeRoutes,
+		exporter.writeAgencies,
+		exporter.writeCalendars,
+		exporter.writeCalendarDates,
+		func() error { return exporter.writeFeedInfo(feeds) },
+	}
+	for _, step := range steps {
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+	return exporter.zipWriter.Close()
+}
+
+type gtfsExporter struct {
+	fetcher   Fetcher
+	filter    ExportFilter
+	zipWriter *zip.Writer
+	prefixIds bool
+	//everything referenced by the exported trips, by feed ID
+	tripIds    map[string][]string
+	serviceIds map[FeededService]bool
+	routeIds   map[string]map[string]bool
+	stopIds    map[string]map[string]bool
+	agencyIds  map[string]map[string]bool
+	//ID of the only agency of every feed with routes without agency_id, see feedAgencyId
+	feedAgencyIds map[string]string
+}
+
+func addToSet(set map[string]map[string]bool, feedId string, id string) {
+	if set[feedId] == nil {
+		set[feedId] = make(map[string]bool)
+	}
+	set[feedId][id] = true
+}
+
+// mapKeys returns the sorted keys of the given map.
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// exportId returns the ID as written in the exported file.
+func (e *gtfsExporter) exportId(feedId string, id string) string {
+	if !e.prefixIds || id == "" {
+		return id
+	}
+	return feedId + ":" + id
+}
+
+// exportAgencyId returns the agency ID as written in the exported file. Unlike other IDs, agency IDs may be empty
+// (single agency feeds), but they're still prefixed: the routes of several feeds can't all refer to an empty agency_id.
+func (e *gtfsExporter) exportAgencyId(feedId string, agencyId string) string {
+	if !e.prefixIds {
+		return agencyId
+	}
+	return feedId + ":" + agencyId
+}
+
+// feedAgencyId returns the ID of the only agency of the feed, which routes without agency_id refer to.
+// It returns an empty ID if the feed doesn't have exactly one agency.
+func (e *gtfsExporter) feedAgencyId(feedId string) (string, error) {
+	agencyId, ok := e.feedAgencyIds[feedId]
+	if ok {
+		return agencyId, nil
+	}
+	var agencyIds []string
+	err := e.fetcher.db.Model(&Agency{}).Where("feed_id = ?", feedId).Limit(2).Pluck("agency_id", &agencyIds).Error
+	if err != nil {
+		return "", err
+	}
+	if len(agencyIds) == 1 {
+		agencyId = agencyIds[0]
+	}
+	e.feedAgencyIds[feedId] = agencyId
+	return agencyId, nil
+}
+
+// formatGtfsTime converts a time stored in the DB back to "hh:mm:ss" (possibly over 24h).
+func formatGtfsTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	duration := t.Sub(time.Unix(0, 0))
+	hours := int(duration / time.Hour)
+	minutes := int(duration%time.Hour) / int(time.Minute)
+	seconds := int(duration%time.Minute) / int(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
+}
+
+func formatGtfsBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func formatGtfsFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+const gtfsDateFormat = "20060102"
+
+// writeCsvFile creates a file in the zip and lets the given function write its records.
+func (e *gtfsExporter) writeCsvFile(fileName string, header []string, writeRecords func(csvWriter *csv.Writer) error) error {
+	fileWriter, err := e.zipWriter.Create(fileName)
+	if err != nil {
+		return err
+	}
+	csvWriter := csv.NewWriter(fileWriter)
+	err = csvWriter.Write(header)
+	if err != nil {
+		return err
+	}
+	err = writeRecords(csvWriter)
+	if err != nil {
+		return fmt.Errorf("error while exporting %s: %s", fileName, err.Error())
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func (e *gtfsExporter) getFeeds() ([]Feed, error) {
+	var feeds []Feed
+	query := e.fetcher.db.Model(&Feed{})
+	if len(e.filter.FeedIds) > 0 {
+		query = query.Where("feed_id IN ?", e.filter.FeedIds)
+	}
+	err := query.Order("feed_id").Find(&feeds).Error
+	return feeds, err
+}
+
+func (e *gtfsExporter) writeTrips() error {
+	query := e.fetcher.db.Model(&Trip{}).
+		Joins("JOIN routes r ON r.feed_id = trips.feed_id AND r.route_id = trips.ref_route_id")
+	if len(e.filter.FeedIds) > 0 {
+		query = query.Where("trips.feed_id IN ?", e.filter.FeedIds)
+	}
+	if len(e.filter.RouteTypes) > 0 {
+		query = query.Where("r.route_type IN ?", e.filter.RouteTypes)
+	}
+	if bb := e.filter.BoundingBox; bb != nil {
+		query = query.Where("(trips.max_lat >= ?) AND (trips.min_lat <= ?) AND (trips.max_lon >= ?) AND (trips.min_lon <= ?)",
+			bb.MinLat, bb.MaxLat, bb.MinLon, bb.MaxLon)
+	}
+	if !e.filter.StartDate.IsZero() || !e.filter.EndDate.IsZero() {
+		subQuery := e.fetcher.db.Model(&ServiceDay{}).Select("1").
+			Where("service_days.feed_id = trips.feed_id AND service_days.service_id = trips.ref_service_id")
+		if !e.filter.StartDate.IsZero() {
+			subQuery = subQuery.Where("service_days.date >= ?", e.filter.StartDate)
+		}
+		if !e.filter.EndDate.IsZero() {
+			subQuery = subQuery.Where("service_days.date <= ?", e.filter.EndDate)
+		}
+		query = query.Where("EXISTS (?)", subQuery)
+	}
+	var trips []Trip
+	err := query.Select("trips.*").Order("trips.feed_id, trips.trip_id").Find(&trips).Error
+	if err != nil {
+		return err
+	}
+
+	header := []string{"route_id", "service_id", "trip_id", "trip_headsign", "trip_short_name"}
+	return e.writeCsvFile("trips.txt", header, func(csvWriter *csv.Writer) error {
+		for _, trip := range trips {
+			e.tripIds[trip.FeedId] = append(e.tripIds[trip.FeedId], trip.TripId)
+			e.serviceIds[FeededService{FeedId: trip.FeedId, ServiceId: trip.RefServiceId}] = true
+			addToSet(e.routeIds, trip.FeedId, trip.RefRouteId)
+			err := csvWriter.Write([]string{
+				e.exportId(trip.FeedId, trip.RefRouteId),
+				e.exportId(trip.FeedId, trip.RefServiceId),
+				e.exportId(trip.FeedId, trip.TripId),
+				trip.Headsign,
+				trip.TripShortName,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forEachIdChunk calls the given function with chunks of IDs, to keep the SQL parameter count reasonable.
+func forEachIdChunk(ids []string, callback func(chunk []string) error) error {
+	const chunkSize = 500
+	for start := 0; start < len(ids); start += chunkSize {
+		err := callback(ids[start:min(start+chunkSize, len(ids))])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *gtfsExporter) writeStopTimes() error {
+	header := []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence", "stop_headsign", "pickup_type", "drop_off_type"}
+	return e.writeCsvFile("stop_times.txt", header, func(csvWriter *csv.Writer) error {
+		for _, feedId := range mapKeys(e.tripIds) {
+			err := forEachIdChunk(e.tripIds[feedId], func(tripIds []string) error {
+				var stopTimes []StopTime
+				err := e.fetcher.db.Where("feed_id = ? AND trip_id IN ?", feedId, tripIds).
+					Order("trip_id, stop_sequence").Find(&stopTimes).Error
+				if err != nil {
+					return err
+				}
+				for _, st := range stopTimes {
+					addToSet(e.stopIds, st.FeedId, st.StopId)
+					err = csvWriter.Write([]string{
+						e.exportId(st.FeedId, st.TripId),
+						formatGtfsTime(st.ArrivalTime),
+						formatGtfsTime(st.DepartureTime),
+						e.exportId(st.FeedId, st.StopId),
+						strconv.FormatUint(uint64(st.StopSequence), 10),
+						st.StopHeadsign,
+						strconv.FormatUint(uint64(st.PickupType), 10),
+						strconv.FormatUint(uint64(st.DropOffType), 10),
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *gtfsExporter) writeStops() error {
+	header := []string{"stop_id", "stop_code", "stop_name", "tts_stop_name", "stop_desc", "stop_lat", "stop_lon", "stop_url", "location_type", "parent_station"}
+	return e.writeCsvFile("stops.txt", header, func(csvWriter *csv.Writer) error {
+		for _, feedId := range mapKeys(e.stopIds) {
+			//parent stations aren't referenced by stop times, so fetch them in a second pass
+			stopIds := mapKeys(e.stopIds[feedId])
+			writtenStops := make(map[string]bool)
+			for len(stopIds) > 0 {
+				parentIds := make(map[string]bool)
+				err := forEachIdChunk(stopIds, func(chunk []string) error {
+					var stops []Stop
+					err := e.fetcher.db.Where("feed_id = ? AND stop_id IN ?", feedId, chunk).Order("stop_id").Find(&stops).Error
+					if err != nil {
+						return err
+					}
+					for _, stop := range stops {
+						writtenStops[stop.StopId] = true
+						locationType := ""
+						if stop.LocationType != nil {
+							locationType = strconv.Itoa(int(*stop.LocationType))
+						}
+						parentStation := ""
+						if stop.ParentStationId != nil && *stop.ParentStationId != "" {
+							parentStation = e.exportId(feedId, *stop.ParentStationId)
+							if !writtenStops[*stop.ParentStationId] {
+								parentIds[*stop.ParentStationId] = true
+							}
+						}
+						err = csvWriter.Write([]string{
+							e.exportId(feedId, stop.StopId),
+							stop.StopCode,
+							stop.StopName,
+							stop.TtsStopName,
+							stop.StopDesc,
+							formatGtfsFloat(stop.StopLat),
+							formatGtfsFloat(stop.StopLon),
+							stop.StopUrl,
+							locationType,
+							parentStation,
+						})
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				for parentId := range parentIds {
+					if writtenStops[parentId] {
+						delete(parentIds, parentId)
+					}
+				}
+				stopIds = mapKeys(parentIds)
+			}
+		}
+		return nil
+	})
+}
+
+func (e *gtfsExporter) writeRoutes() error {
+	header := []string{"route_id", "agency_id", "route_short_name", "route_long_name", "route_desc", "route_type", "route_color", "route_text_color"}
+	return e.writeCsvFile("routes.txt", header, func(csvWriter *csv.Writer) error {
+		for _, feedId := range mapKeys(e.routeIds) {
+			err := forEachIdChunk(mapKeys(e.routeIds[feedId]), func(routeIds []string) error {
+				var routes []Route
+				err := e.fetcher.db.Where("feed_id = ? AND route_id IN ?", feedId, routeIds).Order("route_id").Find(&routes).Error
+				if err != nil {
+					return err
+				}
+				for _, route := range routes {
+					agencyId := route.AgencyId
+					if agencyId == "" {
+						//name the agency explicitly, the exported file may have several
+						agencyId, err = e.feedAgencyId(feedId)
+						if err != nil {
+							return err
+						}
+					}
+					addToSet(e.agencyIds, feedId, agencyId)
+					err = csvWriter.Write([]string{
+						e.exportId(feedId, route.RouteId),
+						e.exportAgencyId(feedId, agencyId),
+						route.RouteShortName,
+						route.RouteLongName,
+						route.RouteDesc,
+						strconv.Itoa(int(route.RouteType)),
+						route.RouteColor,
+						route.RouteTextColor,
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *gtfsExporter) writeAgencies() error {
+	header := []string{"agency_id", "agency_name", "agency_url", "agency_timezone", "agency_lang"}
+	return e.writeCsvFile("agency.txt", header, func(csvWriter *csv.Writer) error {
+		for _, feedId := range mapKeys(e.agencyIds) {
+			var agencies []Agency
+			query := e.fetcher.db.Where("feed_id = ?", feedId)
+			//routes without agency_id refer to the only agency of the feed, if any, so keep all of them in that case
+			if !e.agencyIds[feedId][""] {
+				query = query.Where("agency_id IN ?", mapKeys(e.agencyIds[feedId]))
+			}
+			err := query.Order("agency_id").Find(&agencies).Error
+			if err != nil {
+				return err
+			}
+			for _, agency := range agencies {
+				err = csvWriter.Write([]string{
+					e.exportAgencyId(feedId, agency.AgencyId),
+					agency.AgencyName,
+					agency.AgencyUrl,
+					agency.AgencyTimezone,
+					agency.AgencyLang,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// servicesByFeed returns the exported service IDs grouped by feed.
+func (e *gtfsExporter) servicesByFeed() map[string][]string {
+	services := make(map[string]map[string]bool)
+	for feededService := range e.serviceIds {
+		addToSet(services, feededService.FeedId, feededService.ServiceId)
+	}
+	result := make(map[string][]string, len(services))
+	for feedId, serviceIds := range services {
+		result[feedId] = mapKeys(serviceIds)
+	}
+	return result
+}
+
+func (e *gtfsExporter) writeCalendars() error {
+	header := []string{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"}
+	services := e.servicesByFeed()
+	return e.writeCsvFile("calendar.txt", header, func(csvWriter *csv.Writer) error {
+		for _, feedId := range mapKeys(services) {
+			err := forEachIdChunk(services[feedId], func(serviceIds []string) error {
+				var calendars []Calendar
+				err := e.fetcher.db.Where("feed_id = ? AND service_id IN ?", feedId, serviceIds).Order("service_id").Find(&calendars).Error
+				if err != nil {
+					return err
+				}
+				for _, calendar := range calendars {
+					//clip the calendar to the exported date range
+					if !e.filter.StartDate.IsZero() && calendar.StartDate.Before(e.filter.StartDate) {
+						calendar.StartDate = e.filter.StartDate
+					}
+					if !e.filter.EndDate.IsZero() && calendar.EndDate.After(e.filter.EndDate) {
+						calendar.EndDate = e.filter.EndDate
+					}
+					if calendar.EndDate.Before(calendar.StartDate) {
+						continue
+					}
+					err = csvWriter.Write([]string{
+						e.exportId(feedId, calendar.ServiceId),
+						formatGtfsBool(calendar.Monday),
+						formatGtfsBool(calendar.Tuesday),
+						formatGtfsBool(calendar.Wednesday),
+						formatGtfsBool(calendar.Thursday),
+						formatGtfsBool(calendar.Friday),
+						formatGtfsBool(calendar.Saturday),
+						formatGtfsBool(calendar.Sunday),
+						calendar.StartDate.Format(gtfsDateFormat),
+						calendar.EndDate.Format(gtfsDateFormat),
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *gtfsExporter) writeCalendarDates() error {
+	header := []string{"service_id", "date", "exception_type"}
+	services := e.servicesByFeed()
+	return e.writeCsvFile("calendar_dates.txt", header, func(csvWriter *csv.Writer) error {
+		for _, feedId := range mapKeys(services) {
+			err := forEachIdChunk(services[feedId], func(serviceIds []string) error {
+				var calendarDates []CalendarDate
+				query := e.fetcher.db.Where("feed_id = ? AND service_id IN ?", feedId, serviceIds)
+				if !e.filter.StartDate.IsZero() {
+					query = query.Where("date >= ?", e.filter.StartDate)
+				}
+				if !e.filter.EndDate.IsZero() {
+					query = query.Where("date <= ?", e.filter.EndDate)
+				}
+				err := query.Order("service_id, date").Find(&calendarDates).Error
+				if err != nil {
+					return err
+				}
+				for _, calendarDate := range calendarDates {
+					err = csvWriter.Write([]string{
+						e.exportId(feedId, calendarDate.ServiceId),
+						calendarDate.Date.Format(gtfsDateFormat),
+						strconv.FormatUint(uint64(calendarDate.ExceptionType), 10),
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *gtfsExporter) writeFeedInfo(feeds []Feed) error {
+	header := []string{"feed_publisher_name", "feed_publisher_url", "feed_lang", "default_lang", "feed_version", "feed_contact_email", "feed_contact_url"}
+	return e.writeCsvFile("feed_info.txt", header, func(csvWriter *csv.Writer) error {
+		if len(feeds) == 0 {
+			return nil
+		}
+		//the spec only allows a single feed_info entry, so merge them if needed
+		feed := feeds[0]
+		if len(feeds) > 1 {
+			publisherNames := make([]string, 0, len(feeds))
+			for _, otherFeed := range feeds {
+				publisherNames = append(publisherNames, firstNonEmpty(otherFeed.PublisherName, otherFeed.DisplayName))
+			}
+			feed = Feed{PublisherName: strings.Join(publisherNames, " / "), FeedLang: "mul"}
+		}
+		return csvWriter.Write([]string{
+			feed.PublisherName,
+			feed.PublisherUrl,
+			feed.FeedLang,
+			feed.DefaultLang,
+			feed.Version,
+			feed.ContactEmail,
+			feed.ContactUrl,
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package trainmapdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describeTrips returns a description of every trip of the DB (route, agency, running dates and stop times),
+// by trip ID as given by tripId.
+func describeTrips(t *testing.T, fetcher *Fetcher, tripId func(feedId string, id string) string) map[string]string {
+	t.Helper()
+	var trips []Trip
+	err := fetcher.db.Preload("Route").Find(&trips).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptions := make(map[string]string, len(trips))
+	for _, trip := range trips {
+		//routes without agency_id refer to the only agency of their feed
+		var agency Agency
+		query := fetcher.db.Where("feed_id = ?", trip.FeedId)
+		if trip.Route.AgencyId != "" {
+			query = query.Where("agency_id = ?", trip.Route.AgencyId)
+		}
+		err = query.Take(&agency).Error
+		if err != nil {
+			t.Fatalf("trip %s: no agency %q: %s", trip.TripId, trip.Route.AgencyId, err.Error())
+		}
+		var serviceDays []ServiceDay
+		err = fetcher.db.Where("feed_id = ? AND service_id = ?", trip.FeedId, trip.RefServiceId).Order("date").Find(&serviceDays).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stopTimes []StopTime
+		err = fetcher.db.Where("feed_id = ? AND trip_id = ?", trip.FeedId, trip.TripId).Order("stop_sequence").Find(&stopTimes).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := []string{trip.Route.RouteShortName, agency.AgencyName, trip.TripShortName, trip.Headsign}
+		for _, serviceDay := range serviceDays {
+			parts = append(parts, serviceDay.Date.UTC().Format(time.DateOnly))
+		}
+		for _, stopTime := range stopTimes {
+			var stop Stop
+			err = fetcher.db.Where("feed_id = ? AND stop_id = ?", stopTime.FeedId, stopTime.StopId).Take(&stop).Error
+			if err != nil {
+				t.Fatalf("trip %s: no stop %q: %s", trip.TripId, stopTime.StopId, err.Error())
+			}
+			parts = append(parts, fmt.Sprintf("%d %s (%s) %s-%s %d/%d",
+				stopTime.StopSequence, stop.StopName, formatGtfsFloat(stop.StopLat), formatGtfsTime(stopTime.ArrivalTime), formatGtfsTime(stopTime.DepartureTime), stopTime.PickupType, stopTime.DropOffType))
+		}
+		descriptions[tripId(trip.FeedId, trip.TripId)] = strings.Join(parts, " | ")
+	}
+	return descriptions
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	source := loadTestDatabase(t, testFeed(FeedFormatNeTEx, "testdata/netex.xml"), testFeed(FeedFormatHRDF, zipTestFeed(t, "testdata/hrdf")))
+	//like GTFS feeds with a single agency, whose routes may omit agency_id
+	err := source.db.Model(&Route{}).Where("feed_id = ?", "1").Update("agency_id", "").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exportPath := filepath.Join(t.TempDir(), "export.zip")
+	err = source.ExportGTFSFile(exportPath, ExportFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := loadTestDatabase(t, testFeed(FeedFormatGTFS, exportPath))
+
+	expected := describeTrips(t, source, func(feedId string, id string) string { return feedId + ":" + id })
+	got := describeTrips(t, exported, func(feedId string, id string) string { return id })
+	if len(got) != len(expected) {
+		t.Errorf("got %d trips, expected %d", len(got), len(expected))
+	}
+	for _, tripId := range mapKeys(expected) {
+		if got[tripId] != expected[tripId] {
+			t.Errorf("trip %s:\n got      %s\n expected %s", tripId, got[tripId], expected[tripId])
+		}
+	}
+
+	var agencyIds []string
+	err = exported.db.Model(&Agency{}).Order("agency_id").Pluck("agency_id", &agencyIds).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(agencyIds, []string{"1:FR:Operator:TER", "2:000011"}) {
+		t.Errorf("got agencies %v", agencyIds)
+	}
+}
+
+func TestExportGTFSFileFailure(t *testing.T) {
+	dir := t.TempDir()
+	exportPath := filepath.Join(dir, "export.zip")
+	err := (Fetcher{}).ExportGTFSFile(exportPath, ExportFilter{})
+	if err == nil {
+		t.Fatal("exporting without a DB should fail")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("a failed export should leave nothing behind, found %v", entries)
+	}
+}
@@ -0,0 +1,58 @@
+package trainmapdb
+
+// feedRules holds the rules of a feed's config entry: its transformers, route filter and region.
+type feedRules struct {
+	writer       *dbWriter
+	region       *Region
+	transformers feedTransformers
+	filter       *routeFilter
+	exclusions   *routeExclusions
+}
+
+// the entities of a feed the rules apply to
+type feedEntities struct {
+	agencies  []Agency
+	routes    []Route
+	trips     []Trip
+	stopTimes []StopTime
+	stops     []Stop
+}
+
+func newFeedRules(writer *dbWriter, feedId string, configEntry LoaderConfigEntry) (*feedRules, error) {
+	transformers, err := newFeedTransformers(feedId, configEntry)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := configEntry.Routes.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &feedRules{writer: writer, region: configEntry.Region, transformers: transformers, filter: filter, exclusions: newRouteExclusions()}, nil
+}
+
+// applyFeedRules applies every rule of the config entry to a whole feed, for the formats parsed in one go (NeTEx, HRDF).
+// It returns the IDs of the services the kept trips run on.
+func applyFeedRules(writer *dbWriter, feedId string, configEntry LoaderConfigEntry, entities *feedEntities) (map[string]bool, error) {
+	rules, err := newFeedRules(writer, feedId, configEntry)
+	if err != nil {
+		return nil, err
+	}
+	entities.agencies, entities.routes, entities.trips, entities.stopTimes, entities.stops = rules.transformers.transformFeed(
+		entities.agencies, entities.routes, entities.trips, entities.stopTimes, entities.stops)
+	entities.routes = rules.filter.filterRoutes(entities.routes, rules.exclusions)
+	entities.trips, entities.stopTimes = rules.exclusions.filterTrips(entities.trips, entities.stopTimes)
+	return rules.clip(entities)
+}
+
+// clip reports the routes excluded so far, then clips the trips, stop times and stops to the region.
+// GTFS feeds are streamed, so they apply the transformers and the route filter while parsing, and only call clip.
+// It returns the IDs of the services the kept trips run on.
+func (rules *feedRules) clip(entities *feedEntities) (map[string]bool, error) {
+	rules.exclusions.report(rules.writer)
+	var err error
+	entities.trips, entities.stopTimes, entities.stops, err = clipFeed(rules.writer, rules.region, entities.trips, entities.stopTimes, entities.stops)
+	if err != nil {
+		return nil, err
+	}
+	return tripServiceIds(entities.trips), nil
+}
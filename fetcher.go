@@ -1,13 +1,12 @@
 package trainmapdb
 
 import (
+	"context"
 	"fmt"
 	"math"
-	"strings"
 	"time"
 
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 // A FetcherConfig represents the parameters used for a fetcher.
@@ -18,8 +17,15 @@ type FetcherConfig struct {
 	BearingMinThreshold             Bearing //anything below this will be not be considered as much
 	BearingMaxThreshold             Bearing //anything above this will be more favorably considered
 	DatabaseOutOfBoundsGraceDegrees float64
-	CloseHeavyRailStationThreshold  float64 //kilometers
-	CloseTramStationThreshold       float64 //kilometers
+	CloseHeavyRailStationThreshold  float64       //kilometers
+	CloseTramStationThreshold       float64       //kilometers
+	DuplicateTripTimeTolerance      time.Duration //max time difference for trips of different feeds to be merged as the same train, 0 = no merging
+	SpatialIndex                    SpatialIndexType
+	InMemorySnapshot                bool         //answer queries from an in-memory Snapshot built when opening the DB
+	MigrateSchema                   bool         //upgrade DBs built with an older schema in place when opening them, see SchemaVersion
+	AllowIncompleteDatabase         bool         //open DBs whose load didn't complete, to resume it (see LoaderConfig.Resume)
+	Observer                        LoadObserver //receives the progress events of loads and schema migrations, nil = silent
+	Metrics                         Metrics      //receives the load and query metrics, see NewExpvarMetrics, nil = none
 }
 
 func NewDefaultConfig() FetcherConfig {
@@ -32,6 +38,8 @@ func NewDefaultConfig() FetcherConfig {
 		DatabaseOutOfBoundsGraceDegrees: 0.009 * 2,                //used in SQL for trip bounding box
 		CloseHeavyRailStationThreshold:  0.6,
 		CloseTramStationThreshold:       0.2,
+		DuplicateTripTimeTolerance:      3 * time.Minute,
+		SpatialIndex:                    SpatialIndexAuto,
 	}
 }
 
@@ -40,6 +48,12 @@ type Fetcher struct {
 	useMutex bool
 	db       *gorm.DB
 	Config   FetcherConfig
+	Realtime *RealtimeState  //realtime adjustments applied to sight queries
+	ctx      context.Context //nil = context.Background()
+
+	spatialIndex  SpatialIndex
+	snapshot      *snapshotHolder
+	customBackend Backend //see WithBackend
 }
 
 func NewFetcher(dial gorm.Dialector, useMutex bool, config *FetcherConfig) (*Fetcher, error) {
@@ -56,33 +70,53 @@ func NewFetcher(dial gorm.Dialector, useMutex bool, config *FetcherConfig) (*Fet
 	if err != nil {
 		return nil, fmt.Errorf("error while opening DB: %s", err.Error())
 	}
-	return &Fetcher{db: db, useMutex: useMutex, Config: fetcherConfig}, nil
-}
-
-// GetAllTrips fetches all the trips in the DB by batches and returns them.
-func (f Fetcher) GetAllTrips() ([]Trip, error) {
-	var trips, tripBatch []Trip
-	const BATCH_SIZE int = 1000
-	batchIndex := 0
-	for {
-		err := f.db.Offset(BATCH_SIZE * batchIndex).Limit(BATCH_SIZE).Preload(clause.Associations).Preload("StopTimes.Stop").Find(&tripBatch).Error
+	spatialIndex, err := newSpatialIndex(db, fetcherConfig.SpatialIndex)
+	if err != nil {
+		return nil, fmt.Errorf("error while setting up spatial index: %s", err.Error())
+	}
+	fetcher := &Fetcher{db: db, useMutex: useMutex, Config: fetcherConfig, Realtime: NewRealtimeState(), spatialIndex: spatialIndex, snapshot: &snapshotHolder{}}
+	err = fetcher.checkSchema()
+	if err != nil {
+		return nil, err
+	}
+	if fetcherConfig.InMemorySnapshot && db.Migrator().HasTable(&Trip{}) {
+		err = fetcher.ReloadSnapshot()
 		if err != nil {
-			return nil, err
-		}
-		if len(tripBatch) == 0 {
-			break
+			return nil, fmt.Errorf("error while building snapshot: %s", err.Error())
 		}
-		trips = append(trips, tripBatch...)
-		batchIndex++
 	}
-	return trips, nil
+	return fetcher, nil
+}
+
+// WithContext returns a copy of the Fetcher whose queries, loads and sight computations are bound to the given context.
+// Every method of the returned Fetcher stops with the context's error once it's cancelled.
+func (f Fetcher) WithContext(ctx context.Context) *Fetcher {
+	if f.db != nil {
+		f.db = f.db.WithContext(ctx)
+	}
+	f.ctx = ctx
+	return &f
+}
+
+// context returns the context the Fetcher is bound to (context.Background() by default).
+func (f Fetcher) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
+// GetAllTrips fetches all the trips (from the DB by batches) and returns them.
+// Use IterateTrips to process them without holding them all in memory.
+func (f Fetcher) GetAllTrips() ([]Trip, error) {
+	defer f.observeQuery("GetAllTrips", time.Now())
+	return f.Backend().GetAllTrips(f.context())
 }
 
 // GetAllStops returns all the stops in the DB.
 func (f Fetcher) GetAllStops() ([]Stop, error) {
-	var stops []Stop
-	err := f.db.Model(&Stop{}).Preload(clause.Associations).Find(&stops).Error
-	return stops, err
+	defer f.observeQuery("GetAllStops", time.Now())
+	return f.Backend().GetAllStops(f.context())
 }
 
 // A FeededService represents a combined feed ID and service ID.
@@ -93,57 +127,86 @@ type FeededService struct {
 
 // GetServicesOnDate returns all services that are active on a given date.
 func (f Fetcher) GetServicesOnDate(date time.Time) ([]ServiceDay, error) {
+	defer f.observeQuery("GetServicesOnDate", time.Now())
 	//NOTE: SQL "BETWEEN" is inclusive on both sides
 	return f.GetServicesBetweenDates(date, date)
 }
 
 // GetServicesBetweenDates retuns all services that are active between the given dates.
 func (f Fetcher) GetServicesBetweenDates(startDate time.Time, endDate time.Time) ([]ServiceDay, error) {
-	var serviceDays []ServiceDay
-	err := f.db.Model(&ServiceDay{}).Where("Date BETWEEN ? AND ?", startDate, endDate).Find(&serviceDays).Error
-	if err != nil {
-		return nil, err
-	}
-
-	return serviceDays, nil
+	defer f.observeQuery("GetServicesBetweenDates", time.Now())
+	return f.Backend().GetServicesBetweenDates(f.context(), startDate, endDate)
 }
 
 // GetFeededServiceIdTrips returns all trips that run on the given service
 func (f Fetcher) GetFeededServiceIdTrips(feededService FeededService) ([]Trip, error) {
-	var trips []Trip
-	err := f.db.Where("FeedId = ?", feededService.FeedId).Where("RefServiceId = ?", feededService.ServiceId).Find(&trips).Error
-	if err != nil {
-		return nil, err
-	}
-	return trips, nil
+	defer f.observeQuery("GetFeededServiceIdTrips", time.Now())
+	return f.Backend().GetFeededServiceIdTrips(f.context(), feededService)
 }
 
 func (f Fetcher) GetTrip(feedId string, tripId string) (Trip, error) {
-	trip := Trip{FeedId: feedId, TripId: tripId}
-	err := f.db.Model(&Trip{}).Preload(clause.Associations).Preload("Route").Preload("StopTimes.Stop").Preload("StopTimes.Trip").Where(&trip).First(&trip).Error
-	if err != nil {
-		return trip, err
-	}
-	return trip, err
+	defer f.observeQuery("GetTrip", time.Now())
+	return f.Backend().GetTrip(f.context(), feedId, tripId)
 }
 
 func (f Fetcher) GetRoute(feedId string, routeId string) (Route, error) {
-	route := Route{FeedId: feedId, RouteId: routeId}
-	err := f.db.Model(&Route{}).Preload(clause.Associations).Preload("Trips.StopTimes.Stop").Where(&route).First(&route).Error
-	return route, err
+	defer f.observeQuery("GetRoute", time.Now())
+	return f.Backend().GetRoute(f.context(), feedId, routeId)
 }
 
 func (f Fetcher) GetFeed(feedId string) (Feed, error) {
-	feed := Feed{FeedId: feedId}
-	err := f.db.Where(&feed).First(&feed).Error
-	return feed, err
+	defer f.observeQuery("GetFeed", time.Now())
+	return f.Backend().GetFeed(f.context(), feedId)
 }
 
-// GetTripsContaining returns all trips whose bounding box contains the given point
+// GetTripsContaining returns all trips with a segment whose bounding box contains the given point
 func (f Fetcher) GetTripsContaining(pt Point) ([]Trip, error) {
+	defer f.observeQuery("GetTripsContaining", time.Now())
 	return f.GetTripsInsidePointInterval(pt, pt)
 }
 
+// A BoundingBox represents a lat/lon rectangle.
+type BoundingBox struct {
+	MinLat float64 `json:"min_lat"`
+	MaxLat float64 `json:"max_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+// Contains checks whether the given point is inside the bounding box (borders included).
+func (bb BoundingBox) Contains(pt Point) bool {
+	return pt.Lat >= bb.MinLat && pt.Lat <= bb.MaxLat &&
+		pt.Lon >= bb.MinLon && pt.Lon <= bb.MaxLon
+}
+
+func (bb BoundingBox) intersects(other BoundingBox) bool {
+	return bb.MaxLat >= other.MinLat && bb.MinLat <= other.MaxLat &&
+		bb.MaxLon >= other.MinLon && bb.MinLon <= other.MaxLon
+}
+
+func (bb BoundingBox) union(other BoundingBox) BoundingBox {
+	return BoundingBox{
+		MinLat: min(bb.MinLat, other.MinLat),
+		MaxLat: max(bb.MaxLat, other.MaxLat),
+		MinLon: min(bb.MinLon, other.MinLon),
+		MaxLon: max(bb.MaxLon, other.MaxLon),
+	}
+}
+
+// withMargin returns the bounding box grown by the given number of degrees on each side.
+func (bb BoundingBox) withMargin(margin float64) BoundingBox {
+	return BoundingBox{
+		MinLat: bb.MinLat - margin,
+		MaxLat: bb.MaxLat + margin,
+		MinLon: bb.MinLon - margin,
+		MaxLon: bb.MaxLon + margin,
+	}
+}
+
+func (bb BoundingBox) center() Point {
+	return Point{Lat: (bb.MinLat + bb.MaxLat) / 2, Lon: (bb.MinLon + bb.MaxLon) / 2}
+}
+
 func pointsToBoundingBox(pt1, pt2 Point) (minLat, minLon, maxLat, maxLon float64) {
 	minLat = min(pt1.Lat, pt2.Lat)
 	maxLat = max(pt1.Lat, pt2.Lat)
@@ -155,73 +218,72 @@ func pointsToBoundingBox(pt1, pt2 Point) (minLat, minLon, maxLat, maxLon float64
 // GetTripsInsidePointInterval returns all trips whose bounding box intersects with
 // the bounding box formed by the 2 given points.
 func (f Fetcher) GetTripsInsidePointInterval(pt1 Point, pt2 Point) ([]Trip, error) {
+	defer f.observeQuery("GetTripsInsidePointInterval", time.Now())
 	return f.GetTripsWithIntersection(pointsToBoundingBox(pt1, pt2))
 }
 
-// GetTripsWithIntersection returns all trips whose bounding box intersects with
-// the given bounding box.
+// GetTripsWithIntersection returns all trips with a segment (between 2 consecutive stops)
+// whose bounding box intersects with the given bounding box.
 func (f Fetcher) GetTripsWithIntersection(minLat float64, maxLat float64, minLon float64, maxLon float64) ([]Trip, error) {
-	var trips, tripBatch []Trip
-	const batchSize int = 1000
-	batchIndex := 0
-	grace := f.Config.DatabaseOutOfBoundsGraceDegrees
-	for {
-		err := f.db.Offset(batchSize*batchIndex).Limit(batchSize).
-			Where("(max_lat >= ?) AND (min_lat <= ?) AND (max_lon >= ?) AND (min_lon <= ?)",
-				minLat-grace,
-				maxLat+grace,
-				minLon-grace,
-				maxLon+grace).
-			Preload(clause.Associations).Preload("StopTimes.Stop").Find(&tripBatch).Error
-		if err != nil {
-			return nil, err
-		}
-		if len(tripBatch) == 0 {
-			break
-		}
-		trips = append(trips, tripBatch...)
-		batchIndex++
+	defer f.observeQuery("GetTripsWithIntersection", time.Now())
+	box := BoundingBox{MinLat: minLat, MaxLat: maxLat, MinLon: minLon, MaxLon: maxLon}
+	matches, err := f.Backend().GetTripSegmentsWithIntersection(f.context(), box.withMargin(f.Config.DatabaseOutOfBoundsGraceDegrees), FullTripLoadOptions())
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]Trip, len(matches))
+	for i, match := range matches {
+		trips[i] = match.Trip
 	}
 	return trips, nil
 }
 
 func (f Fetcher) GetStop(feedId string, stopId string) (Stop, error) {
-	stop := Stop{FeedId: feedId, StopId: stopId}
-	err := f.db.Preload(clause.Associations).Preload("StopTimes.Trip").Where(&stop).First(&stop).Error
-	return stop, err
+	defer f.observeQuery("GetStop", time.Now())
+	return f.Backend().GetStop(f.context(), feedId, stopId)
 }
 
+// GetStopsLike returns the stops whose name contains the given string.
+// Once stations are matched (see MatchStations), only one stop is returned per station.
 func (f Fetcher) GetStopsLike(name string) ([]Stop, error) {
-	var stops []Stop
-	err := f.db.
-		Preload("Feed").
-		Where("UPPER(stop_name) LIKE ?", "%"+strings.ToUpper(name)+"%").
-		Limit(20).
-		Find(&stops).
-		Error
-	return stops, err
+	defer f.observeQuery("GetStopsLike", time.Now())
+	return f.Backend().GetStopsLike(f.context(), name)
+}
+
+const stopsLikeMaxResults = 20
+
+// uniqueStationStops only keeps the first stop of every station, up to stopsLikeMaxResults stops.
+func uniqueStationStops(stops []Stop) []Stop {
+	seenStations := make(map[string]bool)
+	uniqueStops := make([]Stop, 0, stopsLikeMaxResults)
+	for _, stop := range stops {
+		if stop.StationId != nil {
+			if seenStations[*stop.StationId] {
+				continue
+			}
+			seenStations[*stop.StationId] = true
+		}
+		uniqueStops = append(uniqueStops, stop)
+		if len(uniqueStops) == stopsLikeMaxResults {
+			break
+		}
+	}
+	return uniqueStops
 }
 
 // GetFeeds returns all the feed info known in the DB.
 func (f Fetcher) GetFeeds() ([]Feed, error) {
-	var feeds []Feed
-	err := f.db.Where(&feeds).Find(&feeds).Error
-	return feeds, err
+	defer f.observeQuery("GetFeeds", time.Now())
+	return f.Backend().GetFeeds(f.context())
 }
 
 // GetStopTimesAtStop returns all the StopTimes related to the given Stop.
 func (f Fetcher) GetStopTimesAtStop(feedId string, stopId string) ([]StopTime, error) {
-	var stopTimes []StopTime
-	err := f.db.Where(&StopTime{FeedId: feedId, StopId: stopId}).Find(&stopTimes).Error
-	return stopTimes, err
+	defer f.observeQuery("GetStopTimesAtStop", time.Now())
+	return f.Backend().GetStopTimesAtStop(f.context(), feedId, stopId)
 }
 
 func (f Fetcher) GetAllAgencies() ([]Agency, error) {
-	var agencies []Agency
-	err := f.db.Where(&agencies).Find(&agencies).Error
-	if err != nil {
-		return nil, err
-	}
-	return agencies, nil
-
+	defer f.observeQuery("GetAllAgencies", time.Now())
+	return f.Backend().GetAllAgencies(f.context())
 }
@@ -3,14 +3,22 @@ module github.com/rom-vtn/trainmap-db
 go 1.22.1
 
 require (
+	github.com/jackc/pgx/v5 v5.7.4
 	github.com/jftuga/geodist v1.0.0
 	github.com/jszwec/csvutil v1.10.0
+	gorm.io/driver/sqlite v1.5.7
 	gorm.io/gorm v1.25.12
 )
 
-require golang.org/x/text v0.18.0 // indirect
+require golang.org/x/text v0.21.0 // indirect
 
 require (
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	github.com/jackc/puddle/v2 v2.2.2 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/mattn/go-sqlite3 v1.14.22 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
 )
@@ -0,0 +1,171 @@
+package trainmapdb
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// a gormBackend answers queries from the DB, it's the default Backend of a Fetcher.
+type gormBackend struct {
+	db           *gorm.DB
+	spatialIndex SpatialIndex
+}
+
+// GetAllTrips fetches all the trips in the DB by batches and returns them.
+func (b gormBackend) GetAllTrips(ctx context.Context) ([]Trip, error) {
+	var trips []Trip
+	it := newTripIterator(b.db.WithContext(ctx), FullTripLoadOptions())
+	for it.Next() {
+		trips = append(trips, it.Trip())
+	}
+	return trips, it.Err()
+}
+
+// GetAllStops returns all the stops in the DB.
+func (b gormBackend) GetAllStops(ctx context.Context) ([]Stop, error) {
+	var stops []Stop
+	err := b.db.WithContext(ctx).Model(&Stop{}).Preload(clause.Associations).Find(&stops).Error
+	return stops, err
+}
+
+// GetServicesBetweenDates retuns all services that are active between the given dates.
+func (b gormBackend) GetServicesBetweenDates(ctx context.Context, startDate time.Time, endDate time.Time) ([]ServiceDay, error) {
+	var serviceDays []ServiceDay
+	err := b.db.WithContext(ctx).Model(&ServiceDay{}).Where("Date BETWEEN ? AND ?", startDate, endDate).Find(&serviceDays).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return serviceDays, nil
+}
+
+// GetFeededServiceIdTrips returns all trips that run on the given service
+func (b gormBackend) GetFeededServiceIdTrips(ctx context.Context, feededService FeededService) ([]Trip, error) {
+	var trips []Trip
+	err := b.db.WithContext(ctx).Where("feed_id = ? AND ref_service_id = ?", feededService.FeedId, feededService.ServiceId).Find(&trips).Error
+	if err != nil {
+		return nil, err
+	}
+	return trips, nil
+}
+
+func (b gormBackend) GetTrip(ctx context.Context, feedId string, tripId string) (Trip, error) {
+	trip := Trip{FeedId: feedId, TripId: tripId}
+	err := b.db.WithContext(ctx).Model(&Trip{}).Preload(clause.Associations).Preload("Route").Preload("StopTimes.Stop").Preload("StopTimes.Trip").Where(&trip).First(&trip).Error
+	if err != nil {
+		return trip, err
+	}
+	return trip, err
+}
+
+func (b gormBackend) GetRoute(ctx context.Context, feedId string, routeId string) (Route, error) {
+	route := Route{FeedId: feedId, RouteId: routeId}
+	err := b.db.WithContext(ctx).Model(&Route{}).Preload(clause.Associations).Preload("Trips.StopTimes.Stop").Where(&route).First(&route).Error
+	return route, err
+}
+
+func (b gormBackend) GetFeed(ctx context.Context, feedId string) (Feed, error) {
+	feed := Feed{FeedId: feedId}
+	err := b.db.WithContext(ctx).Where(&feed).First(&feed).Error
+	return feed, err
+}
+
+// GetTripSegmentsWithIntersection looks the segments up in the spatial index, then loads their trips by batches.
+func (b gormBackend) GetTripSegmentsWithIntersection(ctx context.Context, box BoundingBox, options TripLoadOptions) ([]TripMatch, error) {
+	options.StopTimes = true //needed to locate the segments
+	segments, err := b.spatialIndex.Search(ctx, box)
+	if err != nil {
+		return nil, err
+	}
+	stopSequences := make(map[FeededTrip]map[uint]bool)
+	tripIds := make(map[string][]string)
+	for _, segment := range segments {
+		key := FeededTrip{FeedId: segment.FeedId, TripId: segment.TripId}
+		if stopSequences[key] == nil {
+			stopSequences[key] = make(map[uint]bool)
+			tripIds[key.FeedId] = append(tripIds[key.FeedId], key.TripId)
+		}
+		stopSequences[key][segment.StopSequence] = true
+	}
+	var matches []TripMatch
+	db := b.db.WithContext(ctx)
+	loader := newTripLoader(db, options)
+	for _, feedId := range mapKeys(tripIds) {
+		err := forEachIdChunk(tripIds[feedId], func(chunk []string) error {
+			var tripBatch []Trip
+			err := db.Where("feed_id = ? AND trip_id IN ?", feedId, chunk).Find(&tripBatch).Error
+			if err != nil {
+				return err
+			}
+			err = loader.complete(tripBatch)
+			if err != nil {
+				return err
+			}
+			for _, trip := range tripBatch {
+				match := TripMatch{Trip: trip}
+				tripStopSequences := stopSequences[FeededTrip{FeedId: trip.FeedId, TripId: trip.TripId}]
+				for i, stopTime := range trip.StopTimes[:max(len(trip.StopTimes)-1, 0)] {
+					if tripStopSequences[stopTime.StopSequence] {
+						match.Segments = append(match.Segments, i)
+					}
+				}
+				if len(match.Segments) > 0 {
+					matches = append(matches, match)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+func (b gormBackend) GetStop(ctx context.Context, feedId string, stopId string) (Stop, error) {
+	stop := Stop{FeedId: feedId, StopId: stopId}
+	err := b.db.WithContext(ctx).Preload(clause.Associations).Preload("StopTimes.Trip").Where(&stop).First(&stop).Error
+	return stop, err
+}
+
+// GetStopsLike returns the stops whose name contains the given string, see Fetcher.GetStopsLike.
+func (b gormBackend) GetStopsLike(ctx context.Context, name string) ([]Stop, error) {
+	var stops []Stop
+	err := b.db.WithContext(ctx).
+		Preload("Feed").
+		Where("UPPER(stop_name) LIKE ?", "%"+strings.ToUpper(name)+"%").
+		Limit(stopsLikeMaxResults * 5). //leave room for duplicates
+		Find(&stops).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return uniqueStationStops(stops), nil
+}
+
+// GetFeeds returns all the feed info known in the DB.
+func (b gormBackend) GetFeeds(ctx context.Context) ([]Feed, error) {
+	var feeds []Feed
+	err := b.db.WithContext(ctx).Where(&feeds).Find(&feeds).Error
+	return feeds, err
+}
+
+// GetStopTimesAtStop returns all the StopTimes related to the given Stop.
+func (b gormBackend) GetStopTimesAtStop(ctx context.Context, feedId string, stopId string) ([]StopTime, error) {
+	var stopTimes []StopTime
+	err := b.db.WithContext(ctx).Where(&StopTime{FeedId: feedId, StopId: stopId}).Find(&stopTimes).Error
+	return stopTimes, err
+}
+
+func (b gormBackend) GetAllAgencies(ctx context.Context) ([]Agency, error) {
+	var agencies []Agency
+	err := b.db.WithContext(ctx).Where(&agencies).Find(&agencies).Error
+	if err != nil {
+		return nil, err
+	}
+	return agencies, nil
+}
@@ -0,0 +1,609 @@
+package trainmapdb
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAFAS Rohdaten (HRDF) files are fixed width text files, see the "HRDF Realisierungsvorgaben" for the spec.
+// Columns below are 1-indexed like in the spec.
+
+// hrdfColumns returns the trimmed content of line between the (1-indexed, inclusive) given columns.
+// NOTE: columns are counted in characters, not bytes, since names may contain accents.
+func hrdfColumns(line string, from int, to int) string {
+	runes := []rune(line)
+	if from > len(runes) {
+		return ""
+	}
+	to = min(to, len(runes))
+	return strings.TrimSpace(string(runes[from-1 : to]))
+}
+
+// hrdfFiles holds the content of the files of an HRDF archive, indexed by upper case base name.
+type hrdfFiles map[string][]byte
+
+func readHrdfFiles(content []byte) (hrdfFiles, error) {
+	zipFile, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(hrdfFiles)
+	for _, file := range zipFile.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		fileContent, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		//older HRDF versions are latin-1 encoded
+		if !utf8.Valid(fileContent) {
+			runes := make([]rune, len(fileContent))
+			for i, b := range fileContent {
+				runes[i] = rune(b)
+			}
+			fileContent = []byte(string(runes))
+		}
+		files[strings.ToUpper(path.Base(file.Name))] = fileContent
+	}
+	return files, nil
+}
+
+// lines returns the lines of the first file found with one of the given names.
+func (files hrdfFiles) lines(names ...string) ([]string, bool) {
+	for _, name := range names {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		var lines []string
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" || strings.HasPrefix(line, "%") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		return lines, true
+	}
+	return nil, false
+}
+
+// parseHrdfValidity returns the first and last day of the timetable period (ECKDATEN).
+func parseHrdfValidity(files hrdfFiles) (time.Time, time.Time, error) {
+	lines, ok := files.lines("ECKDATEN")
+	if !ok || len(lines) < 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("missing or incomplete ECKDATEN file")
+	}
+	startDate, err := time.Parse("02.01.2006", hrdfColumns(lines[0], 1, 10))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	endDate, err := time.Parse("02.01.2006", hrdfColumns(lines[1], 1, 10))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return startDate, endDate, nil
+}
+
+// parseHrdfStops reads BAHNHOF (names) and BFKOORD_WGS (coordinates).
+func parseHrdfStops(files hrdfFiles, feedId string) ([]Stop, error) {
+	lines, ok := files.lines("BAHNHOF")
+	if !ok {
+		return nil, fmt.Errorf("missing BAHNHOF file")
+	}
+	stopsById := make(map[string]*Stop)
+	stops := make([]Stop, 0, len(lines))
+	for _, line := range lines {
+		stopId := hrdfColumns(line, 1, 7)
+		//names look like "Basel SBB$<1>$Basel$<2>", we keep the first one
+		name := hrdfColumns(line, 13, utf8.RuneCountInString(line))
+		name, _, _ = strings.Cut(name, "$")
+		stops = append(stops, Stop{FeedId: feedId, StopId: stopId, StopName: name})
+	}
+	for i := range stops {
+		stopsById[stops[i].StopId] = &stops[i]
+	}
+
+	coordLines, ok := files.lines("BFKOORD_WGS", "BFKOORD_GEO")
+	if !ok {
+		return nil, fmt.Errorf("missing BFKOORD_WGS file")
+	}
+	locatedStops := make([]Stop, 0, len(stops))
+	for _, line := range coordLines {
+		//fields are separated by spaces: stop number, longitude, latitude, height
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid BFKOORD_WGS line %q", line)
+		}
+		stop, ok := stopsById[fields[0]]
+		if !ok {
+			continue
+		}
+		lon, err := trimAndParseFloat(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		lat, err := trimAndParseFloat(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		stop.StopLon = lon
+		stop.StopLat = lat
+		locatedStops = append(locatedStops, *stop)
+	}
+	//stops without coordinates are useless for sights, drop them (the trips calling there are cut or dropped, see locatedStretch)
+	return locatedStops, nil
+}
+
+// parseHrdfBitfields reads BITFELD and returns the running dates for every bitfield number.
+func parseHrdfBitfields(files hrdfFiles, startDate time.Time) (map[string][]time.Time, error) {
+	const ONE_DAY = 24 * time.Hour
+	lines, _ := files.lines("BITFELD")
+	bitfields := make(map[string][]time.Time, len(lines))
+	for _, line := range lines {
+		bitfieldId := hrdfColumns(line, 1, 6)
+		hexBits := hrdfColumns(line, 8, utf8.RuneCountInString(line))
+		var dates []time.Time
+		for charIndex, char := range hexBits {
+			value, err := strconv.ParseUint(string(char), 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bitfield %s: %s", bitfieldId, err.Error())
+			}
+			for bit := 0; bit < 4; bit++ {
+				if value&(0b1000>>bit) != 0 {
+					dayIndex := charIndex*4 + bit
+					dates = append(dates, startDate.Add(time.Duration(dayIndex)*ONE_DAY))
+				}
+			}
+		}
+		bitfields[bitfieldId] = dates
+	}
+	return bitfields, nil
+}
+
+// parseHrdfOperators reads BETRIEB and returns the operator names indexed by administration number.
+func parseHrdfOperators(files hrdfFiles) map[string]string {
+	lines, _ := files.lines("BETRIEB", "BETRIEB_DE")
+	namesByOperator := make(map[string]string)
+	namesByAdmin := make(map[string]string)
+	for _, line := range lines {
+		operatorId := hrdfColumns(line, 1, 5)
+		rest := hrdfColumns(line, 7, utf8.RuneCountInString(line))
+		if strings.HasPrefix(rest, ":") {
+			//"00001 : 000011 000012" maps an operator to administration numbers
+			for _, adminId := range strings.Fields(rest[1:]) {
+				namesByAdmin[adminId] = namesByOperator[operatorId]
+			}
+			continue
+		}
+		//"00001 K "SBB" L "SBB" V "Schweizerische Bundesbahnen SBB"", prefer the long (V) name
+		parts := strings.Split(rest, "\"")
+		for i := 0; i+1 < len(parts); i += 2 {
+			key := strings.TrimSpace(parts[i])
+			if key == "V" || namesByOperator[operatorId] == "" {
+				namesByOperator[operatorId] = parts[i+1]
+			}
+		}
+	}
+	return namesByAdmin
+}
+
+// converts an HRDF category (Gattung) into a GTFS route type
+func hrdfCategoryToRouteType(category string) RouteType {
+	switch strings.ToUpper(category) {
+	case "B", "BN", "BUS", "NFB", "KB", "EXB", "RUB", "EV", "TX", "BP":
+		return RouteTypeBus
+	case "T", "TRAM", "NFT":
+		return RouteTypeTram
+	case "M", "MET":
+		return RouteTypeSubway
+	case "BAT", "FAE", "KAT", "SCH":
+		return 4
+	case "GB", "LB", "SL", "PB", "ASC":
+		return 6
+	case "FUN":
+		return 7
+	}
+	return RouteTypeHeavyRail
+}
+
+// parses an HRDF time ("hhmm" possibly with a sign and over 24h).
+// returns the GTFS "hh:mm:ss" representation and whether passengers are allowed to board/alight there.
+func parseHrdfTime(field string) (gtfsTime string, allowed bool, err error) {
+	field = strings.TrimSpace(field)
+	if field == "" || field == "99999" || field == "-99999" {
+		return "", false, nil
+	}
+	allowed = !strings.HasPrefix(field, "-")
+	field = strings.TrimLeft(field, "-+")
+	if len(field) < 3 {
+		return "", false, fmt.Errorf("invalid HRDF time %q", field)
+	}
+	hours, err := strconv.ParseUint(field[:len(field)-2], 10, 64)
+	if err != nil {
+		return "", false, err
+	}
+	minutes, err := strconv.ParseUint(field[len(field)-2:], 10, 64)
+	if err != nil {
+		return "", false, err
+	}
+	return fmt.Sprintf("%02d:%02d:00", hours, minutes), allowed, nil
+}
+
+// an hrdfJourney represents a single *Z block of the FPLAN file
+type hrdfJourney struct {
+	trainNumber string
+	adminId     string
+	categories  []hrdfAttribute //*G lines
+	lines       []hrdfAttribute //*L lines
+	bitfields   []hrdfAttribute //*A VE lines
+	cycleCount  int
+	cycleTime   int        //minutes
+	stopTimes   []StopTime //including the stops passed through without a time
+}
+
+// an hrdfAttribute is a value of a journey (category, line or bitfield) applying between two of its stops
+type hrdfAttribute struct {
+	value    string
+	fromStop string //empty = from the first stop
+	toStop   string //empty = to the last stop
+}
+
+// an hrdfSection is a stretch of a journey along which its category, line and bitfield don't change
+type hrdfSection struct {
+	category   string
+	line       string
+	bitfieldId string
+	stopTimes  []StopTime //only the ones with a time
+}
+
+// stopRange returns the indexes of the first and last stops of the journey the attribute applies to.
+func (journey hrdfJourney) stopRange(attribute hrdfAttribute) (int, int, error) {
+	from, to := 0, len(journey.stopTimes)-1
+	if attribute.fromStop != "" {
+		from = slices.IndexFunc(journey.stopTimes, func(stopTime StopTime) bool { return stopTime.StopId == attribute.fromStop })
+		if from < 0 {
+			return 0, 0, fmt.Errorf("journey %s/%s: %q applies from stop %s, which it doesn't call at", journey.trainNumber, journey.adminId, attribute.value, attribute.fromStop)
+		}
+	}
+	if attribute.toStop != "" {
+		index := slices.IndexFunc(journey.stopTimes[from+1:], func(stopTime StopTime) bool { return stopTime.StopId == attribute.toStop })
+		if index < 0 {
+			return 0, 0, fmt.Errorf("journey %s/%s: %q applies until stop %s, which it doesn't call at afterwards", journey.trainNumber, journey.adminId, attribute.value, attribute.toStop)
+		}
+		to = from + 1 + index
+	}
+	return from, to, nil
+}
+
+// sections splits the journey wherever its category, line or bitfield changes, the stop in between belonging to both sections.
+func (journey hrdfJourney) sections() ([]hrdfSection, error) {
+	if len(journey.stopTimes) < 2 {
+		return nil, nil
+	}
+	//the category, line and bitfield between every two consecutive stops, later lines overriding earlier ones
+	segments := make([][3]string, len(journey.stopTimes)-1)
+	for attributeIndex, attributes := range [][]hrdfAttribute{journey.categories, journey.lines, journey.bitfields} {
+		for _, attribute := range attributes {
+			from, to, err := journey.stopRange(attribute)
+			if err != nil {
+				return nil, err
+			}
+			for segment := from; segment < to; segment++ {
+				segments[segment][attributeIndex] = attribute.value
+			}
+		}
+	}
+	var sections []hrdfSection
+	start := 0
+	for segment := 1; segment <= len(segments); segment++ {
+		if segment < len(segments) && segments[segment] == segments[start] {
+			continue
+		}
+		section := hrdfSection{category: segments[start][0], line: segments[start][1], bitfieldId: segments[start][2]}
+		for _, stopTime := range journey.stopTimes[start : segment+1] {
+			if stopTime.CsvArrivalTime != "" || stopTime.CsvDepartureTime != "" {
+				section.stopTimes = append(section.stopTimes, stopTime)
+			}
+		}
+		sections = append(sections, section)
+		start = segment
+	}
+	return sections, nil
+}
+
+// locatedStretch returns the stop times between the first and last ones at a located stop.
+// It returns false if a stop in between isn't located, since the trip would have a gap there.
+func locatedStretch(stopTimes []StopTime, locatedStopIds map[string]bool) ([]StopTime, bool) {
+	isLocated := func(stopTime StopTime) bool { return locatedStopIds[stopTime.StopId] }
+	first := slices.IndexFunc(stopTimes, isLocated)
+	if first < 0 {
+		return nil, true
+	}
+	last := len(stopTimes) - 1
+	for !isLocated(stopTimes[last]) {
+		last--
+	}
+	stretch := stopTimes[first : last+1]
+	return stretch, !slices.ContainsFunc(stretch, func(stopTime StopTime) bool { return !isLocated(stopTime) })
+}
+
+func parseHrdfJourneys(files hrdfFiles) ([]hrdfJourney, error) {
+	lines, ok := files.lines("FPLAN")
+	if !ok {
+		return nil, fmt.Errorf("missing FPLAN file")
+	}
+	var journeys []hrdfJourney
+	var current *hrdfJourney
+	for _, line := range lines {
+		if strings.HasPrefix(line, "*") {
+			switch {
+			case strings.HasPrefix(line, "*Z"):
+				journeys = append(journeys, hrdfJourney{
+					trainNumber: hrdfColumns(line, 4, 9),
+					adminId:     hrdfColumns(line, 11, 16),
+				})
+				current = &journeys[len(journeys)-1]
+				current.cycleCount, _ = strconv.Atoi(hrdfColumns(line, 23, 25))
+				current.cycleTime, _ = strconv.Atoi(hrdfColumns(line, 27, 29))
+			case current == nil:
+				return nil, fmt.Errorf("FPLAN: %q appears before any *Z line", line)
+			//categories, lines and bitfields may change along the journey, see hrdfJourney.sections
+			case strings.HasPrefix(line, "*G"):
+				current.categories = append(current.categories, hrdfAttribute{
+					value:    hrdfColumns(line, 4, 6),
+					fromStop: hrdfColumns(line, 8, 14),
+					toStop:   hrdfColumns(line, 16, 22),
+				})
+			case strings.HasPrefix(line, "*A VE"):
+				current.bitfields = append(current.bitfields, hrdfAttribute{
+					value:    hrdfColumns(line, 23, 28),
+					fromStop: hrdfColumns(line, 7, 13),
+					toStop:   hrdfColumns(line, 15, 21),
+				})
+			case strings.HasPrefix(line, "*L"):
+				current.lines = append(current.lines, hrdfAttribute{
+					value:    strings.TrimPrefix(hrdfColumns(line, 4, 11), "#"),
+					fromStop: hrdfColumns(line, 13, 19),
+					toStop:   hrdfColumns(line, 21, 27),
+				})
+			}
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("FPLAN: stop line %q appears before any *Z line", line)
+		}
+		arrival, canAlight, err := parseHrdfTime(hrdfColumns(line, 30, 35))
+		if err != nil {
+			return nil, err
+		}
+		departure, canBoard, err := parseHrdfTime(hrdfColumns(line, 37, 42))
+		if err != nil {
+			return nil, err
+		}
+		stopTime := StopTime{
+			StopId:           hrdfColumns(line, 1, 7),
+			StopSequence:     uint(len(current.stopTimes) + 1),
+			CsvArrivalTime:   arrival,
+			CsvDepartureTime: departure,
+		}
+		if !canBoard {
+			stopTime.PickupType = ServiceTypeNotPossible
+		}
+		if !canAlight {
+			stopTime.DropOffType = ServiceTypeNotPossible
+		}
+		//stops passed through without a time are kept until the journey is split into sections, they may bound some
+		current.stopTimes = append(current.stopTimes, stopTime)
+	}
+	return journeys, nil
+}
+
+// processHrdfFeed converts an HRDF archive into the same rows as a GTFS feed.
+func processHrdfFeed(content []byte, feedId string, writer *dbWriter, configEntry LoaderConfigEntry) error {
+	const allDaysServiceId = "000000" //journeys without a bitfield run every day
+	const defaultTimeZone = "Europe/Zurich"
+	const ONE_DAY = 24 * time.Hour
+	files, err := readHrdfFiles(content)
+	if err != nil {
+		return err
+	}
+	startDate, endDate, err := parseHrdfValidity(files)
+	if err != nil {
+		return err
+	}
+	stops, err := parseHrdfStops(files, feedId)
+	if err != nil {
+		return err
+	}
+	bitfields, err := parseHrdfBitfields(files, startDate)
+	if err != nil {
+		return err
+	}
+	var allDays []time.Time
+	for date := startDate; !date.After(endDate); date = date.Add(ONE_DAY) {
+		allDays = append(allDays, date)
+	}
+	bitfields[allDaysServiceId] = allDays
+	adminNames := parseHrdfOperators(files)
+	journeys, err := parseHrdfJourneys(files)
+	if err != nil {
+		return err
+	}
+
+	locatedStopIds := make(map[string]bool, len(stops))
+	for _, stop := range stops {
+		locatedStopIds[stop.StopId] = true
+	}
+	//HRDF doesn't give any time zone name
+	timeZone := configEntry.TimeZone
+	if timeZone == "" {
+		timeZone = defaultTimeZone
+	}
+
+	agencies := make([]Agency, 0)
+	knownAgencies := make(map[string]bool)
+	routes := make([]Route, 0)
+	knownRoutes := make(map[string]bool)
+	trips := make([]Trip, 0, len(journeys))
+	var stopTimes []StopTime
+	usedServiceIds := make(map[string]bool)
+	tripIdCount := make(map[string]int)
+	var cutSections, droppedSections int
+
+	for _, journey := range journeys {
+		sections, err := journey.sections()
+		if err != nil {
+			return err
+		}
+		for _, section := range sections {
+			routeType := hrdfCategoryToRouteType(section.category)
+			if routeType == RouteTypeBus || len(section.stopTimes) < 2 {
+				continue
+			}
+			sectionStopTimes, ok := locatedStretch(section.stopTimes, locatedStopIds)
+			if !ok || len(sectionStopTimes) < 2 {
+				droppedSections++
+				continue
+			}
+			if len(sectionStopTimes) < len(section.stopTimes) {
+				cutSections++
+			}
+			if !knownAgencies[journey.adminId] {
+				knownAgencies[journey.adminId] = true
+				agencies = append(agencies, Agency{
+					FeedId:         feedId,
+					AgencyId:       journey.adminId,
+					AgencyName:     adminNames[journey.adminId],
+					AgencyTimezone: timeZone,
+				})
+			}
+			//one route per operator, category and line
+			routeId := strings.Join([]string{journey.adminId, section.category, section.line}, ":")
+			if !knownRoutes[routeId] {
+				knownRoutes[routeId] = true
+				routes = append(routes, Route{
+					FeedId:         feedId,
+					RouteId:        routeId,
+					RouteShortName: strings.TrimSpace(section.category + " " + section.line),
+					RouteType:      routeType,
+					AgencyId:       journey.adminId,
+				})
+			}
+			serviceId := section.bitfieldId
+			if serviceId == "" {
+				serviceId = allDaysServiceId
+			}
+			if _, ok := bitfields[serviceId]; !ok {
+				return fmt.Errorf("journey %s/%s refers to unknown bitfield %s", journey.trainNumber, journey.adminId, serviceId)
+			}
+			usedServiceIds[serviceId] = true
+
+			//cycles repeat the same journey every cycleTime minutes
+			for cycle := 0; cycle <= journey.cycleCount; cycle++ {
+				baseTripId := journey.trainNumber + ":" + journey.adminId
+				tripIdCount[baseTripId]++
+				tripId := fmt.Sprintf("%s:%d", baseTripId, tripIdCount[baseTripId])
+				trips = append(trips, Trip{
+					FeedId:        feedId,
+					TripId:        tripId,
+					RefRouteId:    routeId,
+					RefServiceId:  serviceId,
+					TripShortName: strings.TrimLeft(journey.trainNumber, "0"),
+				})
+				offset := time.Duration(cycle*journey.cycleTime) * time.Minute
+				for _, stopTime := range sectionStopTimes {
+					stopTime.FeedId = feedId
+					stopTime.TripId = tripId
+					err = stopTime.convertTimes()
+					if err != nil {
+						return fmt.Errorf("journey %s/%s: %s", journey.trainNumber, journey.adminId, err.Error())
+					}
+					if !stopTime.ArrivalTime.IsZero() {
+						stopTime.ArrivalTime = stopTime.ArrivalTime.Add(offset)
+					}
+					if !stopTime.DepartureTime.IsZero() {
+						stopTime.DepartureTime = stopTime.DepartureTime.Add(offset)
+					}
+					stopTimes = append(stopTimes, stopTime)
+				}
+			}
+		}
+	}
+	if cutSections > 0 || droppedSections > 0 {
+		writer.emitFeedEvent(LoadEvent{Type: LoadEventTripsCut, Rows: int64(droppedSections),
+			Detail: fmt.Sprintf("%d journeys cut and %d dropped at stops without coordinates", cutSections, droppedSections)})
+	}
+
+	entities := feedEntities{agencies: agencies, routes: routes, trips: trips, stopTimes: stopTimes, stops: stops}
+	usedServiceIds, err = applyFeedRules(writer, feedId, configEntry, &entities)
+	if err != nil {
+		return err
+	}
+	agencies, routes, trips, stopTimes, stops = entities.agencies, entities.routes, entities.trips, entities.stopTimes, entities.stops
+
+	//services: every running date becomes an added calendar date, so that calculateServiceDays picks it up
+	var calendarDates []CalendarDate
+	for serviceId := range usedServiceIds {
+		for _, date := range bitfields[serviceId] {
+			if date.After(endDate) {
+				break
+			}
+			calendarDates = append(calendarDates, CalendarDate{
+				FeedId:        feedId,
+				ServiceId:     serviceId,
+				Date:          date,
+				ExceptionType: ExceptionTypeServiceAdded,
+			})
+		}
+	}
+
+	feeds := []Feed{{FeedId: feedId, DisplayName: configEntry.DisplayName}}
+
+	err = addToDB(writer, routes)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, trips)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, calendarDates)
+	if err != nil {
+		return err
+	}
+	err = calculateServiceDays(writer, nil, calendarDates)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, stopTimes)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, stops)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, agencies)
+	if err != nil {
+		return err
+	}
+	return addToDB(writer, feeds)
+}
@@ -0,0 +1,138 @@
+package trainmapdb
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// zipTestFeed zips the files of the given testdata directory, since HRDF feeds come zipped.
+func zipTestFeed(t *testing.T, dir string) string {
+	t.Helper()
+	zipPath := filepath.Join(t.TempDir(), filepath.Base(dir)+".zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zipFile.Close()
+	zipWriter := zip.NewWriter(zipFile)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileWriter, err := zipWriter.Create(entry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fileWriter.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zipPath
+}
+
+func TestHrdfFeed(t *testing.T) {
+	fetcher := loadTestDatabase(t, testFeed(FeedFormatHRDF, zipTestFeed(t, "testdata/hrdf")))
+
+	var agencies []Agency
+	err := fetcher.db.Find(&agencies).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agencies) != 1 || agencies[0].AgencyName != "Schweizerische Bundesbahnen SBB" || agencies[0].AgencyTimezone != "Europe/Zurich" {
+		t.Errorf("unexpected agencies %+v", agencies)
+	}
+
+	var trips []Trip
+	err = fetcher.db.Order("trip_id").Find(&trips).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	type expectedTrip struct {
+		tripId    string
+		serviceId string
+		stopIds   []string
+		departure string
+	}
+	expectedTrips := []expectedTrip{
+		//the journey is split where its bitfield changes, Olten ending the first section and starting the second one
+		{"002345:000011:1", "000001", []string{"8500010", "8500023", "8500218"}, "08:00"},
+		{"002345:000011:2", "000002", []string{"8500218", "8503000"}, "08:32"},
+		{"002347:000011:1", "000000", []string{"8500010", "8500218"}, "09:00"},
+		{"002347:000011:2", "000000", []string{"8500010", "8500218"}, "10:00"},
+		//Weil am Rhein has no coordinates, the trip starts at the next stop instead
+		{"002349:000011:1", "000001", []string{"8500010", "8500023"}, "10:10"},
+	}
+	if len(trips) != len(expectedTrips) {
+		t.Fatalf("got %d trips, expected %d", len(trips), len(expectedTrips))
+	}
+	for i, expected := range expectedTrips {
+		trip := trips[i]
+		if trip.TripId != expected.tripId || trip.RefServiceId != expected.serviceId {
+			t.Errorf("got trip %s on service %s, expected %s on %s", trip.TripId, trip.RefServiceId, expected.tripId, expected.serviceId)
+			continue
+		}
+		var stopTimes []StopTime
+		err = fetcher.db.Where("trip_id = ?", trip.TripId).Order("stop_sequence").Find(&stopTimes).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stopIds []string
+		for _, stopTime := range stopTimes {
+			stopIds = append(stopIds, stopTime.StopId)
+		}
+		if !slices.Equal(stopIds, expected.stopIds) {
+			t.Errorf("trip %s calls at %v, expected %v", trip.TripId, stopIds, expected.stopIds)
+			continue
+		}
+		if departure := stopTimes[0].DepartureTime.Format("15:04"); departure != expected.departure {
+			t.Errorf("trip %s leaves at %s, expected %s", trip.TripId, departure, expected.departure)
+		}
+	}
+
+	expectedDates := map[string][]string{
+		"000000": {"2024-05-13", "2024-05-14", "2024-05-15", "2024-05-16", "2024-05-17", "2024-05-18", "2024-05-19"},
+		"000001": {"2024-05-13", "2024-05-14", "2024-05-15", "2024-05-16", "2024-05-17"},
+		"000002": {"2024-05-18"},
+	}
+	for serviceId, expected := range expectedDates {
+		var serviceDays []ServiceDay
+		err = fetcher.db.Where("service_id = ?", serviceId).Order("date").Find(&serviceDays).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dates []string
+		for _, serviceDay := range serviceDays {
+			dates = append(dates, serviceDay.Date.UTC().Format(time.DateOnly))
+		}
+		if !slices.Equal(dates, expected) {
+			t.Errorf("service %s runs on %v, expected %v", serviceId, dates, expected)
+		}
+	}
+}
+
+func TestHrdfSectionsUnknownStop(t *testing.T) {
+	journey := hrdfJourney{
+		trainNumber: "002345",
+		adminId:     "000011",
+		bitfields:   []hrdfAttribute{{value: "000001", fromStop: "8500218", toStop: "8500010"}},
+		stopTimes:   []StopTime{{StopId: "8500010"}, {StopId: "8500218"}},
+	}
+	_, err := journey.sections()
+	if err == nil {
+		t.Errorf("a bitfield ending before it starts should be reported")
+	}
+}
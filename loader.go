@@ -3,13 +3,14 @@ package trainmapdb
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -63,27 +64,11 @@ func (tr *trimReader) Read() ([]string, error) {
 	return content, nil
 }
 
-func addToDB[T any](scdb syncCompatibleDB, input []T) error {
-	scdb.wgIncrement()
-	go func(scdb syncCompatibleDB, input []T) {
-		db := scdb.getDB()
-		defer scdb.wgDone()
-		defer scdb.freeMutex()
-		scdb.takeMutex()
-		// err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(input).Error
-		err := db.Create(input).Error
-		if err != nil {
-			panic(fmt.Errorf("could not insert to DB: %s", err.Error()))
-		}
-	}(scdb, input)
-	return nil
-}
-
 var maxCsvBytes int
 var usedCsvBytes int
 var csvBytesMutex sync.Mutex
 
-func readCsv[T any](zipFile *zip.Reader, csvFileName string) ([]T, error) {
+func readCsv[T any](zipFile *zip.Reader, writer *dbWriter, csvFileName string) ([]T, error) {
 	file, err := zipFile.Open(csvFileName)
 	if err != nil {
 		return nil, err
@@ -97,10 +82,8 @@ func readCsv[T any](zipFile *zip.Reader, csvFileName string) ([]T, error) {
 
 	csvBytesMutex.Lock()
 	maxCsvBytes = max(maxCsvBytes, currentCsvBytes)
-	fmt.Printf("maxCsvBytes: %v\n", maxCsvBytes)
 	for usedCsvBytes+currentCsvBytes > maxCsvBytes {
 		csvBytesMutex.Unlock()
-		println("Too much memory!")
 		time.Sleep(100 * time.Millisecond)
 		csvBytesMutex.Lock()
 	}
@@ -116,11 +99,12 @@ func readCsv[T any](zipFile *zip.Reader, csvFileName string) ([]T, error) {
 	if err != nil {
 		return nil, err
 	}
+	writer.emitFeedEvent(LoadEvent{Type: LoadEventFileParsed, File: csvFileName, Rows: int64(len(content))})
 	return content, nil
 }
 
-func parseCalendarDates(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, validServiceIds map[string]bool) ([]CalendarDate, error) {
-	calendarDates, err := readCsv[CalendarDate](zipFile, "calendar_dates.txt")
+func parseCalendarDates(zipFile *zip.Reader, writer *dbWriter, feedId string, validServiceIds map[string]bool) ([]CalendarDate, error) {
+	calendarDates, err := readCsv[CalendarDate](zipFile, writer, "calendar_dates.txt")
 	if err != nil {
 		//NOTE: not a reason to forward the error, GTFS spec allows for no calendar dates
 		return []CalendarDate{}, nil
@@ -138,11 +122,11 @@ func parseCalendarDates(zipFile *zip.Reader, scdb syncCompatibleDB, feedId strin
 		calendarDates[i].Date = date
 		validCalendarDates = append(validCalendarDates, calendarDates[i])
 	}
-	return validCalendarDates, addToDB(scdb, validCalendarDates)
+	return validCalendarDates, addToDB(writer, validCalendarDates)
 }
 
-func parseCalendar(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, validService map[string]bool) ([]Calendar, error) {
-	calendars, err := readCsv[Calendar](zipFile, "calendar.txt")
+func parseCalendar(zipFile *zip.Reader, writer *dbWriter, feedId string, validService map[string]bool) ([]Calendar, error) {
+	calendars, err := readCsv[Calendar](zipFile, writer, "calendar.txt")
 	if err != nil {
 		//NOTE: not a reason to forward the error, GTFS spec allows for no calendars
 		return []Calendar{}, nil
@@ -166,23 +150,16 @@ func parseCalendar(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, va
 		}
 		validCalendars = append(validCalendars, calendars[i])
 	}
-	return validCalendars, addToDB(scdb, validCalendars)
+	return validCalendars, addToDB(writer, validCalendars)
 }
 
-func parseStops(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, validStopIds map[string]bool) error {
-	stops, err := readCsv[Stop](zipFile, "stops.txt")
+// parseStops returns every stop, including the ones without stop times (parent stations), see clipFeed to drop unused ones.
+func parseStops(zipFile *zip.Reader, writer *dbWriter, feedId string, transformers feedTransformers) ([]Stop, error) {
+	stops, err := readCsv[Stop](zipFile, writer, "stops.txt")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	validStops := make([]Stop, 0, len(stops))
 	for i := range stops {
-		// filter got removed to make sure parent stops with no stoptimes get included
-		// TODO maybe find a better solution??
-
-		// if !validStopIds[stops[i].StopId] {
-		// 	continue
-		// }
-
 		stops[i].FeedId = feedId
 		//go around the foreign key constraint
 		if stops[i].CsvParentStationId != "" {
@@ -190,54 +167,57 @@ func parseStops(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, valid
 		}
 		err = stops[i].parseLocation()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		validStops = append(validStops, stops[i])
 	}
-	return addToDB(scdb, validStops)
+	return transformEach(stops, transformers.stop), nil
 }
 
-// returns (validTripIds, validServiceIds, err)
-func parseTrips(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, validRouteIds map[string]bool) (validTripIds map[string]bool, validServiceIds map[string]bool, err error) {
-	trips, err := readCsv[Trip](zipFile, "trips.txt")
+// returns (validTrips, validTripIds, err)
+func parseTrips(zipFile *zip.Reader, writer *dbWriter, feedId string, transformers feedTransformers, validRouteIds map[string]bool, exclusions *routeExclusions) (validTrips []Trip, validTripIds map[string]bool, err error) {
+	trips, err := readCsv[Trip](zipFile, writer, "trips.txt")
 	if err != nil {
 		return nil, nil, err
 	}
 	validTripIds = make(map[string]bool)
-	validServiceIds = make(map[string]bool)
-	validTrips := make([]Trip, 0, len(trips))
+	validTrips = make([]Trip, 0, len(trips))
 	for i := range trips {
+		trips[i].FeedId = feedId
+		if !transformers.trip(&trips[i]) {
+			continue
+		}
 		if _, ok := validRouteIds[trips[i].RefRouteId]; !ok {
+			exclusions.countTrip(trips[i].RefRouteId)
 			continue
 		}
-		trips[i].FeedId = feedId
 		validTrips = append(validTrips, trips[i])
 		validTripIds[trips[i].TripId] = true
-		validServiceIds[trips[i].RefServiceId] = true
 	}
-	return validTripIds, validServiceIds, addToDB(scdb, validTrips)
+	return validTrips, validTripIds, nil
 }
 
-func parseStopTimes(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, validTripIds map[string]bool) (map[string]bool, error) {
-	stopTimes, err := readCsv[StopTime](zipFile, "stop_times.txt")
+func parseStopTimes(zipFile *zip.Reader, writer *dbWriter, feedId string, transformers feedTransformers, validTripIds map[string]bool) ([]StopTime, error) {
+	stopTimes, err := readCsv[StopTime](zipFile, writer, "stop_times.txt")
 	if err != nil {
 		return nil, err
 	}
 	validStopTimes := make([]StopTime, 0, len(stopTimes))
-	validStopIds := make(map[string]bool)
 	for i := range stopTimes {
-		if _, ok := validTripIds[stopTimes[i].TripId]; !ok {
+		stopTimes[i].FeedId = feedId
+		//skip the other trips early, unless a transformer may still fix their ID
+		if len(transformers.transformers) == 0 && !validTripIds[stopTimes[i].TripId] {
 			continue
 		}
-		stopTimes[i].FeedId = feedId
 		err = stopTimes[i].convertTimes()
 		if err != nil {
 			return nil, err
 		}
+		if !transformers.stopTime(&stopTimes[i]) || !validTripIds[stopTimes[i].TripId] {
+			continue
+		}
 		validStopTimes = append(validStopTimes, stopTimes[i])
-		validStopIds[stopTimes[i].StopId] = true
 	}
-	return validStopIds, addToDB(scdb, validStopTimes)
+	return validStopTimes, nil
 }
 
 // Convert extended GTFS route types into simple types.
@@ -269,8 +249,8 @@ func simplifyRouteType(rt RouteType) RouteType {
 	return rt //return itself
 }
 
-func parseRoutes(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string) (map[string]bool, error) {
-	routes, err := readCsv[Route](zipFile, "routes.txt")
+func parseRoutes(zipFile *zip.Reader, writer *dbWriter, feedId string, transformers feedTransformers, filter *routeFilter, exclusions *routeExclusions) (map[string]bool, error) {
+	routes, err := readCsv[Route](zipFile, writer, "routes.txt")
 	if err != nil {
 		return nil, err
 	}
@@ -279,28 +259,34 @@ func parseRoutes(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string) (map
 	for i := range routes {
 		routes[i].FeedId = feedId
 		routes[i].RouteType = simplifyRouteType(routes[i].RouteType)
+		if !transformers.route(&routes[i]) {
+			continue
+		}
 		if routes[i].RouteType != RouteTypeBus {
 			validRoutes = append(validRoutes, routes[i])
-			validRouteIds[routes[i].RouteId] = true
 		}
 	}
-	return validRouteIds, addToDB(scdb, validRoutes)
+	validRoutes = filter.filterRoutes(validRoutes, exclusions)
+	for _, route := range validRoutes {
+		validRouteIds[route.RouteId] = true
+	}
+	return validRouteIds, addToDB(writer, validRoutes)
 }
 
-func parseAgencies(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string) error {
-	agencies, err := readCsv[Agency](zipFile, "agency.txt")
+func parseAgencies(zipFile *zip.Reader, writer *dbWriter, feedId string, transformers feedTransformers) error {
+	agencies, err := readCsv[Agency](zipFile, writer, "agency.txt")
 	if err != nil {
 		return err
 	}
 	for i := range agencies {
 		agencies[i].FeedId = feedId
 	}
-	return addToDB(scdb, agencies)
+	return addToDB(writer, transformers.agencies(agencies))
 }
 
-func parseFeed(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, displayName string) error {
+func parseFeed(zipFile *zip.Reader, writer *dbWriter, feedId string, displayName string) error {
 	//NOTE: errors are possible if no feed_info is given, in this case we just add our own feed info entry
-	feeds, _ := readCsv[Feed](zipFile, "feed_info.txt")
+	feeds, _ := readCsv[Feed](zipFile, writer, "feed_info.txt")
 	if feeds == nil {
 		feeds = append(feeds, Feed{FeedId: feedId})
 	}
@@ -309,11 +295,11 @@ func parseFeed(zipFile *zip.Reader, scdb syncCompatibleDB, feedId string, displa
 		feeds[i].DisplayName = displayName
 	}
 	// TODO check that this is how the GTFS spec should really be implemented
-	return addToDB(scdb, feeds)
+	return addToDB(writer, feeds)
 }
 
 // calculate service days based on calendars and calendarDates to make lookups easier
-func calculateServiceDays(scdb syncCompatibleDB, calendars []Calendar, calendarDates []CalendarDate) error {
+func calculateServiceDays(writer *dbWriter, calendars []Calendar, calendarDates []CalendarDate) error {
 	const ONE_DAY = 24 * time.Hour
 
 	var serviceDays []ServiceDay
@@ -358,35 +344,61 @@ func calculateServiceDays(scdb syncCompatibleDB, calendars []Calendar, calendarD
 	}
 	//then add service exceptions
 
-	err := addToDB(scdb, serviceDays)
+	err := addToDB(writer, serviceDays)
 	return err
 }
 
 // a LoaderConfig represents a config used to load GTFS feeds into a DB.
 type LoaderConfig struct {
-	DatabasePath string              `json:"db_path"`
-	Contents     []LoaderConfigEntry `json:"contents"`
+	DatabasePath   string              `json:"db_path"`
+	Contents       []LoaderConfigEntry `json:"contents"`
+	WriterPoolSize int                 `json:"writer_pool_size"` //concurrent DB writers, ignored (always 1) when the Fetcher uses a mutex (SQLite)
+	KeepBackup     bool                `json:"keep_backup"`      //BuildDatabase only: keep the replaced DB at DatabasePath + ".bak"
+	Resume         bool                `json:"resume"`           //load into an existing DB, skipping the feeds already loaded from the same source
+	Region         *Region             `json:"region"`           //only load the trips stopping in this region, for every feed without its own region
+	DateWindow     *DateWindow         `json:"date_window"`      //only keep the services running in this window around the load's day (in FetcherConfig.TimeZone), see PruneDatabase
 }
 
 // a LoaderConfigEntry contains info about a specific GTFS feed and how it should be loaded.
 type LoaderConfigEntry struct {
-	Active             bool   `json:"active"`
-	FeedURL            string `json:"feed_url"`
-	FetchIntervalHours *uint  `json:"fetch_interval_hours"` //0 = always fetch, null = always rely on local file
-	DatabaseFileName   string `json:"db_filename"`
-	DisplayName        string `json:"display_name"`
+	Active             bool         `json:"active"`
+	FeedURL            string       `json:"feed_url"`
+	FetchIntervalHours *uint        `json:"fetch_interval_hours"` //0 = always fetch, null = always rely on local file
+	DatabaseFileName   string       `json:"db_filename"`
+	DisplayName        string       `json:"display_name"`
+	Format             string       `json:"format"`       //see FeedFormat* constants, defaults to GTFS
+	Region             *Region      `json:"region"`       //only load the trips stopping in this region, overrides LoaderConfig.Region
+	Routes             *RouteFilter `json:"routes"`       //include/exclude rules on the routes to load
+	Transformers       []string     `json:"transformers"` //names of the transformers fixing the feed's quirks, applied in order, see RegisterTransformer
+	TimeZone           string       `json:"timezone"`     //IANA time zone of the feed's agencies when the feed doesn't give one (NeTEx, HRDF), defaults to Europe/Zurich for HRDF
 }
 
+// Feed formats supported by the loader.
+const (
+	FeedFormatGTFS  = "gtfs"
+	FeedFormatNeTEx = "netex" //European Passenger Information Profile
+	FeedFormatHRDF  = "hrdf"  //HAFAS Rohdaten, zipped
+)
+
 func migrate(db *gorm.DB, disableForeignKeyConstraints bool) error {
 	fkOriginalSettings := db.Config.DisableForeignKeyConstraintWhenMigrating
 	db.Config.DisableForeignKeyConstraintWhenMigrating = disableForeignKeyConstraints
-	err := db.AutoMigrate(&Feed{}, &Agency{}, &Calendar{}, &CalendarDate{}, &ServiceDay{}, &Stop{}, &Route{}, &Trip{}, &StopTime{})
+	err := db.AutoMigrate(databaseModels...)
 	db.Config.DisableForeignKeyConstraintWhenMigrating = fkOriginalSettings
 	return err
 }
 
 // LoadDatabase builds a database from the given LoaderConfig into the given file.
+// Use WithContext to put a deadline on the load (downloads and DB writes stop with the context).
+// A failed load leaves an incomplete DB behind, which NewFetcher refuses; use BuildDatabase to replace file DBs atomically.
+// With config.Resume, the load goes on in an existing DB: feeds whose load completed from the same source file are kept,
+// failed, interrupted and changed ones are loaded again, and the ones not in the config anymore are removed.
+// The stations grouping stops of reloaded or removed feeds are removed, run MatchStations again afterwards.
 func (f Fetcher) LoadDatabase(config LoaderConfig) error {
+	if f.db == nil {
+		return ErrNoDatabase
+	}
+	defer f.networkChanged() //even a failed load may have changed it
 	stat, err := os.Stat(config.DatabasePath)
 	hasData := true
 	if errors.Is(err, os.ErrNotExist) {
@@ -399,100 +411,252 @@ func (f Fetcher) LoadDatabase(config LoaderConfig) error {
 	if hasData { //check if not an empty file
 		hasData = stat.Size() > 0
 	}
-	if hasData {
-		return fmt.Errorf("database file %s already exists, please remove it first", config.DatabasePath)
+	if hasData && !config.Resume {
+		return fmt.Errorf("database file %s already exists, please remove it first (or resume the load)", config.DatabasePath)
+	}
+	//check the regions and rules before touching the DB
+	config.Contents = slices.Clone(config.Contents) //don't modify the caller's entries
+	for i := range config.Contents {
+		if config.Contents[i].Region == nil {
+			config.Contents[i].Region = config.Region
+		}
+		if config.Contents[i].Region != nil {
+			_, err = config.Contents[i].Region.compile()
+			if err != nil {
+				return fmt.Errorf("[%s] %s", config.Contents[i].DisplayName, err.Error())
+			}
+		}
+		_, err = config.Contents[i].Routes.compile()
+		if err != nil {
+			return fmt.Errorf("[%s] %s", config.Contents[i].DisplayName, err.Error())
+		}
+		if config.Contents[i].TimeZone != "" {
+			_, err = time.LoadLocation(config.Contents[i].TimeZone)
+			if err != nil {
+				return fmt.Errorf("[%s] %s", config.Contents[i].DisplayName, err.Error())
+			}
+		}
+		_, err = newFeedTransformers("", config.Contents[i])
+		if err != nil {
+			return fmt.Errorf("[%s] %s", config.Contents[i].DisplayName, err.Error())
+		}
+	}
+	//the date window is around the load's day in the Fetcher's time zone
+	localTimeZone, err := time.LoadLocation(f.Config.TimeZone)
+	if err != nil {
+		return fmt.Errorf("invalid time zone %s: %s", f.Config.TimeZone, err.Error())
 	}
 
 	//migrate schema
 	db := f.db
+	ctx := f.context()
+	startTime := time.Now()
 
+	f.emitPhase(LoadPhaseMigrate)
 	err = migrate(db, !f.useMutex)
 	if err != nil {
 		return fmt.Errorf("error when automigrating: %s", err.Error())
 	}
 
-	var processingWg sync.WaitGroup
-	var scdb syncCompatibleDB
-	if f.useMutex {
-		scdb = &mutexedDB{db: db}
-	} else {
-		scdb = &unmutexedDB{db: db}
+	//get every feed first, so that a resumed load knows which feeds to remove before the bulk load starts
+	f.emitPhase(LoadPhaseFetch)
+	feedContents := f.fetchFeeds(ctx, config)
+
+	feedSources := make(map[string]FeedSource)
+	if config.Resume {
+		feedSources, err = f.prepareResume(config, feedContents)
+		if err != nil {
+			return fmt.Errorf("error when preparing to resume: %s", err.Error())
+		}
+	}
+
+	//use the dialect's fastest insert path, and only build indexes once everything is in
+	bulkLoader, err := newBulkLoader(db)
+	if err != nil {
+		return err
+	}
+	bulkLoader.durable = config.Resume
+	bulkLoader.emit = f.emit
+	if config.Resume && !f.useMutex {
+		err = bulkLoader.dropForeignKeys()
+		if err != nil {
+			return fmt.Errorf("error when dropping foreign keys before load: %s", err.Error())
+		}
+	}
+	err = bulkLoader.dropIndexes()
+	if err != nil {
+		return fmt.Errorf("error when dropping indexes before load: %s", err.Error())
+	}
+	err = bulkLoader.start()
+	if err != nil {
+		bulkLoader.finish(context.WithoutCancel(ctx)) //best effort, undo whatever start changed
+		return fmt.Errorf("error when preparing bulk load: %s", err.Error())
 	}
 
+	//SQLite doesn't support concurrent writes, so only allow a single writer there
+	poolSize := config.WriterPoolSize
+	if f.useMutex || poolSize <= 0 {
+		poolSize = 1
+	}
+	writer := newDBWriter(bulkLoader.writeDB(), poolSize, bulkLoader.copyMode, f.emit, f.metrics())
+
+	var processingWg sync.WaitGroup
+	var feedErrorsMutex sync.Mutex
+	var feedErrors []error
+	failFeed := func(writer *dbWriter, configEntry LoaderConfigEntry, err error) {
+		writer.emitFeedEvent(LoadEvent{Type: LoadEventFeedFailed, Err: err})
+		feedErrorsMutex.Lock()
+		defer feedErrorsMutex.Unlock()
+		feedErrors = append(feedErrors, fmt.Errorf("[%s] Error while parsing feed %s : %s", configEntry.DisplayName, configEntry.DatabaseFileName, err.Error()))
+	}
 	// load all the data we got
+	f.emitPhase(LoadPhaseFeeds)
 	for feedIdInt, configEntry := range config.Contents {
 		if !configEntry.Active {
 			continue
 		}
-		feedFileName := configEntry.DatabaseFileName
 		feedId := fmt.Sprintf("%d", feedIdInt+1) //add 1 to not have an empty PK field
+		feedWriter := writer.forFeed(feedId, configEntry.DisplayName)
+		feed := feedContents[feedId]
+		if feed.err != nil {
+			failFeed(feedWriter, configEntry, feed.err) //the previous load, if any, is kept
+			continue
+		}
+		if feedSources[feedId].loadedFrom(feed) {
+			feedWriter.emitFeedEvent(LoadEvent{Type: LoadEventFeedSkipped})
+			continue
+		}
 		processingWg.Add(1)
-		go func(feedFileName string, feedId string, scdb syncCompatibleDB, configEntry LoaderConfigEntry) {
+		go func(feedId string, writer *dbWriter, configEntry LoaderConfigEntry) {
 			defer processingWg.Done()
-			err := processFeed(feedId, scdb, configEntry)
+			err := f.loadFeed(feedId, writer, configEntry, feed)
 			if err != nil {
-				panic(fmt.Errorf("[%s] Error while parsing feed %s : %s", configEntry.DisplayName, feedFileName, err.Error()))
+				failFeed(writer, configEntry, err)
 			}
-			log.Default().Printf("[%s] Done with processing!\n", configEntry.DisplayName)
-		}(feedFileName, feedId, scdb, configEntry)
+		}(feedId, feedWriter, configEntry)
 	}
-
-	log.Default().Println("Waiting for file parsing to be done...")
 	processingWg.Wait()
 
-	log.Default().Println("Waiting for all the entries to be written to the DB before running optimization SQL...")
-	scdb.wgWait()
+	f.emitPhase(LoadPhaseWrite)
+	stats, err := writer.close()
+	//settings must be restored even if the load was cancelled
+	finishErr := bulkLoader.finish(context.WithoutCancel(ctx))
+	if err != nil {
+		return err
+	}
+	if len(feedErrors) > 0 {
+		return errors.Join(feedErrors...)
+	}
+	if finishErr != nil {
+		return fmt.Errorf("error when restoring settings after bulk load: %s", finishErr.Error())
+	}
+	if config.DateWindow != nil {
+		f.emitPhase(LoadPhasePrune)
+		startDate, endDate := config.DateWindow.Dates(time.Now().In(localTimeZone))
+		err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			_, err := pruneRows(tx, startDate, endDate)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error when pruning: %s", err.Error())
+		}
+	}
+
+	//then compile the whole min/lat lon/lat for trips and add the geo index
+	//this is run only once and expectedly slow, so don't let gorm report it as slow SQL
+	f.emitPhase(LoadPhaseTripBounds)
+	session := db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Silent)})
+	err = session.Exec(tripBoundsSQL(db.Dialector.Name())).Error
+	if err != nil {
+		return err
+	}
+
+	err = bulkLoader.createIndexes()
+	if err != nil {
+		return fmt.Errorf("error when creating indexes: %s", err.Error())
+	}
+
+	f.emit(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseSpatialIndex, Detail: string(f.spatialIndex.Type())})
+	err = f.BuildSpatialIndex()
+	if err != nil {
+		return fmt.Errorf("error when building spatial index: %s", err.Error())
+	}
 
 	if !f.useMutex {
-		log.Default().Println("Adding FK contraints...")
+		f.emitPhase(LoadPhaseForeignKeys)
 		err = migrate(db, false)
 		if err != nil {
 			return fmt.Errorf("error when adding foreign keys: %s", err.Error())
 		}
 	}
 
-	log.Default().Println("Running optimization SQL...")
+	err = f.writeDatabaseInfo()
+	if err != nil {
+		return fmt.Errorf("error when writing database metadata: %s", err.Error())
+	}
 
-	//then compile the whole min/lat lon/lat for trips and add the geo index
-	//first suppress SLOW SQL warning, this is run only once
+	if f.Config.InMemorySnapshot {
+		f.emitPhase(LoadPhaseSnapshot)
+		err = f.ReloadSnapshot()
+		if err != nil {
+			return fmt.Errorf("error when building snapshot: %s", err.Error())
+		}
+	}
+	f.emit(LoadEvent{Type: LoadEventDone, Rows: stats.RowsWritten, Duration: time.Since(startTime)})
+	return nil
+}
 
-	customLogger := logger.New(
-		log.New(os.Stdout, "\r\n", log.LstdFlags),
-		logger.Config{SlowThreshold: 30 * time.Second})
-	session := db.Session(&gorm.Session{Logger: customLogger})
-	sqlString := `
+// the per trip bounding boxes, joined on the full (feed_id, stop_id) key since stop IDs collide across feeds
+const tripBoundsSubquery = `
+	SELECT
+		st.feed_id as feed_id,
+		st.trip_id as trip_id,
+		MIN(s.stop_lat) as min_lat,
+		MAX(s.stop_lat) as max_lat,
+		MIN(s.stop_lon) as min_lon,
+		MAX(s.stop_lon) as max_lon
+	FROM stop_times as st
+	JOIN stops as s ON s.feed_id = st.feed_id AND s.stop_id = st.stop_id
+	GROUP BY st.feed_id, st.trip_id`
+
+// tripBoundsSQL returns the statement filling the trips' bounding boxes, as multi-table UPDATEs aren't standard SQL.
+func tripBoundsSQL(dialect string) string {
+	if dialect == "mysql" {
+		return `
+		UPDATE trips
+		JOIN (` + tripBoundsSubquery + `
+		) as r ON r.feed_id = trips.feed_id AND r.trip_id = trips.trip_id
+		SET
+			trips.min_lat = r.min_lat,
+			trips.max_lat = r.max_lat,
+			trips.min_lon = r.min_lon,
+			trips.max_lon = r.max_lon;`
+	}
+	//SQLite (3.33+) and Postgres
+	return `
 		UPDATE trips
 		SET
 			min_lat = r.min_lat,
 			max_lat = r.max_lat,
 			min_lon = r.min_lon,
 			max_lon = r.max_lon
-		FROM (
-			SELECT
-				st.feed_id as feed_id,
-				st.trip_id as trip_id,
-				MIN(s.stop_lat) as min_lat,
-				MAX(s.stop_lat) as max_lat,
-				MIN(s.stop_lon) as min_lon,
-				MAX(s.stop_lon) as max_lon
-			FROM (stop_times as st JOIN stops as s ON st.stop_id = s.stop_id)
-			GROUP BY st.trip_id, st.feed_id
+		FROM (` + tripBoundsSubquery + `
 		) as r
 		WHERE r.trip_id = trips.trip_id
 		AND r.feed_id = trips.feed_id;`
-	err = session.Exec(sqlString).Error
-	if err != nil {
-		return err
-	}
-	return nil
 }
 
-func downloadFeed(feedURL string) ([]byte, error) {
+func downloadFeed(ctx context.Context, feedURL string) ([]byte, error) {
 	// first download the feed
-	resp, err := http.DefaultClient.Get(feedURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("expected http 200 from %s, got %d instead", feedURL, resp.StatusCode)
 	}
@@ -526,75 +690,188 @@ func shouldDownload(configEntry LoaderConfigEntry) (bool, error) {
 	return lastModifiedDuration > lastModifiedThreshold, nil
 }
 
-func processFeed(feedId string, scdb syncCompatibleDB, configEntry LoaderConfigEntry) error {
+// a feedContent is the raw file of an active feed, or the error which prevented getting it.
+type feedContent struct {
+	content    []byte
+	sourceHash string //see FeedSource
+	err        error
+}
+
+// fetchFeeds concurrently gets the raw file of every active feed of the config, by feed ID.
+func (f Fetcher) fetchFeeds(ctx context.Context, config LoaderConfig) map[string]*feedContent {
+	feedContents := make(map[string]*feedContent)
+	var fetchWg sync.WaitGroup
+	for feedIdInt, configEntry := range config.Contents {
+		if !configEntry.Active {
+			continue
+		}
+		feedId := fmt.Sprintf("%d", feedIdInt+1) //same IDs as LoadDatabase
+		feed := &feedContent{}
+		feedContents[feedId] = feed
+		fetchWg.Add(1)
+		go func() {
+			defer fetchWg.Done()
+			feed.content, feed.err = f.getFeedContent(ctx, feedId, configEntry)
+			if feed.err == nil {
+				feed.sourceHash = hashFeedContent(feed.content)
+			}
+		}()
+	}
+	fetchWg.Wait()
+	return feedContents
+}
+
+// getFeedContent returns the raw feed file, downloading it first if required.
+func (f Fetcher) getFeedContent(ctx context.Context, feedId string, configEntry LoaderConfigEntry) ([]byte, error) {
 	feedFileName := configEntry.DatabaseFileName
 	feedURL := configEntry.FeedURL
+	emitFeedEvent := func(event LoadEvent) {
+		event.FeedId = feedId
+		event.FeedName = configEntry.DisplayName
+		f.emit(event)
+	}
 
 	//check if feed should be downloaded, if so download, otherwise get from local file
 	download, err := shouldDownload(configEntry)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var content []byte
 	if download {
-		log.Default().Printf("[%s] Starting download of %s \n", configEntry.DisplayName, feedFileName)
-		content, err = downloadFeed(feedURL)
+		emitFeedEvent(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseDownload, File: feedURL})
+		downloadStart := time.Now()
+		content, err = downloadFeed(ctx, feedURL)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		log.Default().Printf("[%s] Done downloading, caching to %s...", configEntry.DisplayName, feedFileName)
+		downloadDuration := time.Since(downloadStart)
+		f.metrics().Observe("loader.download_seconds", downloadDuration.Seconds())
+		emitFeedEvent(LoadEvent{Type: LoadEventDownloaded, File: feedURL, Bytes: int64(len(content)), Duration: downloadDuration})
 		//TODO maybe 0644 isn't really ideal but who cares
 		err = os.WriteFile(feedFileName, content, 0644)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		log.Default().Printf("[%s] Done caching, staring parsing...\n", configEntry.DisplayName)
 	} else {
-		log.Default().Printf("[%s] Using saved cached file at %s...\n", configEntry.DisplayName, feedFileName)
+		emitFeedEvent(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseReadCache, File: feedFileName})
 		content, err = os.ReadFile(feedFileName)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return content, nil
+}
+
+// loadFeed loads a single feed from its raw file and records its status.
+// The rows of any previous load of the feed must have been removed first, see prepareResume.
+func (f Fetcher) loadFeed(feedId string, writer *dbWriter, configEntry LoaderConfigEntry, feed *feedContent) error {
+	startTime := time.Now()
+	feedSource := FeedSource{FeedId: feedId, DisplayName: configEntry.DisplayName, SourceHash: feed.sourceHash, Status: FeedStatusLoading}
+	err := f.db.Save(&feedSource).Error
+	if err != nil {
+		return err
+	}
+
+	writer.emitFeedEvent(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseParse})
+	err = processFeed(feed.content, feedId, writer, configEntry)
+	if err != nil {
+		//drop the feed's batches still queued, so that none is written after its failed status
+		writer.feedErr.set(err)
+	}
+	err = writer.wait()
+	if err != nil {
+		feedSource.Status = FeedStatusFailed
+		feedSource.Error = err.Error()
+		f.db.Save(&feedSource) //best effort, the status stays "loading" otherwise, which also gets reloaded
+		return err
+	}
+	feedSource.Status = FeedStatusComplete
+	feedSource.LoadedAt = time.Now()
+	err = f.db.Save(&feedSource).Error
+	if err != nil {
+		return err
+	}
+	writer.emitFeedEvent(LoadEvent{Type: LoadEventFeedDone, Rows: writer.feedRows.Load(), Duration: time.Since(startTime)})
+	return nil
+}
 
+func processFeed(content []byte, feedId string, writer *dbWriter, configEntry LoaderConfigEntry) error {
+	var err error
+	switch configEntry.Format {
+	case FeedFormatGTFS, "":
+		err = processGtfsFeed(content, feedId, writer, configEntry)
+	case FeedFormatNeTEx:
+		err = processNetexFeed(content, feedId, writer, configEntry)
+	case FeedFormatHRDF:
+		err = processHrdfFeed(content, feedId, writer, configEntry)
+	default:
+		err = fmt.Errorf("unknown feed format %s", configEntry.Format)
+	}
+	return err
+}
+
+func processGtfsFeed(content []byte, feedId string, writer *dbWriter, configEntry LoaderConfigEntry) error {
 	//then open the file
 	zipFile, err := zip.NewReader(bytes.NewReader(content), (int64)(len(content)))
 	if err != nil {
 		return err
 	}
-	validRouteIds, err := parseRoutes(zipFile, scdb, feedId)
+	rules, err := newFeedRules(writer, feedId, configEntry)
+	if err != nil {
+		return err
+	}
+	//agencies first, since the other transformations may depend on them
+	err = parseAgencies(zipFile, writer, feedId, rules.transformers)
+	if err != nil {
+		return err
+	}
+	validRouteIds, err := parseRoutes(zipFile, writer, feedId, rules.transformers, rules.filter, rules.exclusions)
+	if err != nil {
+		return err
+	}
+	var entities feedEntities
+	var validTripIds map[string]bool
+	entities.trips, validTripIds, err = parseTrips(zipFile, writer, feedId, rules.transformers, validRouteIds, rules.exclusions)
+	if err != nil {
+		return err
+	}
+	entities.stopTimes, err = parseStopTimes(zipFile, writer, feedId, rules.transformers, validTripIds)
+	if err != nil {
+		return err
+	}
+	entities.stops, err = parseStops(zipFile, writer, feedId, rules.transformers)
 	if err != nil {
 		return err
 	}
-	validTripIds, validServiceIds, err := parseTrips(zipFile, scdb, feedId, validRouteIds)
+	validServiceIds, err := rules.clip(&entities)
 	if err != nil {
 		return err
 	}
-	calendarDates, err := parseCalendarDates(zipFile, scdb, feedId, validServiceIds)
+	err = addToDB(writer, entities.trips)
 	if err != nil {
 		return err
 	}
-	calendar, err := parseCalendar(zipFile, scdb, feedId, validServiceIds)
+	err = addToDB(writer, entities.stopTimes)
 	if err != nil {
 		return err
 	}
-	err = calculateServiceDays(scdb, calendar, calendarDates)
+	err = addToDB(writer, entities.stops)
 	if err != nil {
 		return err
 	}
-	validStopIds, err := parseStopTimes(zipFile, scdb, feedId, validTripIds)
+	calendarDates, err := parseCalendarDates(zipFile, writer, feedId, validServiceIds)
 	if err != nil {
 		return err
 	}
-	err = parseStops(zipFile, scdb, feedId, validStopIds)
+	calendar, err := parseCalendar(zipFile, writer, feedId, validServiceIds)
 	if err != nil {
 		return err
 	}
-	err = parseAgencies(zipFile, scdb, feedId)
+	err = calculateServiceDays(writer, calendar, calendarDates)
 	if err != nil {
 		return err
 	}
-	err = parseFeed(zipFile, scdb, feedId, configEntry.DisplayName)
+	err = parseFeed(zipFile, writer, feedId, configEntry.DisplayName)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,117 @@
+package trainmapdb
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"sync"
+	"time"
+)
+
+// Metrics receives the counters and measurements of loads and queries, see FetcherConfig.Metrics.
+// Implementations must be safe for concurrent use. ExpvarMetrics publishes them through expvar.
+//
+// The names used are:
+//   - loader.rows_parsed.<Model>: counter of the rows parsed from the feeds and queued for writing (e.g. loader.rows_parsed.StopTime)
+//   - loader.rows_inserted.<Model>: counter of the rows committed to the DB
+//   - loader.download_seconds: duration of every feed download
+//   - query.latency_seconds.<Method>: duration of every call of a Fetcher query method (e.g. query.latency_seconds.GetTrip)
+//   - query.candidate_trips.<Method>: number of trips near the observer considered by every sight query
+//   - query.sights.<Method>: number of sights returned by every sight query
+type Metrics interface {
+	Add(name string, delta int64)       //increments a counter
+	Observe(name string, value float64) //records a measurement
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Add(name string, delta int64)       {}
+func (noopMetrics) Observe(name string, value float64) {}
+
+// metrics returns the configured Metrics, or one discarding everything.
+func (f Fetcher) metrics() Metrics {
+	if f.Config.Metrics == nil {
+		return noopMetrics{}
+	}
+	return f.Config.Metrics
+}
+
+// observeQuery records the latency of a query method, call it as defer f.observeQuery("Method", time.Now()).
+func (f Fetcher) observeQuery(method string, start time.Time) {
+	f.metrics().Observe("query.latency_seconds."+method, time.Since(start).Seconds())
+}
+
+// ExpvarMetrics publishes the metrics as an expvar map: counters are integers,
+// measurements are summaries with their count, sum, min, max and mean.
+// Importing net/http/pprof or expvar serves them on /debug/vars of the default HTTP mux.
+type ExpvarMetrics struct {
+	vars  *expvar.Map
+	mutex sync.Mutex //held when adding a summary
+}
+
+// NewExpvarMetrics publishes the metrics under the given expvar name (e.g. "trainmap").
+// Fetchers using the same name share the same map.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name) //panics if the name is already used by something else, like every expvar
+	}
+	return &ExpvarMetrics{vars: vars}
+}
+
+// Vars returns the published map.
+func (m *ExpvarMetrics) Vars() *expvar.Map {
+	return m.vars
+}
+
+func (m *ExpvarMetrics) Add(name string, delta int64) {
+	m.vars.Add(name, delta)
+}
+
+func (m *ExpvarMetrics) Observe(name string, value float64) {
+	summary, ok := m.vars.Get(name).(*metricSummary)
+	if !ok {
+		m.mutex.Lock()
+		summary, ok = m.vars.Get(name).(*metricSummary)
+		if !ok {
+			summary = &metricSummary{min: math.Inf(1), max: math.Inf(-1)}
+			m.vars.Set(name, summary)
+		}
+		m.mutex.Unlock()
+	}
+	summary.observe(value)
+}
+
+// a metricSummary is the expvar.Var of a measurement.
+type metricSummary struct {
+	mutex sync.Mutex
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (s *metricSummary) observe(value float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.count++
+	s.sum += value
+	s.min = min(s.min, value)
+	s.max = max(s.max, value)
+}
+
+func (s *metricSummary) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	values := map[string]any{"count": s.count, "sum": s.sum}
+	if s.count > 0 {
+		values["min"] = s.min
+		values["max"] = s.max
+		values["mean"] = s.sum / float64(s.count)
+	}
+	content, err := json.Marshal(values)
+	if err != nil {
+		return "{}"
+	}
+	return string(content)
+}
@@ -7,9 +7,12 @@ import (
 	"time"
 )
 
+//NOTE: string key columns (primary and foreign keys) are sized, as MySQL can't index unbounded TEXT columns.
+//191 utf8mb4 characters fit in the 767 byte index limit of older MySQL/MariaDB setups.
+
 type Agency struct {
-	FeedId         string `csv:"-" gorm:"primaryKey;uniqueIndex:pk_agency" json:"feed_id"`
-	AgencyId       string `gorm:"primaryKey;uniqueIndex:pk_agency" csv:"agency_id" json:"agency_id"`
+	FeedId         string `csv:"-" gorm:"primaryKey;size:191;uniqueIndex:pk_agency" json:"feed_id"`
+	AgencyId       string `gorm:"primaryKey;size:191;uniqueIndex:pk_agency" csv:"agency_id" json:"agency_id"`
 	AgencyName     string `csv:"agency_name" json:"name"`
 	AgencyUrl      string `csv:"agency_url"`
 	AgencyTimezone string `csv:"agency_timezone"`
@@ -34,8 +37,8 @@ const (
 type Stop struct {
 	// Feed            Feed          `csv:"-" gorm:"foreignKey:FeedId;references:FeedId" json:"feed"`
 	Feed               Feed          `csv:"-" gorm:"foreignKey:FeedId" json:"feed"`
-	FeedId             string        `csv:"-" gorm:"primaryKey;uniqueIndex:pk_stop" json:"feed_id"`
-	StopId             string        `csv:"stop_id" gorm:"primaryKey;uniqueIndex:pk_stop" json:"stop_id"`
+	FeedId             string        `csv:"-" gorm:"primaryKey;size:191;uniqueIndex:pk_stop" json:"feed_id"`
+	StopId             string        `csv:"stop_id" gorm:"primaryKey;size:191;uniqueIndex:pk_stop" json:"stop_id"`
 	StopCode           string        `csv:"stop_code" json:"stop_code"`
 	StopName           string        `csv:"stop_name" json:"stop_name"`
 	TtsStopName        string        `csv:"tts_stop_name" json:"tts_stop_name"`
@@ -47,11 +50,12 @@ type Stop struct {
 	StopLonString      string        `csv:"stop_lon" json:"-"`
 	LocationType       *LocationType `csv:"location_type" json:"location_type"` // 0=Stop/platform, 1=Station, 2=Entrance/exit, 3=Generic, 4=Boarding area
 	CsvParentStationId string        `gorm:"-:all" csv:"parent_station" json:"-"`
-	ParentStationId    *string       `csv:"-" json:"-"`
+	ParentStationId    *string       `csv:"-" gorm:"size:191" json:"-"`
 	//station hierarchy removed because FK constraint isn't required by the spec, TODO check for breaking changes
 	ParentStation *Stop      `csv:"-" gorm:"foreignKey:ParentStationId,FeedId;references:StopId,FeedId" json:"parent_station"`
 	ChildStations []Stop     `csv:"-" gorm:"foreignKey:ParentStationId,FeedId;references:StopId,FeedId" json:"child_stations"`
 	StopTimes     []StopTime `csv:"-" gorm:"foreignKey:FeedId,StopId;references:FeedId,StopId" json:"stop_times"`
+	StationId     *string    `csv:"-" gorm:"index;size:191" json:"station_id"` //canonical cross-feed station, see MatchStations
 }
 
 func (s *Stop) parseLocation() error {
@@ -94,8 +98,8 @@ func (r RouteType) isRailType() bool {
 
 type Route struct {
 	Feed           Feed      `csv:"-" gorm:"foreignKey:FeedId" json:"feed"`
-	FeedId         string    `csv:"-" gorm:"primaryKey;uniqueIndex:pk_route" json:"feed_id"`
-	RouteId        string    `gorm:"primaryKey;uniqueIndex:pk_route" csv:"route_id" json:"route_id"`
+	FeedId         string    `csv:"-" gorm:"primaryKey;size:191;uniqueIndex:pk_route" json:"feed_id"`
+	RouteId        string    `gorm:"primaryKey;size:191;uniqueIndex:pk_route" csv:"route_id" json:"route_id"`
 	RouteShortName string    `csv:"route_short_name" json:"short_name"`
 	RouteLongName  string    `csv:"route_long_name" json:"long_name"`
 	RouteDesc      string    `csv:"route_desc" json:"description"`
@@ -103,17 +107,17 @@ type Route struct {
 	RouteColor     string    `csv:"route_color" json:"color"`
 	RouteTextColor string    `csv:"route_text_color" json:"text_color"`
 	Trips          []Trip    `csv:"-" gorm:"foreignKey:RefRouteId,FeedId;references:RouteId,FeedId" json:"trips"`
-	AgencyId       string    `csv:"agency_id" json:"agency_id"`
+	AgencyId       string    `csv:"agency_id" gorm:"size:191" json:"agency_id"`
 	Agency         Agency    `csv:"-" gorm:"foreignKey:FeedId,AgencyId;references:FeedId,AgencyId" json:"agency"`
 }
 
 type Trip struct {
-	FeedId       string   `csv:"-" gorm:"primaryKey;uniqueIndex:pk_trip" json:"feed_id"`
-	TripId       string   `gorm:"primaryKey;uniqueIndex:pk_trip" csv:"trip_id" json:"trip_id"`
+	FeedId       string   `csv:"-" gorm:"primaryKey;size:191;uniqueIndex:pk_trip" json:"feed_id"`
+	TripId       string   `gorm:"primaryKey;size:191;uniqueIndex:pk_trip" csv:"trip_id" json:"trip_id"`
 	Feed         *Feed    `csv:"-" gorm:"foreignKey:FeedId" json:"feed"`
-	RefRouteId   string   `csv:"route_id" json:"-"`
+	RefRouteId   string   `csv:"route_id" gorm:"size:191" json:"-"`
 	Route        *Route   `csv:"-" gorm:"foreignKey:RefRouteId,FeedId;references:RouteId,FeedId" json:"route"`
-	RefServiceId string   `csv:"service_id" json:"service_id"`
+	RefServiceId string   `csv:"service_id" gorm:"size:191" json:"service_id"`
 	Calendar     Calendar `csv:"-" json:"calendar" gorm:"foreignKey:FeedId,RefServiceId;references:FeedId,ServiceId"`
 	// Calendar Calendar `csv:"-" json:"calendar" gorm:"foreignKey:FeedId,ServiceId"`
 	//REMOVING THAT ONE CAUSE NOT PART OF STRICT ORM, TODO check if this breaks anything
@@ -141,19 +145,19 @@ const (
 )
 
 type StopTime struct {
-	FeedId           string      `csv:"-" gorm:"primaryKey;uniqueIndex:pk_stoptime" json:"feed_id"`
-	TripId           string      `gorm:"primaryKey;uniqueIndex:pk_stoptime" csv:"trip_id" json:"trip_id"`
+	FeedId           string      `csv:"-" gorm:"primaryKey;size:191;uniqueIndex:pk_stoptime" json:"feed_id"`
+	TripId           string      `gorm:"primaryKey;size:191;uniqueIndex:pk_stoptime" csv:"trip_id" json:"trip_id"`
 	CsvArrivalTime   string      `gorm:"-:all" csv:"arrival_time" json:"-"`   //hh:mm:ss
 	CsvDepartureTime string      `gorm:"-:all" csv:"departure_time" json:"-"` //hh:mm:ss
 	ArrivalTime      time.Time   `csv:"-" json:"arrival_time"`
 	DepartureTime    time.Time   `csv:"-" json:"departure_time"`
-	StopId           string      `csv:"stop_id" json:"stop_id"`
+	StopId           string      `csv:"stop_id" gorm:"size:191" json:"stop_id"`
 	Stop             *Stop       `csv:"-" gorm:"foreignKey:FeedId,StopId" json:"stop"`
 	Trip             *Trip       `csv:"-" gorm:"foreignKey:FeedId,TripId" json:"trip"`
 	StopSequence     uint        `gorm:"primaryKey;uniqueIndex:pk_stoptime" csv:"stop_sequence" json:"stop_sequence"`
 	StopHeadsign     string      `csv:"stop_headsign" json:"stop_headsign"`
 	PickupType       ServiceType `csv:"pickup_type" json:"pickup_type"`
-	DropOffType      ServiceType `csv:"pickup_type" json:"dorp_off_type"`
+	DropOffType      ServiceType `csv:"drop_off_type" json:"dorp_off_type"`
 }
 
 func updateDateTz(dateFrom, timeFrom time.Time, tz *time.Location) time.Time {
@@ -225,8 +229,8 @@ func (st *StopTime) convertTimes() error {
 }
 
 type Calendar struct {
-	FeedId        string         `gorm:"primaryKey;uniqueIndex:pk_calendar" json:"feed_id"`
-	ServiceId     string         `gorm:"primaryKey;uniqueIndex:pk_calendar" csv:"service_id" json:"service_id"`
+	FeedId        string         `gorm:"primaryKey;size:191;uniqueIndex:pk_calendar" json:"feed_id"`
+	ServiceId     string         `gorm:"primaryKey;size:191;uniqueIndex:pk_calendar" csv:"service_id" json:"service_id"`
 	Monday        bool           `csv:"monday" json:"monday"`
 	Tuesday       bool           `csv:"tuesday" json:"tuesday"`
 	Wednesday     bool           `csv:"wednesday" json:"wednesday"`
@@ -273,8 +277,8 @@ const (
 )
 
 type CalendarDate struct {
-	FeedId        string        `csv:"-" gorm:"primaryKey;uniqueIndex:pk_calendardate" json:"feed_id"`
-	ServiceId     string        `gorm:"primaryKey;uniqueIndex:pk_calendardate" csv:"service_id" json:"service_id"`
+	FeedId        string        `csv:"-" gorm:"primaryKey;size:191;uniqueIndex:pk_calendardate" json:"feed_id"`
+	ServiceId     string        `gorm:"primaryKey;size:191;uniqueIndex:pk_calendardate" csv:"service_id" json:"service_id"`
 	Date          time.Time     `csv:"-" gorm:"primaryKey;uniqueIndex:pk_calendardate" json:"date"`
 	CsvDate       string        `csv:"date" gorm:"-:all" json:"-"`           //YYYYmmdd
 	ExceptionType ExceptionType `csv:"exception_type" json:"exception_type"` //1=added, 2=removed
@@ -282,8 +286,8 @@ type CalendarDate struct {
 
 type ServiceDay struct {
 	Date      time.Time `gorm:"primaryKey;uniqueIndex:pk_servicedays"`
-	FeedId    string    `gorm:"primaryKey;uniqueIndex:pk_servicedays"`
-	ServiceId string    `gorm:"primaryKey;uniqueIndex:pk_servicedays"`
+	FeedId    string    `gorm:"primaryKey;size:191;uniqueIndex:pk_servicedays"`
+	ServiceId string    `gorm:"primaryKey;size:191;uniqueIndex:pk_servicedays"`
 }
 
 func (s ServiceDay) GetFeededService() FeededService {
@@ -295,7 +299,7 @@ func (s ServiceDay) GetFeededService() FeededService {
 
 type Feed struct {
 	DisplayName   string `csv:"-" json:"display_name"` //added by us
-	FeedId        string `csv:"-" gorm:"primaryKey;uniqueIndex:pk_feed" json:"feed_id"`
+	FeedId        string `csv:"-" gorm:"primaryKey;size:191;uniqueIndex:pk_feed" json:"feed_id"`
 	PublisherName string `csv:"feed_publisher_name" json:"publisher_name"`
 	PublisherUrl  string `csv:"feed_publisher_url" json:"publisher_url"`
 	FeedLang      string `csv:"feed_lang" json:"feed_lang"`
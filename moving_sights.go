@@ -9,6 +9,7 @@ import (
 // GetSightsFromTripKey gets the sights that are visible while riding the given trip on a given date
 // NOTE: does not check if the trip is actually running on that day
 func (f *Fetcher) GetSightsFromTripKey(feedId string, tripId string, date Date, lateTime time.Duration) ([]RealMovingTrainSight, Trip, error) {
+	defer f.observeQuery("GetSightsFromTripKey", time.Now())
 	trip, err := f.GetTrip(feedId, tripId)
 	if err != nil {
 		return nil, Trip{}, err
@@ -19,17 +20,22 @@ func (f *Fetcher) GetSightsFromTripKey(feedId string, tripId string, date Date,
 // GetSightsFromTrip gets the sights that are visible while riding the given trip on a given date
 // NOTE: does not check if the trip is actually running on that day
 func (f *Fetcher) GetSightsFromTrip(trip Trip, date Date, lateTime time.Duration) ([]RealMovingTrainSight, Trip, error) {
+	defer f.observeQuery("GetSightsFromTrip", time.Now())
 	//first get the trips in the interval we want
 	const gracePeriod time.Duration = 5 * time.Minute
 	firstSt := trip.StopTimes[0]
 	lastSt := trip.StopTimes[len(trip.StopTimes)-1]
-	overlappingTrips, err := f.GetTripsInsidePointInterval(firstSt.Stop.GetPoint(), lastSt.Stop.GetPoint())
+	minLat, maxLat, minLon, maxLon := pointsToBoundingBox(firstSt.Stop.GetPoint(), lastSt.Stop.GetPoint())
+	tripBox := BoundingBox{MinLat: minLat, MaxLat: maxLat, MinLon: minLon, MaxLon: maxLon}
+	backend := f.Backend()
+	overlappingTrips, err := backend.GetTripSegmentsWithIntersection(f.context(), tripBox.withMargin(f.Config.DatabaseOutOfBoundsGraceDegrees), sightTripLoadOptions())
 	if err != nil {
 		return nil, Trip{}, err
 	}
+	f.metrics().Observe("query.candidate_trips.GetSightsFromTrip", float64(len(overlappingTrips)))
 
 	//get service days to check later when they run
-	serviceDays, err := f.GetServicesOnDate(time.Time(date))
+	serviceDays, err := backend.GetServicesBetweenDates(f.context(), time.Time(date), time.Time(date))
 	if err != nil {
 		return nil, Trip{}, err
 	}
@@ -41,7 +47,12 @@ func (f *Fetcher) GetSightsFromTrip(trip Trip, date Date, lateTime time.Duration
 
 	serviceToSights := make(map[FeededService][]MovingTrainSight, 0)
 	//check possible sight with every trip
-	for _, possibleTrip := range overlappingTrips {
+	for _, overlappingTrip := range overlappingTrips {
+		err = f.context().Err() //the client may have given up
+		if err != nil {
+			return nil, Trip{}, err
+		}
+		possibleTrip := overlappingTrip.Trip
 		possibleSight, hasPossibleSight, err := f.getPossibleMovingSight(trip, possibleTrip, lateTime)
 		if err != nil {
 			return nil, Trip{}, err
@@ -62,6 +73,27 @@ func (f *Fetcher) GetSightsFromTrip(trip Trip, date Date, lateTime time.Duration
 	for date, feededServices := range dateToServices {
 		for _, feededService := range feededServices {
 			for _, mts := range serviceToSights[feededService] {
+				adjustment, hasAdjustment := f.Realtime.GetAdjustment(mts.FeedId, mts.TripId, date)
+				if hasAdjustment && adjustment.Cancelled {
+					continue
+				}
+				var delay time.Duration
+				if hasAdjustment {
+					adjustedTrip := mts.Trip.withAdjustment(adjustment)
+					if len(adjustedTrip.StopTimes) < 2 {
+						continue //every stop was cancelled
+					}
+					//recompute the sight using the delayed trip, since the meeting point moves with the delay
+					delayedSight, hasDelayedSight, err := f.getPossibleMovingSight(trip, adjustedTrip, lateTime)
+					if err != nil {
+						return nil, Trip{}, err
+					}
+					if !hasDelayedSight {
+						continue
+					}
+					mts = delayedSight
+					delay = adjustment.Delay
+				}
 				sightTime := mts.PassingInterPoint.Time
 				tripDepTime := mts.Trip.StopTimes[0].DepartureTime
 				tripArrTime := mts.Trip.StopTimes[len(mts.Trip.StopTimes)-1].ArrivalTime
@@ -73,6 +105,8 @@ func (f *Fetcher) GetSightsFromTrip(trip Trip, date Date, lateTime time.Duration
 					MovingTrainSight: mts,
 					Date:             date,
 					Timestamp:        date.Add(duration),
+					Delay:            delay,
+					Sources:          []FeededTrip{{FeedId: mts.FeedId, TripId: mts.TripId}},
 				}
 				rmts.updateInnerDates(tz)
 				realMovingTrainSights = append(realMovingTrainSights, rmts)
@@ -84,6 +118,9 @@ func (f *Fetcher) GetSightsFromTrip(trip Trip, date Date, lateTime time.Duration
 		return realMovingTrainSights[i].Timestamp.Before(realMovingTrainSights[j].Timestamp)
 	})
 
+	realMovingTrainSights = mergeDuplicateMovingTrainSights(realMovingTrainSights, f.Config.DuplicateTripTimeTolerance)
+	f.metrics().Observe("query.sights.GetSightsFromTrip", float64(len(realMovingTrainSights)))
+
 	//adapt trip stoptimes
 	newTrip := trip
 	for i := range trip.StopTimes {
@@ -172,6 +209,8 @@ type RealMovingTrainSight struct {
 	MovingTrainSight MovingTrainSight `json:"sight"`
 	Timestamp        time.Time        `json:"timestamp"`
 	Date             time.Time        `json:"date"`
+	Delay            time.Duration    `json:"delay"`   //realtime delay of the seen trip, already included in Timestamp
+	Sources          []FeededTrip     `json:"sources"` //every feed trip this sight was seen in (several for cross-feed duplicates)
 }
 
 func (rmts *RealMovingTrainSight) updateInnerDates(tz *time.Location) {
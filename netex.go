@@ -0,0 +1,689 @@
+package trainmapdb
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NeTEx elements used by the European Passenger Information Profile (EPIP).
+// Elements are looked up by name wherever they are in the document, so the frame layout
+// (CompositeFrame, GeneralFrame, one file per frame...) doesn't matter.
+
+type netexRef struct {
+	Ref string `xml:"ref,attr"`
+}
+
+type netexLocation struct {
+	Longitude *float64 `xml:"Location>Longitude"`
+	Latitude  *float64 `xml:"Location>Latitude"`
+}
+
+type netexOperator struct {
+	Id   string `xml:"id,attr"`
+	Name string `xml:"Name"`
+	Url  string `xml:"ContactDetails>Url"`
+}
+
+type netexQuay struct {
+	Id       string        `xml:"id,attr"`
+	Name     string        `xml:"Name"`
+	Code     string        `xml:"PublicCode"`
+	Centroid netexLocation `xml:"Centroid"`
+}
+
+type netexStopPlace struct {
+	Id          string        `xml:"id,attr"`
+	Name        string        `xml:"Name"`
+	PrivateCode string        `xml:"PrivateCode"`
+	Centroid    netexLocation `xml:"Centroid"`
+	Quays       []netexQuay   `xml:"quays>Quay"`
+}
+
+type netexScheduledStopPoint struct {
+	Id   string `xml:"id,attr"`
+	Name string `xml:"Name"`
+	netexLocation
+}
+
+type netexPassengerStopAssignment struct {
+	ScheduledStopPointRef netexRef `xml:"ScheduledStopPointRef"`
+	StopPlaceRef          netexRef `xml:"StopPlaceRef"`
+	QuayRef               netexRef `xml:"QuayRef"`
+}
+
+type netexLine struct {
+	Id            string   `xml:"id,attr"`
+	Name          string   `xml:"Name"`
+	ShortName     string   `xml:"ShortName"`
+	PublicCode    string   `xml:"PublicCode"`
+	Description   string   `xml:"Description"`
+	TransportMode string   `xml:"TransportMode"`
+	OperatorRef   netexRef `xml:"OperatorRef"`
+	AuthorityRef  netexRef `xml:"AuthorityRef"`
+	Colour        string   `xml:"Presentation>Colour"`
+	TextColour    string   `xml:"Presentation>TextColour"`
+}
+
+type netexRoute struct {
+	Id      string   `xml:"id,attr"`
+	LineRef netexRef `xml:"LineRef"`
+}
+
+type netexStopPointInJourneyPattern struct {
+	Id                    string   `xml:"id,attr"`
+	Order                 uint     `xml:"order,attr"`
+	ScheduledStopPointRef netexRef `xml:"ScheduledStopPointRef"`
+	ForAlighting          *bool    `xml:"ForAlighting"`
+	ForBoarding           *bool    `xml:"ForBoarding"`
+}
+
+type netexJourneyPattern struct {
+	Id             string                           `xml:"id,attr"`
+	RouteRef       netexRef                         `xml:"RouteRef"`
+	Points         []netexStopPointInJourneyPattern `xml:"pointsInSequence>StopPointInJourneyPattern"`
+	DestinationRef netexRef                         `xml:"DestinationDisplayRef"`
+}
+
+type netexPassingTime struct {
+	StopPointInJourneyPatternRef netexRef `xml:"StopPointInJourneyPatternRef"`
+	ArrivalTime                  string   `xml:"ArrivalTime"`
+	ArrivalDayOffset             uint     `xml:"ArrivalDayOffset"`
+	DepartureTime                string   `xml:"DepartureTime"`
+	DepartureDayOffset           uint     `xml:"DepartureDayOffset"`
+}
+
+type netexServiceJourney struct {
+	Id                       string             `xml:"id,attr"`
+	Name                     string             `xml:"Name"`
+	PrivateCode              string             `xml:"PrivateCode"`
+	PublicCode               string             `xml:"PublicCode"`
+	DayTypeRefs              []netexRef         `xml:"dayTypes>DayTypeRef"`
+	ServiceJourneyPatternRef netexRef           `xml:"ServiceJourneyPatternRef"`
+	JourneyPatternRef        netexRef           `xml:"JourneyPatternRef"`
+	LineRef                  netexRef           `xml:"LineRef"`
+	DestinationRef           netexRef           `xml:"DestinationDisplayRef"`
+	PassingTimes             []netexPassingTime `xml:"passingTimes>TimetabledPassingTime"`
+}
+
+type netexDestinationDisplay struct {
+	Id        string `xml:"id,attr"`
+	FrontText string `xml:"FrontText"`
+}
+
+type netexDayType struct {
+	Id         string   `xml:"id,attr"`
+	DaysOfWeek []string `xml:"properties>PropertyOfDay>DaysOfWeek"` //one per PropertyOfDay, the day type runs on all of them
+}
+
+type netexOperatingPeriod struct {
+	Id           string `xml:"id,attr"`
+	FromDate     string `xml:"FromDate"`
+	ToDate       string `xml:"ToDate"`
+	ValidDayBits string `xml:"ValidDayBits"` //UicOperatingPeriod only
+}
+
+type netexOperatingDay struct {
+	Id           string `xml:"id,attr"`
+	CalendarDate string `xml:"CalendarDate"`
+}
+
+type netexDayTypeAssignment struct {
+	Order              int      `xml:"order,attr"`
+	OperatingPeriodRef netexRef `xml:"OperatingPeriodRef"`
+	OperatingDayRef    netexRef `xml:"OperatingDayRef"`
+	Date               string   `xml:"Date"`
+	DayTypeRef         netexRef `xml:"DayTypeRef"`
+	IsAvailable        *bool    `xml:"isAvailable"`
+}
+
+// a netexDocument accumulates the elements of every XML file in a NeTEx delivery.
+type netexDocument struct {
+	publisher           string
+	timeZone            string
+	operators           []netexOperator
+	stopPlaces          []netexStopPlace
+	scheduledStopPoints []netexScheduledStopPoint
+	assignments         []netexPassengerStopAssignment
+	lines               []netexLine
+	routes              []netexRoute
+	journeyPatterns     []netexJourneyPattern
+	serviceJourneys     []netexServiceJourney
+	destinations        []netexDestinationDisplay
+	dayTypes            []netexDayType
+	operatingPeriods    []netexOperatingPeriod
+	operatingDays       []netexOperatingDay
+	dayTypeAssignments  []netexDayTypeAssignment
+}
+
+func decodeNetexElement[T any](dec *xml.Decoder, start *xml.StartElement, output *[]T) error {
+	var element T
+	err := dec.DecodeElement(&element, start)
+	if err != nil {
+		return err
+	}
+	*output = append(*output, element)
+	return nil
+}
+
+// read walks through a NeTEx XML file and stores every element we know about.
+func (doc *netexDocument) read(r io.Reader) error {
+	dec := xml.NewDecoder(r)
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "ParticipantRef":
+			err = dec.DecodeElement(&doc.publisher, &start)
+		case "TimeZone":
+			err = dec.DecodeElement(&doc.timeZone, &start)
+		case "Operator", "Authority":
+			err = decodeNetexElement(dec, &start, &doc.operators)
+		case "StopPlace":
+			err = decodeNetexElement(dec, &start, &doc.stopPlaces)
+		case "ScheduledStopPoint":
+			err = decodeNetexElement(dec, &start, &doc.scheduledStopPoints)
+		case "PassengerStopAssignment":
+			err = decodeNetexElement(dec, &start, &doc.assignments)
+		case "Line":
+			err = decodeNetexElement(dec, &start, &doc.lines)
+		case "Route":
+			err = decodeNetexElement(dec, &start, &doc.routes)
+		case "ServiceJourneyPattern", "JourneyPattern":
+			err = decodeNetexElement(dec, &start, &doc.journeyPatterns)
+		case "ServiceJourney":
+			err = decodeNetexElement(dec, &start, &doc.serviceJourneys)
+		case "DestinationDisplay":
+			err = decodeNetexElement(dec, &start, &doc.destinations)
+		case "DayType":
+			err = decodeNetexElement(dec, &start, &doc.dayTypes)
+		case "OperatingPeriod", "UicOperatingPeriod":
+			err = decodeNetexElement(dec, &start, &doc.operatingPeriods)
+		case "OperatingDay":
+			err = decodeNetexElement(dec, &start, &doc.operatingDays)
+		case "DayTypeAssignment":
+			err = decodeNetexElement(dec, &start, &doc.dayTypeAssignments)
+		}
+		if err != nil {
+			return fmt.Errorf("error while decoding NeTEx %s: %s", start.Name.Local, err.Error())
+		}
+	}
+}
+
+// readNetexDocument reads either a single XML file or a zip archive containing XML files.
+func readNetexDocument(content []byte) (*netexDocument, error) {
+	doc := &netexDocument{}
+	if !bytes.HasPrefix(content, []byte("PK")) {
+		return doc, doc.read(bytes.NewReader(content))
+	}
+	zipFile, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	//shared files (stops, calendars...) are usually named with a leading underscore, order doesn't matter to us though
+	for _, file := range zipFile.File {
+		if !strings.EqualFold(path.Ext(file.Name), ".xml") {
+			continue
+		}
+		xmlFile, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = doc.read(xmlFile)
+		xmlFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name, err.Error())
+		}
+	}
+	return doc, nil
+}
+
+// converts a NeTEx TransportMode into a GTFS route type
+func netexTransportModeToRouteType(mode string) RouteType {
+	switch mode {
+	case "rail", "intercityRail", "urbanRail":
+		return RouteTypeHeavyRail
+	case "tram":
+		return RouteTypeTram
+	case "metro":
+		return RouteTypeSubway
+	case "water", "ferry":
+		return 4
+	case "cableway":
+		return 6
+	case "funicular":
+		return 7
+	case "trolleyBus":
+		return 11
+	}
+	return RouteTypeBus
+}
+
+// converts a NeTEx time ("hh:mm:ss") and day offset into a GTFS time ("hh:mm:ss", possibly over 24h)
+func netexTimeToGtfs(netexTime string, dayOffset uint) string {
+	if netexTime == "" {
+		return ""
+	}
+	var hours, minutes, seconds uint
+	_, err := fmt.Sscanf(netexTime, "%d:%d:%d", &hours, &minutes, &seconds)
+	if err != nil {
+		return netexTime //let convertTimes complain
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", hours+24*dayOffset, minutes, seconds)
+}
+
+func parseNetexDate(date string) (time.Time, error) {
+	//dates may come as xs:date or xs:dateTime, we only care about the date part
+	if len(date) > len(time.DateOnly) {
+		date = date[:len(time.DateOnly)]
+	}
+	return time.Parse(time.DateOnly, date)
+}
+
+// getServiceDates computes the dates every day type is running on.
+func (doc *netexDocument) getServiceDates() (map[string]map[time.Time]bool, error) {
+	const ONE_DAY = 24 * time.Hour
+	weekdaysByDayType := make(map[string]map[time.Weekday]bool)
+	for _, dayType := range doc.dayTypes {
+		days := strings.Fields(strings.Join(dayType.DaysOfWeek, " "))
+		if len(days) == 0 {
+			continue //no restriction
+		}
+		weekdays := make(map[time.Weekday]bool)
+		for _, day := range days {
+			switch day {
+			case "Weekdays":
+				for wd := time.Monday; wd <= time.Friday; wd++ {
+					weekdays[wd] = true
+				}
+			case "Weekend":
+				weekdays[time.Saturday] = true
+				weekdays[time.Sunday] = true
+			case "Everyday":
+				for wd := time.Sunday; wd <= time.Saturday; wd++ {
+					weekdays[wd] = true
+				}
+			default:
+				for wd := time.Sunday; wd <= time.Saturday; wd++ {
+					if wd.String() == day {
+						weekdays[wd] = true
+					}
+				}
+			}
+		}
+		weekdaysByDayType[dayType.Id] = weekdays
+	}
+	periods := make(map[string]netexOperatingPeriod)
+	for _, period := range doc.operatingPeriods {
+		periods[period.Id] = period
+	}
+	operatingDays := make(map[string]string)
+	for _, operatingDay := range doc.operatingDays {
+		operatingDays[operatingDay.Id] = operatingDay.CalendarDate
+	}
+
+	//assignments are applied by order, so that later exclusions override earlier inclusions
+	assignments := append([]netexDayTypeAssignment{}, doc.dayTypeAssignments...)
+	sort.SliceStable(assignments, func(i, j int) bool {
+		return assignments[i].Order < assignments[j].Order
+	})
+
+	serviceDates := make(map[string]map[time.Time]bool)
+	for _, assignment := range assignments {
+		dayTypeId := assignment.DayTypeRef.Ref
+		isAvailable := assignment.IsAvailable == nil || *assignment.IsAvailable
+		var dates []time.Time
+		switch {
+		case assignment.Date != "" || assignment.OperatingDayRef.Ref != "":
+			dateString := assignment.Date
+			if dateString == "" {
+				dateString = operatingDays[assignment.OperatingDayRef.Ref]
+			}
+			date, err := parseNetexDate(dateString)
+			if err != nil {
+				return nil, err
+			}
+			dates = append(dates, date)
+		case assignment.OperatingPeriodRef.Ref != "":
+			period, ok := periods[assignment.OperatingPeriodRef.Ref]
+			if !ok {
+				return nil, fmt.Errorf("unknown operating period %s", assignment.OperatingPeriodRef.Ref)
+			}
+			fromDate, err := parseNetexDate(period.FromDate)
+			if err != nil {
+				return nil, err
+			}
+			toDate, err := parseNetexDate(period.ToDate)
+			if err != nil {
+				return nil, err
+			}
+			weekdays, hasWeekdays := weekdaysByDayType[dayTypeId]
+			dayIndex := 0
+			for date := fromDate; !date.After(toDate); date = date.Add(ONE_DAY) {
+				isValidBit := period.ValidDayBits == "" ||
+					(dayIndex < len(period.ValidDayBits) && period.ValidDayBits[dayIndex] == '1')
+				if isValidBit && (!hasWeekdays || weekdays[date.Weekday()]) {
+					dates = append(dates, date)
+				}
+				dayIndex++
+			}
+		}
+		if serviceDates[dayTypeId] == nil {
+			serviceDates[dayTypeId] = make(map[time.Time]bool)
+		}
+		for _, date := range dates {
+			if isAvailable {
+				serviceDates[dayTypeId][date] = true
+			} else {
+				delete(serviceDates[dayTypeId], date)
+			}
+		}
+	}
+	return serviceDates, nil
+}
+
+// netexServiceId returns the ID of the service running on all the given day types, and their sorted distinct IDs.
+// A single day type is its own service, several ones are combined into a service named after all of them.
+func netexServiceId(dayTypeRefs []netexRef) (string, []string) {
+	dayTypeIds := make([]string, 0, len(dayTypeRefs))
+	for _, dayTypeRef := range dayTypeRefs {
+		dayTypeIds = append(dayTypeIds, dayTypeRef.Ref)
+	}
+	sort.Strings(dayTypeIds)
+	dayTypeIds = slices.Compact(dayTypeIds)
+	return strings.Join(dayTypeIds, "+"), dayTypeIds
+}
+
+func (loc netexLocation) apply(stop *Stop) bool {
+	if loc.Latitude == nil || loc.Longitude == nil {
+		return false
+	}
+	stop.StopLat = *loc.Latitude
+	stop.StopLon = *loc.Longitude
+	return true
+}
+
+// processNetexFeed converts a NeTEx delivery into the same rows as a GTFS feed.
+func processNetexFeed(content []byte, feedId string, writer *dbWriter, configEntry LoaderConfigEntry) error {
+	doc, err := readNetexDocument(content)
+	if err != nil {
+		return err
+	}
+
+	//agencies
+	agencies := make([]Agency, 0, len(doc.operators))
+	knownAgencies := make(map[string]bool)
+	for _, operator := range doc.operators {
+		if knownAgencies[operator.Id] {
+			continue
+		}
+		knownAgencies[operator.Id] = true
+		agencies = append(agencies, Agency{
+			FeedId:         feedId,
+			AgencyId:       operator.Id,
+			AgencyName:     operator.Name,
+			AgencyUrl:      operator.Url,
+			AgencyTimezone: firstNonEmpty(doc.timeZone, configEntry.TimeZone),
+		})
+	}
+
+	//routes (NeTEx lines)
+	validRouteIds := make(map[string]bool)
+	routes := make([]Route, 0, len(doc.lines))
+	for _, line := range doc.lines {
+		routeType := netexTransportModeToRouteType(line.TransportMode)
+		if routeType == RouteTypeBus {
+			continue
+		}
+		shortName := line.PublicCode
+		if shortName == "" {
+			shortName = line.ShortName
+		}
+		agencyId := line.OperatorRef.Ref
+		if agencyId == "" {
+			agencyId = line.AuthorityRef.Ref
+		}
+		routes = append(routes, Route{
+			FeedId:         feedId,
+			RouteId:        line.Id,
+			RouteShortName: shortName,
+			RouteLongName:  line.Name,
+			RouteDesc:      line.Description,
+			RouteType:      routeType,
+			RouteColor:     line.Colour,
+			RouteTextColor: line.TextColour,
+			AgencyId:       agencyId,
+		})
+		validRouteIds[line.Id] = true
+	}
+
+	//stops: stop places become stations, quays become platforms
+	stops := make([]Stop, 0, len(doc.stopPlaces))
+	knownStops := make(map[string]bool)
+	stationType := LocationTypeStation
+	platformType := LocationTypePlatform
+	for _, stopPlace := range doc.stopPlaces {
+		station := Stop{
+			FeedId:       feedId,
+			StopId:       stopPlace.Id,
+			StopCode:     stopPlace.PrivateCode,
+			StopName:     stopPlace.Name,
+			LocationType: &stationType,
+		}
+		hasLocation := stopPlace.Centroid.apply(&station)
+		for _, quay := range stopPlace.Quays {
+			parentId := stopPlace.Id
+			platform := Stop{
+				FeedId:          feedId,
+				StopId:          quay.Id,
+				StopCode:        quay.Code,
+				StopName:        firstNonEmpty(quay.Name, stopPlace.Name),
+				LocationType:    &platformType,
+				ParentStationId: &parentId,
+			}
+			if !quay.Centroid.apply(&platform) {
+				platform.StopLat = station.StopLat
+				platform.StopLon = station.StopLon
+			}
+			if !hasLocation {
+				//use the first located quay for the station
+				hasLocation = quay.Centroid.apply(&station)
+			}
+			stops = append(stops, platform)
+			knownStops[quay.Id] = true
+		}
+		stops = append(stops, station)
+		knownStops[stopPlace.Id] = true
+	}
+
+	//scheduled stop points are mapped to their quay (or stop place), and used directly as a fallback
+	stopPointToStop := make(map[string]string)
+	for _, assignment := range doc.assignments {
+		stopId := assignment.QuayRef.Ref
+		if stopId == "" {
+			stopId = assignment.StopPlaceRef.Ref
+		}
+		stopPointToStop[assignment.ScheduledStopPointRef.Ref] = stopId
+	}
+	for _, stopPoint := range doc.scheduledStopPoints {
+		if _, ok := stopPointToStop[stopPoint.Id]; ok {
+			continue
+		}
+		stop := Stop{FeedId: feedId, StopId: stopPoint.Id, StopName: stopPoint.Name}
+		if stopPoint.netexLocation.apply(&stop) && !knownStops[stopPoint.Id] {
+			stops = append(stops, stop)
+			knownStops[stopPoint.Id] = true
+		}
+		stopPointToStop[stopPoint.Id] = stopPoint.Id
+	}
+
+	//journey patterns: point in pattern -> stop, and pattern -> line
+	routeToLine := make(map[string]string)
+	for _, route := range doc.routes {
+		routeToLine[route.Id] = route.LineRef.Ref
+	}
+	destinations := make(map[string]string)
+	for _, destination := range doc.destinations {
+		destinations[destination.Id] = destination.FrontText
+	}
+	patterns := make(map[string]netexJourneyPattern)
+	pointToStopPoint := make(map[string]netexStopPointInJourneyPattern)
+	for _, pattern := range doc.journeyPatterns {
+		patterns[pattern.Id] = pattern
+		for _, point := range pattern.Points {
+			pointToStopPoint[point.Id] = point
+		}
+	}
+
+	//trips and stop times
+	serviceDayTypes := make(map[string][]string) //service ID -> day types it combines
+	trips := make([]Trip, 0, len(doc.serviceJourneys))
+	var stopTimes []StopTime
+	for _, journey := range doc.serviceJourneys {
+		patternId := journey.ServiceJourneyPatternRef.Ref
+		if patternId == "" {
+			patternId = journey.JourneyPatternRef.Ref
+		}
+		pattern := patterns[patternId]
+		lineId := journey.LineRef.Ref
+		if lineId == "" {
+			lineId = routeToLine[pattern.RouteRef.Ref]
+		}
+		if !validRouteIds[lineId] {
+			continue
+		}
+		if len(journey.DayTypeRefs) == 0 {
+			continue //not running on any day
+		}
+		shortName := journey.PublicCode
+		if shortName == "" {
+			shortName = journey.PrivateCode
+		}
+		destinationId := journey.DestinationRef.Ref
+		if destinationId == "" {
+			destinationId = pattern.DestinationRef.Ref
+		}
+		//a trip only has a single service, so a journey with several day types runs on a service combining them
+		serviceId, dayTypeIds := netexServiceId(journey.DayTypeRefs)
+		serviceDayTypes[serviceId] = dayTypeIds
+		trips = append(trips, Trip{
+			FeedId:        feedId,
+			TripId:        journey.Id,
+			RefRouteId:    lineId,
+			RefServiceId:  serviceId,
+			Headsign:      destinations[destinationId],
+			TripShortName: shortName,
+		})
+
+		for i, passingTime := range journey.PassingTimes {
+			point, ok := pointToStopPoint[passingTime.StopPointInJourneyPatternRef.Ref]
+			if !ok {
+				return fmt.Errorf("service journey %s: unknown stop point in journey pattern %s", journey.Id, passingTime.StopPointInJourneyPatternRef.Ref)
+			}
+			stopSequence := point.Order
+			if stopSequence == 0 {
+				stopSequence = uint(i + 1)
+			}
+			stopTime := StopTime{
+				FeedId:           feedId,
+				TripId:           journey.Id,
+				StopId:           stopPointToStop[point.ScheduledStopPointRef.Ref],
+				StopSequence:     stopSequence,
+				CsvArrivalTime:   netexTimeToGtfs(passingTime.ArrivalTime, passingTime.ArrivalDayOffset),
+				CsvDepartureTime: netexTimeToGtfs(passingTime.DepartureTime, passingTime.DepartureDayOffset),
+			}
+			if point.ForBoarding != nil && !*point.ForBoarding {
+				stopTime.PickupType = ServiceTypeNotPossible
+			}
+			if point.ForAlighting != nil && !*point.ForAlighting {
+				stopTime.DropOffType = ServiceTypeNotPossible
+			}
+			err = stopTime.convertTimes()
+			if err != nil {
+				return fmt.Errorf("service journey %s: %s", journey.Id, err.Error())
+			}
+			stopTimes = append(stopTimes, stopTime)
+		}
+	}
+
+	entities := feedEntities{agencies: agencies, routes: routes, trips: trips, stopTimes: stopTimes, stops: stops}
+	validServiceIds, err := applyFeedRules(writer, feedId, configEntry, &entities)
+	if err != nil {
+		return err
+	}
+	agencies, routes, trips, stopTimes, stops = entities.agencies, entities.routes, entities.trips, entities.stopTimes, entities.stops
+
+	//services: every date becomes an added calendar date, so that calculateServiceDays picks it up
+	serviceDates, err := doc.getServiceDates()
+	if err != nil {
+		return err
+	}
+	var calendarDates []CalendarDate
+	for serviceId, dayTypeIds := range serviceDayTypes {
+		if !validServiceIds[serviceId] {
+			continue
+		}
+		dates := make(map[time.Time]bool)
+		for _, dayTypeId := range dayTypeIds {
+			for date := range serviceDates[dayTypeId] {
+				dates[date] = true //overlapping day types only add the date once
+			}
+		}
+		for date := range dates {
+			calendarDates = append(calendarDates, CalendarDate{
+				FeedId:        feedId,
+				ServiceId:     serviceId,
+				Date:          date,
+				ExceptionType: ExceptionTypeServiceAdded,
+			})
+		}
+	}
+
+	feeds := []Feed{{FeedId: feedId, DisplayName: configEntry.DisplayName, PublisherName: doc.publisher}}
+
+	err = addToDB(writer, routes)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, trips)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, calendarDates)
+	if err != nil {
+		return err
+	}
+	err = calculateServiceDays(writer, nil, calendarDates)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, stopTimes)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, stops)
+	if err != nil {
+		return err
+	}
+	err = addToDB(writer, agencies)
+	if err != nil {
+		return err
+	}
+	return addToDB(writer, feeds)
+}
@@ -0,0 +1,104 @@
+package trainmapdb
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNetexFeed(t *testing.T) {
+	fetcher := loadTestDatabase(t, testFeed(FeedFormatNeTEx, "testdata/netex.xml"))
+
+	var routes []Route
+	err := fetcher.db.Find(&routes).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].RouteId != "FR:Line:DIJ-BES" || routes[0].AgencyId != "FR:Operator:TER" {
+		t.Errorf("got routes %v, expected the rail line only", routes)
+	}
+
+	//a journey running on overlapping day types is a single trip, running once on each date
+	var trips []Trip
+	err = fetcher.db.Order("trip_id").Find(&trips).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 2 {
+		t.Fatalf("got %d trips, expected 2", len(trips))
+	}
+	if trips[0].TripId != "FR:ServiceJourney:891100" || trips[0].TripShortName != "891100" || trips[0].Headsign != "Besançon Viotte" {
+		t.Errorf("unexpected trip %+v", trips[0])
+	}
+	expectedDates := map[string][]string{
+		trips[0].RefServiceId: {"2024-05-13", "2024-05-14", "2024-05-16"},
+		trips[1].RefServiceId: {"2024-05-18"},
+	}
+	for serviceId, expected := range expectedDates {
+		var serviceDays []ServiceDay
+		err = fetcher.db.Where("service_id = ?", serviceId).Order("date").Find(&serviceDays).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dates []string
+		for _, serviceDay := range serviceDays {
+			dates = append(dates, serviceDay.Date.UTC().Format(time.DateOnly))
+		}
+		if !slices.Equal(dates, expected) {
+			t.Errorf("service %s runs on %v, expected %v", serviceId, dates, expected)
+		}
+	}
+
+	var stopTimes []StopTime
+	err = fetcher.db.Where("trip_id = ?", "FR:ServiceJourney:891100").Order("stop_sequence").Find(&stopTimes).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopTimes) != 2 || stopTimes[0].StopId != "FR:Quay:DIJ-A" || stopTimes[1].StopId != "FR:Quay:BES-1" {
+		t.Fatalf("unexpected stop times %+v", stopTimes)
+	}
+	if stopTimes[0].DropOffType != ServiceTypeNotPossible || stopTimes[1].PickupType != ServiceTypeNotPossible {
+		t.Errorf("boarding and alighting restrictions weren't kept: %+v", stopTimes)
+	}
+
+	//quays keep their own name when they have one
+	expectedNames := map[string]string{
+		"FR:StopPlace:DIJ": "Dijon",
+		"FR:Quay:DIJ-A":    "Dijon voie A",
+		"FR:Quay:DIJ-B":    "Dijon",
+		"FR:Quay:BES-1":    "Besançon Viotte",
+	}
+	for stopId, expected := range expectedNames {
+		var stop Stop
+		err = fetcher.db.Where("stop_id = ?", stopId).Take(&stop).Error
+		if err != nil {
+			t.Fatalf("%s: %s", stopId, err.Error())
+		}
+		if stop.StopName != expected {
+			t.Errorf("%s is named %q, expected %q", stopId, stop.StopName, expected)
+		}
+	}
+}
+
+func TestNetexDaysOfWeek(t *testing.T) {
+	doc := &netexDocument{
+		dayTypes:         []netexDayType{{Id: "dt", DaysOfWeek: []string{"Monday", "Saturday Sunday"}}},
+		operatingPeriods: []netexOperatingPeriod{{Id: "op", FromDate: "2024-05-13", ToDate: "2024-05-19"}},
+		dayTypeAssignments: []netexDayTypeAssignment{
+			{Order: 1, OperatingPeriodRef: netexRef{Ref: "op"}, DayTypeRef: netexRef{Ref: "dt"}},
+		},
+	}
+	serviceDates, err := doc.getServiceDates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dates []string
+	for date := range serviceDates["dt"] {
+		dates = append(dates, date.Format(time.DateOnly))
+	}
+	slices.Sort(dates)
+	expected := []string{"2024-05-13", "2024-05-18", "2024-05-19"}
+	if !slices.Equal(dates, expected) {
+		t.Errorf("got dates %v, expected %v", dates, expected)
+	}
+}
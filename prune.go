@@ -0,0 +1,151 @@
+package trainmapdb
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A DateWindow is a range of service dates relative to the current day, see LoaderConfig.DateWindow and PruneDatabase.
+type DateWindow struct {
+	DaysBefore int `json:"days_before"` //e.g. 1 keeps yesterday's services, whose trips may still run after midnight
+	DaysAfter  int `json:"days_after"`
+}
+
+// Dates returns the first and last dates of the window around the given day, as seen in its location
+// (e.g. time.Now().In(tz) for the current day in tz). Like service dates, they're at midnight UTC.
+func (w DateWindow) Dates(day time.Time) (time.Time, time.Time) {
+	year, month, dayOfMonth := day.Date()
+	today := time.Date(year, month, dayOfMonth, 0, 0, 0, 0, time.UTC)
+	return today.AddDate(0, 0, -w.DaysBefore), today.AddDate(0, 0, w.DaysAfter)
+}
+
+// PruneStats counts the rows removed by a prune.
+type PruneStats struct {
+	ServiceDays   int64
+	CalendarDates int64
+	Calendars     int64
+	Trips         int64
+	StopTimes     int64
+	Routes        int64
+	Agencies      int64
+	Stops         int64
+	Stations      int64
+}
+
+// PruneDatabase removes the services running outside the given dates (both included), the trips left without any service day
+// and their stop times, then the routes, agencies, stops and stations nothing refers to anymore.
+// It then reclaims the freed space (VACUUM), refreshes the query planner statistics (ANALYZE),
+// rebuilds the spatial index and reloads the snapshot, if one is used.
+// Use DateWindow.Dates for a window relative to the current day.
+func (f Fetcher) PruneDatabase(startDate time.Time, endDate time.Time) (PruneStats, error) {
+	if f.db == nil {
+		return PruneStats{}, ErrNoDatabase
+	}
+	if endDate.Before(startDate) {
+		return PruneStats{}, fmt.Errorf("invalid date window: %s is after %s", startDate.Format(time.DateOnly), endDate.Format(time.DateOnly))
+	}
+	defer f.networkChanged()
+	db := f.db.WithContext(f.context())
+	var stats PruneStats
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		stats, err = pruneRows(tx, startDate, endDate)
+		return err
+	})
+	if err != nil {
+		return stats, fmt.Errorf("error when pruning: %s", err.Error())
+	}
+	err = optimizeDatabase(db)
+	if err != nil {
+		return stats, fmt.Errorf("error when optimizing: %s", err.Error())
+	}
+	err = f.BuildSpatialIndex()
+	if err != nil {
+		return stats, fmt.Errorf("error when building spatial index: %s", err.Error())
+	}
+	if f.CurrentSnapshot() != nil {
+		err = f.ReloadSnapshot()
+		if err != nil {
+			return stats, fmt.Errorf("error when building snapshot: %s", err.Error())
+		}
+	}
+	return stats, nil
+}
+
+// pruneRows deletes the rows outside the dates, dependent rows first so that foreign keys hold.
+// NOTE: MySQL can't delete from a table also read in a subquery, unless the subquery goes through a derived table.
+func pruneRows(db *gorm.DB, startDate time.Time, endDate time.Time) (PruneStats, error) {
+	var stats PruneStats
+	steps := []struct {
+		count     *int64
+		statement string
+		values    []any
+	}{
+		{&stats.ServiceDays, "DELETE FROM service_days WHERE date < ? OR date > ?", []any{startDate, endDate}},
+		{&stats.CalendarDates, "DELETE FROM calendar_dates WHERE date < ? OR date > ?", []any{startDate, endDate}},
+		{&stats.StopTimes, `DELETE FROM stop_times WHERE (feed_id, trip_id) IN (
+			SELECT feed_id, trip_id FROM trips WHERE (feed_id, ref_service_id) NOT IN (SELECT DISTINCT feed_id, service_id FROM service_days))`, nil},
+		{&stats.Trips, "DELETE FROM trips WHERE (feed_id, ref_service_id) NOT IN (SELECT DISTINCT feed_id, service_id FROM service_days)", nil},
+		{&stats.Calendars, "DELETE FROM calendar WHERE (feed_id, service_id) NOT IN (SELECT DISTINCT feed_id, ref_service_id FROM trips)", nil},
+		{nil, "UPDATE calendar SET start_date = ? WHERE start_date < ?", []any{startDate, startDate}},
+		{nil, "UPDATE calendar SET end_date = ? WHERE end_date > ?", []any{endDate, endDate}},
+		{&stats.Routes, "DELETE FROM routes WHERE (feed_id, route_id) NOT IN (SELECT DISTINCT feed_id, ref_route_id FROM trips)", nil},
+		{&stats.Agencies, "DELETE FROM agency WHERE (feed_id, agency_id) NOT IN (SELECT DISTINCT feed_id, agency_id FROM routes)", nil},
+	}
+	for _, step := range steps {
+		result := db.Exec(step.statement, step.values...)
+		if result.Error != nil {
+			return stats, result.Error
+		}
+		if step.count != nil {
+			*step.count = result.RowsAffected
+		}
+	}
+
+	//stops without stop times, unless they're the parent station of a kept stop: removing platforms may orphan their station, so go on until nothing changes
+	for {
+		result := db.Exec(`DELETE FROM stops WHERE (feed_id, stop_id) NOT IN (SELECT DISTINCT feed_id, stop_id FROM stop_times)
+			AND (feed_id, stop_id) NOT IN (SELECT feed_id, parent_station_id FROM (
+				SELECT DISTINCT feed_id, parent_station_id FROM stops WHERE parent_station_id IS NOT NULL) AS parents)`)
+		if result.Error != nil {
+			return stats, result.Error
+		}
+		stats.Stops += result.RowsAffected
+		if result.RowsAffected == 0 {
+			break
+		}
+	}
+
+	result := db.Exec("DELETE FROM stations WHERE station_id NOT IN (SELECT DISTINCT station_id FROM stops WHERE station_id IS NOT NULL)")
+	if result.Error != nil {
+		return stats, result.Error
+	}
+	stats.Stations = result.RowsAffected
+	return stats, nil
+}
+
+// optimizeDatabase reclaims the space of deleted rows and refreshes the statistics of the query planner.
+func optimizeDatabase(db *gorm.DB) error {
+	var statements []string
+	switch db.Dialector.Name() {
+	case "sqlite":
+		statements = []string{"VACUUM", "ANALYZE"}
+	case "postgres":
+		statements = []string{"VACUUM ANALYZE"} //can't run in a transaction, which gorm doesn't use for Exec
+	case "mysql":
+		tables := "agency, calendar, calendar_dates, service_days, routes, trips, stop_times, stops, stations"
+		statements = []string{"OPTIMIZE TABLE " + tables, "ANALYZE TABLE " + tables}
+	default:
+		return nil
+	}
+	for _, statement := range statements {
+		//MySQL's OPTIMIZE/ANALYZE TABLE return a result set, which Exec simply discards
+		err := db.Exec(statement).Error
+		if err != nil {
+			return fmt.Errorf("could not run %s: %s", statement, err.Error())
+		}
+	}
+	return nil
+}
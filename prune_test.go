@@ -0,0 +1,101 @@
+package trainmapdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDateWindowDates(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//still the 13th in UTC
+	startDate, endDate := DateWindow{DaysBefore: 1, DaysAfter: 2}.Dates(time.Date(2024, 5, 14, 0, 30, 0, 0, paris))
+	if !startDate.Equal(serviceDate(t, "2024-05-13")) || !endDate.Equal(serviceDate(t, "2024-05-16")) {
+		t.Errorf("got window %s - %s, expected 2024-05-13 - 2024-05-16", startDate, endDate)
+	}
+}
+
+func TestPruneDatabase(t *testing.T) {
+	fetcher := newTestFetcher(t)
+	insertTestRows(t, fetcher, Feed{FeedId: "1"})
+	insertTestRows(t, fetcher, Agency{FeedId: "1", AgencyId: "kept-op"}, Agency{FeedId: "1", AgencyId: "old-op"})
+	insertTestRows(t, fetcher,
+		Route{FeedId: "1", RouteId: "kept", AgencyId: "kept-op"},
+		Route{FeedId: "1", RouteId: "old", AgencyId: "old-op"},
+	)
+	insertTestRows(t, fetcher,
+		Calendar{FeedId: "1", ServiceId: "kept", StartDate: serviceDate(t, "2024-01-01"), EndDate: serviceDate(t, "2024-12-31")},
+		Calendar{FeedId: "1", ServiceId: "old", StartDate: serviceDate(t, "2024-05-01"), EndDate: serviceDate(t, "2024-05-01")},
+	)
+	insertTestRows(t, fetcher,
+		ServiceDay{FeedId: "1", ServiceId: "kept", Date: serviceDate(t, "2024-05-14")},
+		ServiceDay{FeedId: "1", ServiceId: "old", Date: serviceDate(t, "2024-05-01")},
+	)
+	insertTestRows(t, fetcher,
+		Trip{FeedId: "1", TripId: "kept", RefRouteId: "kept", RefServiceId: "kept"},
+		Trip{FeedId: "1", TripId: "old", RefRouteId: "old", RefServiceId: "old"},
+	)
+	insertTestRows(t, fetcher, Station{StationId: "A"}, Station{StationId: "B"}, Station{StationId: "C"}, Station{StationId: "D"})
+	station := func(stationId string) *string { return &stationId }
+	//A and D are stations whose platforms are A-1 and D-1
+	insertTestRows(t, fetcher,
+		Stop{FeedId: "1", StopId: "A", StationId: station("A")},
+		Stop{FeedId: "1", StopId: "D", StationId: station("D")},
+	)
+	insertTestRows(t, fetcher,
+		Stop{FeedId: "1", StopId: "A-1", ParentStationId: station("A"), StationId: station("A")},
+		Stop{FeedId: "1", StopId: "B", StationId: station("B")},
+		Stop{FeedId: "1", StopId: "C", StationId: station("C")},
+		Stop{FeedId: "1", StopId: "D-1", ParentStationId: station("D"), StationId: station("D")},
+	)
+	insertTestRows(t, fetcher,
+		StopTime{FeedId: "1", TripId: "old", StopId: "A-1", StopSequence: 1},
+		StopTime{FeedId: "1", TripId: "old", StopId: "B", StopSequence: 2},
+		StopTime{FeedId: "1", TripId: "kept", StopId: "C", StopSequence: 1},
+		StopTime{FeedId: "1", TripId: "kept", StopId: "D-1", StopSequence: 2},
+	)
+
+	stats, err := fetcher.PruneDatabase(serviceDate(t, "2024-05-13"), serviceDate(t, "2024-05-19"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedStats := PruneStats{ServiceDays: 1, Calendars: 1, Trips: 1, StopTimes: 2, Routes: 1, Agencies: 1, Stops: 3, Stations: 2}
+	if stats != expectedStats {
+		t.Errorf("got stats %+v, expected %+v", stats, expectedStats)
+	}
+
+	for _, remaining := range []struct {
+		table    string
+		column   string
+		expected []string
+	}{
+		{"trips", "trip_id", []string{"kept"}},
+		{"routes", "route_id", []string{"kept"}},
+		{"agency", "agency_id", []string{"kept-op"}},
+		{"calendar", "service_id", []string{"kept"}},
+		//the orphaned platform A-1 goes first, then its station A
+		{"stops", "stop_id", []string{"C", "D", "D-1"}},
+		{"stations", "station_id", []string{"C", "D"}},
+	} {
+		var ids []string
+		err := fetcher.db.Table(remaining.table).Order(remaining.column).Pluck(remaining.column, &ids).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, remaining.expected) {
+			t.Errorf("got %s %v after pruning, expected %v", remaining.table, ids, remaining.expected)
+		}
+	}
+
+	var calendar Calendar
+	err = fetcher.db.Where("feed_id = ? AND service_id = ?", "1", "kept").First(&calendar).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !calendar.StartDate.Equal(serviceDate(t, "2024-05-13")) || !calendar.EndDate.Equal(serviceDate(t, "2024-05-19")) {
+		t.Errorf("got calendar dates %s - %s, expected them clipped to the window", calendar.StartDate, calendar.EndDate)
+	}
+}
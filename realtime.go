@@ -0,0 +1,179 @@
+package trainmapdb
+
+import (
+	"sync"
+	"time"
+)
+
+// A FeededTrip represents a combined feed ID and trip ID.
+type FeededTrip struct {
+	FeedId string
+	TripId string
+}
+
+// A TripAdjustment represents a realtime change to a trip running on a given service date.
+type TripAdjustment struct {
+	FeedId     string                   `json:"feed_id"`
+	TripId     string                   `json:"trip_id"`
+	Date       time.Time                `json:"date"` //service date, same format as ServiceDay.Date
+	Delay      time.Duration            `json:"delay"`
+	Cancelled  bool                     `json:"cancelled"`
+	StopDelays map[string]time.Duration `json:"stop_delays"` //delays known at specific stops (by stop ID), overriding Delay
+	//stops not served anymore (by stop ID), for partially cancelled trips:
+	//the trip doesn't run before its first served stop nor after its last one, but still passes through the skipped ones in between
+	CancelledStops map[string]bool `json:"cancelled_stops"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// delayAt returns the delay to apply at the given stop.
+func (ta TripAdjustment) delayAt(stopId string) time.Duration {
+	if delay, ok := ta.StopDelays[stopId]; ok {
+		return delay
+	}
+	return ta.Delay
+}
+
+// servedStopTimes returns the stop times from the first to the last stop still served,
+// which may be less than 2 if the trip doesn't run at all anymore.
+func (ta TripAdjustment) servedStopTimes(stopTimes []StopTime) []StopTime {
+	if len(ta.CancelledStops) == 0 {
+		return stopTimes
+	}
+	first, last := -1, -1
+	for i, st := range stopTimes {
+		if ta.CancelledStops[st.StopId] {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		last = i
+	}
+	if first == -1 {
+		return nil
+	}
+	return stopTimes[first : last+1]
+}
+
+// runsBetween checks whether the trip still runs between two of its consecutive stop times.
+func (ta TripAdjustment) runsBetween(stopTimes []StopTime, stBefore StopTime, stAfter StopTime) bool {
+	served := ta.servedStopTimes(stopTimes)
+	if len(served) < 2 {
+		return false
+	}
+	return served[0].StopSequence <= stBefore.StopSequence && served[len(served)-1].StopSequence >= stAfter.StopSequence
+}
+
+type tripAdjustmentKey struct {
+	FeededTrip
+	Date string //see serviceDateKey
+}
+
+// serviceDateKey identifies a service date whatever the location of the time.Time holding it
+// (DB drivers may return dates in the local time zone, while SIRI ones are parsed in UTC).
+// Service dates are midnight UTC, see NewDate.
+func serviceDateKey(date time.Time) string {
+	return date.UTC().Format(time.DateOnly)
+}
+
+// A RealtimeState holds the realtime adjustments currently known for trips.
+// It is safe for concurrent use.
+type RealtimeState struct {
+	mutex       sync.RWMutex
+	adjustments map[tripAdjustmentKey]TripAdjustment
+}
+
+func NewRealtimeState() *RealtimeState {
+	return &RealtimeState{adjustments: make(map[tripAdjustmentKey]TripAdjustment)}
+}
+
+// SetAdjustment stores (or replaces) the adjustment for its trip and date.
+func (rs *RealtimeState) SetAdjustment(adjustment TripAdjustment) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	key := tripAdjustmentKey{
+		FeededTrip: FeededTrip{FeedId: adjustment.FeedId, TripId: adjustment.TripId},
+		Date:       serviceDateKey(adjustment.Date),
+	}
+	rs.adjustments[key] = adjustment
+}
+
+// UpdateAdjustment changes the adjustment for the given trip and date in place,
+// starting from an empty one if none is known yet. The update runs with the state locked.
+func (rs *RealtimeState) UpdateAdjustment(feedId string, tripId string, date time.Time, update func(adjustment *TripAdjustment)) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	key := tripAdjustmentKey{FeededTrip: FeededTrip{FeedId: feedId, TripId: tripId}, Date: serviceDateKey(date)}
+	adjustment, ok := rs.adjustments[key]
+	if !ok {
+		adjustment = TripAdjustment{FeedId: feedId, TripId: tripId, Date: date}
+	}
+	update(&adjustment)
+	rs.adjustments[key] = adjustment
+}
+
+// GetAdjustment returns the adjustment known for the given trip on the given service date, if any.
+func (rs *RealtimeState) GetAdjustment(feedId string, tripId string, date time.Time) (TripAdjustment, bool) {
+	if rs == nil {
+		return TripAdjustment{}, false
+	}
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	adjustment, ok := rs.adjustments[tripAdjustmentKey{FeededTrip: FeededTrip{FeedId: feedId, TripId: tripId}, Date: serviceDateKey(date)}]
+	return adjustment, ok
+}
+
+// GetAdjustments returns a copy of all the known adjustments.
+func (rs *RealtimeState) GetAdjustments() []TripAdjustment {
+	if rs == nil {
+		return nil
+	}
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	adjustments := make([]TripAdjustment, 0, len(rs.adjustments))
+	for _, adjustment := range rs.adjustments {
+		adjustments = append(adjustments, adjustment)
+	}
+	return adjustments
+}
+
+// PruneBefore removes all adjustments for service dates strictly before the given date.
+func (rs *RealtimeState) PruneBefore(date time.Time) {
+	if rs == nil {
+		return
+	}
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	dateKey := serviceDateKey(date)
+	for key := range rs.adjustments {
+		if key.Date < dateKey { //dates in this format sort chronologically
+			delete(rs.adjustments, key)
+		}
+	}
+}
+
+// Clear removes all the known adjustments.
+func (rs *RealtimeState) Clear() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.adjustments = make(map[tripAdjustmentKey]TripAdjustment)
+}
+
+// withAdjustment returns a copy of the trip with all its stop times shifted according to the adjustment,
+// only keeping the ones it still runs between (see TripAdjustment.CancelledStops).
+func (trip Trip) withAdjustment(adjustment TripAdjustment) Trip {
+	newTrip := trip
+	servedStopTimes := adjustment.servedStopTimes(trip.StopTimes)
+	newTrip.StopTimes = make([]StopTime, len(servedStopTimes))
+	for i, st := range servedStopTimes {
+		delay := adjustment.delayAt(st.StopId)
+		if !st.ArrivalTime.IsZero() {
+			st.ArrivalTime = st.ArrivalTime.Add(delay)
+		}
+		if !st.DepartureTime.IsZero() {
+			st.DepartureTime = st.DepartureTime.Add(delay)
+		}
+		newTrip.StopTimes[i] = st
+	}
+	return newTrip
+}
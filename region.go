@@ -0,0 +1,295 @@
+package trainmapdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A Region restricts a load to the trips stopping in a given area, see LoaderConfig.Region.
+// Set either BoundingBox or GeoJSON (a Polygon or MultiPolygon geometry, or a Feature/FeatureCollection/GeometryCollection of them).
+type Region struct {
+	BoundingBox *BoundingBox    `json:"bbox"`
+	GeoJSON     json.RawMessage `json:"geojson"`
+	BufferKm    float64         `json:"buffer_km"` //stops up to this distance outside the area count as inside
+}
+
+// a regionFilter is a compiled Region.
+type regionFilter struct {
+	polygons [][][]Point //every polygon is a list of rings, the first one is the outer ring and the others are holes
+	bounds   BoundingBox //bounding box of every polygon
+	bufferKm float64
+}
+
+const kmPerDegree = 111.32 //at the equator, or along any meridian
+
+func (r Region) compile() (*regionFilter, error) {
+	if r.BufferKm < 0 {
+		return nil, fmt.Errorf("negative region buffer: %f", r.BufferKm)
+	}
+	rf := &regionFilter{bufferKm: r.BufferKm}
+	switch {
+	case r.BoundingBox != nil && len(r.GeoJSON) > 0:
+		return nil, errors.New("region has both a bounding box and a GeoJSON geometry")
+	case r.BoundingBox != nil:
+		bb := *r.BoundingBox
+		rf.polygons = [][][]Point{{{
+			{Lat: bb.MinLat, Lon: bb.MinLon},
+			{Lat: bb.MinLat, Lon: bb.MaxLon},
+			{Lat: bb.MaxLat, Lon: bb.MaxLon},
+			{Lat: bb.MaxLat, Lon: bb.MinLon},
+		}}}
+	case len(r.GeoJSON) > 0:
+		var object geoJSONObject
+		err := json.Unmarshal(r.GeoJSON, &object)
+		if err != nil {
+			return nil, fmt.Errorf("invalid region GeoJSON: %s", err.Error())
+		}
+		rf.polygons, err = object.polygons()
+		if err != nil {
+			return nil, fmt.Errorf("invalid region GeoJSON: %s", err.Error())
+		}
+	default:
+		return nil, errors.New("region has neither a bounding box nor a GeoJSON geometry")
+	}
+
+	first := true
+	for _, polygon := range rf.polygons {
+		if len(polygon) == 0 || len(polygon[0]) < 3 {
+			return nil, errors.New("region polygon with less than 3 points")
+		}
+		for _, pt := range polygon[0] {
+			ptBox := BoundingBox{MinLat: pt.Lat, MaxLat: pt.Lat, MinLon: pt.Lon, MaxLon: pt.Lon}
+			if first {
+				rf.bounds = ptBox
+				first = false
+			}
+			rf.bounds = rf.bounds.union(ptBox)
+		}
+	}
+	if first {
+		return nil, errors.New("region has no polygon")
+	}
+	return rf, nil
+}
+
+// contains checks whether the point is inside the region or within its buffer.
+func (rf *regionFilter) contains(pt Point) bool {
+	//cheap rejection of points far away from every polygon
+	clamped := Point{
+		Lat: min(max(pt.Lat, rf.bounds.MinLat), rf.bounds.MaxLat),
+		Lon: min(max(pt.Lon, rf.bounds.MinLon), rf.bounds.MaxLon),
+	}
+	if pt.getDistTo(clamped) > rf.bufferKm {
+		return false
+	}
+	for _, polygon := range rf.polygons {
+		if polygonContains(polygon, pt) {
+			return true
+		}
+	}
+	if rf.bufferKm == 0 {
+		return false
+	}
+	for _, polygon := range rf.polygons {
+		for _, ring := range polygon {
+			if ringDistanceKm(ring, pt) <= rf.bufferKm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// polygonContains checks whether the point is inside the outer ring of the polygon and outside its holes.
+func polygonContains(polygon [][]Point, pt Point) bool {
+	if !ringContains(polygon[0], pt) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, pt) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains checks whether the point is inside the ring (even-odd rule, borders are included or not).
+func ringContains(ring []Point, pt Point) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > pt.Lat) != (b.Lat > pt.Lat) &&
+			pt.Lon < (b.Lon-a.Lon)*(pt.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// ringDistanceKm returns the distance from the point to the closest edge of the ring,
+// using an equirectangular projection around the point (fine for buffers of a few dozen kilometers).
+func ringDistanceKm(ring []Point, pt Point) float64 {
+	lonScale := math.Cos(pt.Lat*math.Pi/180) * kmPerDegree
+	project := func(other Point) (float64, float64) {
+		return (other.Lon - pt.Lon) * lonScale, (other.Lat - pt.Lat) * kmPerDegree
+	}
+	distance := math.Inf(1)
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		ax, ay := project(ring[j])
+		bx, by := project(ring[i])
+		//closest point of the segment to the origin
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if dx != 0 || dy != 0 {
+			t = min(max(-(ax*dx+ay*dy)/(dx*dx+dy*dy), 0), 1)
+		}
+		distance = min(distance, math.Hypot(ax+t*dx, ay+t*dy))
+	}
+	return distance
+}
+
+// the parts of a GeoJSON object we care about
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Features    []geoJSONObject `json:"features"`
+	Geometries  []geoJSONObject `json:"geometries"`
+}
+
+func (g geoJSONObject) polygons() ([][][]Point, error) {
+	var polygons [][][]Point
+	switch g.Type {
+	case "Polygon":
+		var coordinates [][][]float64
+		err := json.Unmarshal(g.Coordinates, &coordinates)
+		if err != nil {
+			return nil, err
+		}
+		polygon, err := geoJSONPolygon(coordinates)
+		if err != nil {
+			return nil, err
+		}
+		return append(polygons, polygon), nil
+	case "MultiPolygon":
+		var coordinates [][][][]float64
+		err := json.Unmarshal(g.Coordinates, &coordinates)
+		if err != nil {
+			return nil, err
+		}
+		for _, polygonCoordinates := range coordinates {
+			polygon, err := geoJSONPolygon(polygonCoordinates)
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, polygon)
+		}
+		return polygons, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, errors.New("feature without geometry")
+		}
+		return g.Geometry.polygons()
+	case "FeatureCollection", "GeometryCollection":
+		for _, child := range append(g.Features, g.Geometries...) {
+			childPolygons, err := child.polygons()
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, childPolygons...)
+		}
+		return polygons, nil
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %q, expected a Polygon or a MultiPolygon", g.Type)
+	}
+}
+
+// geoJSONPolygon converts GeoJSON rings ([lon, lat] positions) to our points.
+func geoJSONPolygon(coordinates [][][]float64) ([][]Point, error) {
+	polygon := make([][]Point, 0, len(coordinates))
+	for _, ringCoordinates := range coordinates {
+		ring := make([]Point, 0, len(ringCoordinates))
+		for _, position := range ringCoordinates {
+			if len(position) < 2 {
+				return nil, fmt.Errorf("invalid position %v", position)
+			}
+			ring = append(ring, Point{Lat: position[1], Lon: position[0]})
+		}
+		polygon = append(polygon, ring)
+	}
+	return polygon, nil
+}
+
+// clipFeed drops the trips without any stop inside the region, along with their stop times,
+// then the stops no kept trip uses (keeping the parent stations of the used stops).
+// Everything is kept if the region is nil. Services are cut by the callers, based on the kept trips.
+func clipFeed(writer *dbWriter, region *Region, trips []Trip, stopTimes []StopTime, stops []Stop) ([]Trip, []StopTime, []Stop, error) {
+	if region == nil {
+		return trips, stopTimes, stops, nil
+	}
+	rf, err := region.compile()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stopsById := make(map[string]*Stop, len(stops))
+	insideStopIds := make(map[string]bool)
+	for i := range stops {
+		stopsById[stops[i].StopId] = &stops[i]
+		if rf.contains(stops[i].GetPoint()) {
+			insideStopIds[stops[i].StopId] = true
+		}
+	}
+	keptTripIds := make(map[string]bool)
+	for _, stopTime := range stopTimes {
+		if insideStopIds[stopTime.StopId] {
+			keptTripIds[stopTime.TripId] = true
+		}
+	}
+
+	keptTrips := make([]Trip, 0, len(keptTripIds))
+	for _, trip := range trips {
+		if keptTripIds[trip.TripId] {
+			keptTrips = append(keptTrips, trip)
+		}
+	}
+	keptStopTimes := make([]StopTime, 0, len(stopTimes))
+	usedStopIds := make(map[string]bool)
+	for _, stopTime := range stopTimes {
+		if !keptTripIds[stopTime.TripId] {
+			continue
+		}
+		keptStopTimes = append(keptStopTimes, stopTime)
+		//keep the stop and its parent stations
+		stopId := stopTime.StopId
+		for !usedStopIds[stopId] {
+			usedStopIds[stopId] = true
+			stop, ok := stopsById[stopId]
+			if !ok || stop.ParentStationId == nil {
+				break
+			}
+			stopId = *stop.ParentStationId
+		}
+	}
+	keptStops := make([]Stop, 0, len(usedStopIds))
+	for _, stop := range stops {
+		if usedStopIds[stop.StopId] {
+			keptStops = append(keptStops, stop)
+		}
+	}
+
+	writer.emitFeedEvent(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseClip,
+		Detail: fmt.Sprintf("kept %d of %d trips and %d of %d stops", len(keptTrips), len(trips), len(keptStops), len(stops))})
+	return keptTrips, keptStopTimes, keptStops, nil
+}
+
+// tripServiceIds returns the IDs of the services the trips run on.
+func tripServiceIds(trips []Trip) map[string]bool {
+	serviceIds := make(map[string]bool)
+	for _, trip := range trips {
+		serviceIds[trip.RefServiceId] = true
+	}
+	return serviceIds
+}
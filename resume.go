@@ -0,0 +1,115 @@
+package trainmapdb
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// every model holding rows of a given feed, dependent rows first
+var feedModels = []any{&StopTime{}, &Trip{}, &ServiceDay{}, &CalendarDate{}, &Calendar{}, &Route{}, &Stop{}, &Agency{}, &Feed{}, &FeedSource{}}
+
+// deleteFeedRows removes every row of the given feed, so that it can be loaded again from scratch.
+// Stations built by MatchStations may group the feed's stops with other feeds' ones: they're removed too,
+// and the other stops they grouped are left without any station until MatchStations runs again.
+func deleteFeedRows(db *gorm.DB, feedId string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		//MySQL can't update a table also read in a subquery, unless the subquery goes through a derived table
+		err := tx.Exec(`UPDATE stops SET station_id = NULL WHERE station_id IN (SELECT station_id FROM (
+			SELECT DISTINCT station_id FROM stops WHERE feed_id = ? AND station_id IS NOT NULL) AS feed_stations)`, feedId).Error
+		if err != nil {
+			return fmt.Errorf("could not unlink stations: %s", err.Error())
+		}
+		err = tx.Exec("DELETE FROM stations WHERE station_id NOT IN (SELECT DISTINCT station_id FROM stops WHERE station_id IS NOT NULL)").Error
+		if err != nil {
+			return fmt.Errorf("could not delete stations: %s", err.Error())
+		}
+		for _, model := range feedModels {
+			err := tx.Where("feed_id = ?", feedId).Delete(model).Error
+			if err != nil {
+				return fmt.Errorf("could not delete from %T: %s", model, err.Error())
+			}
+		}
+		return nil
+	})
+}
+
+// prepareResume removes the feeds the config doesn't load anymore, and the rows of the active feeds to load again:
+// the ones whose load didn't complete or whose source file changed. Feeds whose file couldn't be fetched are kept.
+// It returns the load status of every active feed, from before the removal.
+// Active feeds without any status (never loaded, or loaded before statuses existed) get an empty one, so they're reloaded.
+// It must run before the bulk load starts, since deleting is slow without indexes (and SQLite only has a single writer).
+func (f Fetcher) prepareResume(config LoaderConfig, feedContents map[string]*feedContent) (map[string]FeedSource, error) {
+	activeFeedIds := make(map[string]bool)
+	for feedIdInt, configEntry := range config.Contents {
+		if configEntry.Active {
+			activeFeedIds[fmt.Sprintf("%d", feedIdInt+1)] = true //same IDs as LoadDatabase
+		}
+	}
+
+	var feedSources []FeedSource
+	err := f.db.Find(&feedSources).Error
+	if err != nil {
+		return nil, err
+	}
+	var loadedFeedIds []string
+	err = f.db.Model(&Feed{}).Pluck("feed_id", &loadedFeedIds).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, feedSource := range feedSources {
+		loadedFeedIds = append(loadedFeedIds, feedSource.FeedId)
+	}
+
+	removed := make(map[string]bool)
+	for _, feedId := range loadedFeedIds {
+		if activeFeedIds[feedId] || removed[feedId] {
+			continue
+		}
+		f.emit(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseResume, Detail: feedId})
+		err = deleteFeedRows(f.db, feedId)
+		if err != nil {
+			return nil, err
+		}
+		removed[feedId] = true
+	}
+
+	//the DB is incomplete until this load is done
+	err = f.db.Where("id = ?", databaseInfoId).Delete(&DatabaseInfo{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]FeedSource)
+	for feedId := range activeFeedIds {
+		statuses[feedId] = FeedSource{FeedId: feedId}
+	}
+	for _, feedSource := range feedSources {
+		if activeFeedIds[feedSource.FeedId] {
+			statuses[feedSource.FeedId] = feedSource
+		}
+	}
+
+	for feedIdInt, configEntry := range config.Contents {
+		if !configEntry.Active {
+			continue
+		}
+		feedId := fmt.Sprintf("%d", feedIdInt+1)
+		feed := feedContents[feedId]
+		if feed.err != nil || statuses[feedId].loadedFrom(feed) {
+			continue
+		}
+		//start over from a clean slate, whatever state the previous load left
+		f.emit(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseResume, Detail: feedId})
+		err = deleteFeedRows(f.db, feedId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
+
+// loadedFrom tells whether the feed's load completed from the given raw file, so that it doesn't need to be loaded again.
+func (feedSource FeedSource) loadedFrom(feed *feedContent) bool {
+	return feedSource.Status == FeedStatusComplete && feedSource.SourceHash == feed.sourceHash
+}
@@ -0,0 +1,204 @@
+package trainmapdb
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// A RouteFilter selects the routes of a feed to load, see LoaderConfigEntry.Routes.
+// Bus routes are never loaded, whatever the rules.
+type RouteFilter struct {
+	Include []RouteRule `json:"include"` //if set, only the routes matching at least one of these rules are loaded
+	Exclude []RouteRule `json:"exclude"` //the routes matching any of these rules are never loaded
+}
+
+// A RouteRule matches the routes matching every field it sets.
+type RouteRule struct {
+	Name             string      `json:"name"`               //used in the exclusion summary, defaults to the rule's position
+	AgencyIds        []string    `json:"agency_ids"`         //agency_id of the route
+	RouteIds         []string    `json:"route_ids"`          //route_id of the route
+	ShortNamePattern string      `json:"short_name_pattern"` //regular expression matched against route_short_name, e.g. "^(SEV|EV)"
+	RouteTypes       []RouteType `json:"route_types"`        //route_type, extended types are simplified first (e.g. 101 is rail)
+}
+
+// a compiled RouteRule
+type routeRule struct {
+	name      string
+	agencyIds map[string]bool
+	routeIds  map[string]bool
+	shortName *regexp.Regexp
+	types     []RouteType
+}
+
+// a compiled RouteFilter, nil lets every route through
+type routeFilter struct {
+	include []routeRule
+	exclude []routeRule
+}
+
+func (rule RouteRule) compile(name string) (routeRule, error) {
+	compiled := routeRule{name: name, types: rule.RouteTypes}
+	if rule.Name != "" {
+		compiled.name = rule.Name
+	}
+	if len(rule.AgencyIds) > 0 {
+		compiled.agencyIds = make(map[string]bool)
+		for _, agencyId := range rule.AgencyIds {
+			compiled.agencyIds[agencyId] = true
+		}
+	}
+	if len(rule.RouteIds) > 0 {
+		compiled.routeIds = make(map[string]bool)
+		for _, routeId := range rule.RouteIds {
+			compiled.routeIds[routeId] = true
+		}
+	}
+	if rule.ShortNamePattern != "" {
+		shortName, err := regexp.Compile(rule.ShortNamePattern)
+		if err != nil {
+			return routeRule{}, fmt.Errorf("route rule %s: %s", compiled.name, err.Error())
+		}
+		compiled.shortName = shortName
+	}
+	if compiled.agencyIds == nil && compiled.routeIds == nil && compiled.shortName == nil && len(compiled.types) == 0 {
+		return routeRule{}, fmt.Errorf("route rule %s matches every route", compiled.name)
+	}
+	return compiled, nil
+}
+
+func (rule routeRule) matches(route Route) bool {
+	if rule.agencyIds != nil && !rule.agencyIds[route.AgencyId] {
+		return false
+	}
+	if rule.routeIds != nil && !rule.routeIds[route.RouteId] {
+		return false
+	}
+	if rule.shortName != nil && !rule.shortName.MatchString(route.RouteShortName) {
+		return false
+	}
+	if len(rule.types) > 0 && !slices.Contains(rule.types, route.RouteType) {
+		return false
+	}
+	return true
+}
+
+func (filter *RouteFilter) compile() (*routeFilter, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	if len(filter.Include) == 0 && len(filter.Exclude) == 0 {
+		return nil, errors.New("route filter without any rule")
+	}
+	compiled := &routeFilter{}
+	for i, rule := range filter.Include {
+		compiledRule, err := rule.compile(fmt.Sprintf("include #%d", i+1))
+		if err != nil {
+			return nil, err
+		}
+		compiled.include = append(compiled.include, compiledRule)
+	}
+	for i, rule := range filter.Exclude {
+		compiledRule, err := rule.compile(fmt.Sprintf("exclude #%d", i+1))
+		if err != nil {
+			return nil, err
+		}
+		compiled.exclude = append(compiled.exclude, compiledRule)
+	}
+	return compiled, nil
+}
+
+// excludeReason returns why the route isn't loaded, or an empty string if it is.
+func (rf *routeFilter) excludeReason(route Route) string {
+	if rf == nil {
+		return ""
+	}
+	if len(rf.include) > 0 && !slices.ContainsFunc(rf.include, func(rule routeRule) bool { return rule.matches(route) }) {
+		return "not included"
+	}
+	for _, rule := range rf.exclude {
+		if rule.matches(route) {
+			return rule.name
+		}
+	}
+	return ""
+}
+
+// filterRoutes returns the routes the filter keeps, recording the others in the exclusions.
+func (rf *routeFilter) filterRoutes(routes []Route, exclusions *routeExclusions) []Route {
+	if rf == nil {
+		return routes
+	}
+	keptRoutes := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		reason := rf.excludeReason(route)
+		if reason == "" {
+			keptRoutes = append(keptRoutes, route)
+			continue
+		}
+		exclusions.routeReasons[route.RouteId] = reason
+	}
+	return keptRoutes
+}
+
+// routeExclusions records the routes excluded by a routeFilter and how many trips they had, for the summary.
+type routeExclusions struct {
+	routeReasons map[string]string //route ID -> reason
+	trips        int
+}
+
+func newRouteExclusions() *routeExclusions {
+	return &routeExclusions{routeReasons: make(map[string]string)}
+}
+
+// countTrip records a trip dropped because of its route, if the filter excluded that route.
+func (e *routeExclusions) countTrip(routeId string) {
+	if _, ok := e.routeReasons[routeId]; ok {
+		e.trips++
+	}
+}
+
+// filterTrips drops the trips of the excluded routes, along with their stop times.
+func (e *routeExclusions) filterTrips(trips []Trip, stopTimes []StopTime) ([]Trip, []StopTime) {
+	if len(e.routeReasons) == 0 {
+		return trips, stopTimes
+	}
+	keptTrips := make([]Trip, 0, len(trips))
+	excludedTripIds := make(map[string]bool)
+	for _, trip := range trips {
+		if _, ok := e.routeReasons[trip.RefRouteId]; ok {
+			excludedTripIds[trip.TripId] = true
+			e.trips++
+			continue
+		}
+		keptTrips = append(keptTrips, trip)
+	}
+	keptStopTimes := make([]StopTime, 0, len(stopTimes))
+	for _, stopTime := range stopTimes {
+		if !excludedTripIds[stopTime.TripId] {
+			keptStopTimes = append(keptStopTimes, stopTime)
+		}
+	}
+	return keptTrips, keptStopTimes
+}
+
+// report sends the summary of the exclusions, if there were any.
+func (e *routeExclusions) report(writer *dbWriter) {
+	if len(e.routeReasons) == 0 {
+		return
+	}
+	reasonCounts := make(map[string]int)
+	for _, reason := range e.routeReasons {
+		reasonCounts[reason]++
+	}
+	reasons := make([]string, 0, len(reasonCounts))
+	for reason, count := range reasonCounts {
+		reasons = append(reasons, fmt.Sprintf("%s: %d", reason, count))
+	}
+	sort.Strings(reasons)
+	writer.emitFeedEvent(LoadEvent{Type: LoadEventRoutesExcluded, Rows: int64(e.trips),
+		Detail: fmt.Sprintf("excluded %d routes and %d trips (%s)", len(e.routeReasons), e.trips, strings.Join(reasons, ", "))})
+}
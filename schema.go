@@ -0,0 +1,215 @@
+package trainmapdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// SchemaVersion is the version of the DB layout written by this version of the library.
+// Bump it with every breaking change of the models, and add the matching step to schemaMigrations.
+const SchemaVersion = 3
+
+// legacySchemaVersion is the version of the DBs built before schema versioning (no metadata table).
+const legacySchemaVersion = 1
+
+// ErrSchemaOutdated is returned when opening a DB built with an older schema, see FetcherConfig.MigrateSchema.
+var ErrSchemaOutdated = errors.New("database schema is outdated")
+
+// ErrSchemaTooRecent is returned when opening a DB built by a newer version of the library.
+var ErrSchemaTooRecent = errors.New("database schema is more recent than this library")
+
+// A DatabaseInfo records how and when a DB was built, it's stored as a single row.
+type DatabaseInfo struct {
+	Id             uint      `gorm:"primaryKey" json:"-"`
+	SchemaVersion  int       `json:"schema_version"`
+	LibraryVersion string    `json:"library_version"` //version that built or last migrated the DB
+	BuiltAt        time.Time `json:"built_at"`
+	MigratedAt     time.Time `json:"migrated_at"` //zero if never migrated
+}
+
+func (DatabaseInfo) TableName() string {
+	return "trainmap_metadata"
+}
+
+const databaseInfoId = 1
+
+// A FeedSource records which source file a feed was loaded from, and whether that load completed.
+type FeedSource struct {
+	FeedId      string     `gorm:"primaryKey;size:191" json:"feed_id"`
+	DisplayName string     `json:"display_name"`
+	SourceHash  string     `json:"source_hash"` //hex SHA-256 of the raw feed file
+	LoadedAt    time.Time  `json:"loaded_at"`
+	Status      FeedStatus `gorm:"size:16" json:"status"`
+	Error       string     `json:"error"` //why the load failed, if it did
+}
+
+// A FeedStatus is the state of a feed's load, see LoaderConfig.Resume.
+type FeedStatus string
+
+const (
+	FeedStatusLoading  FeedStatus = "loading" //also the status of feeds whose load crashed
+	FeedStatusComplete FeedStatus = "complete"
+	FeedStatusFailed   FeedStatus = "failed"
+)
+
+func hashFeedContent(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// libraryVersion returns the version of this module as recorded in the binary's build info.
+func libraryVersion() string {
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if buildInfo.Main.Path == "github.com/rom-vtn/trainmap-db" {
+		return buildInfo.Main.Version
+	}
+	for _, dep := range buildInfo.Deps {
+		if dep.Path == "github.com/rom-vtn/trainmap-db" {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// a schemaMigration upgrades a DB from the previous version to the given one, in place.
+type schemaMigration struct {
+	version     int
+	description string
+	migrate     func(f Fetcher) error
+}
+
+// every migration step, in version order
+var schemaMigrations = []schemaMigration{
+	{
+		version:     2,
+		description: "sized key columns, station IDs and trip segment spatial index",
+		migrate: func(f Fetcher) error {
+			//AutoMigrate adds the missing columns and indexes and resizes the key columns
+			err := migrate(f.db, false)
+			if err != nil {
+				return err
+			}
+			err = f.db.Exec(tripBoundsSQL(f.db.Dialector.Name())).Error
+			if err != nil {
+				return err
+			}
+			return f.BuildSpatialIndex()
+		},
+	},
+	{
+		version:     3,
+		description: "feed load status",
+		migrate: func(f Fetcher) error {
+			err := f.db.AutoMigrate(&FeedSource{})
+			if err != nil {
+				return err
+			}
+			//feeds of a DB that opened fine were fully loaded
+			return f.db.Model(&FeedSource{}).Where("1 = 1").Update("status", FeedStatusComplete).Error
+		},
+	},
+}
+
+// DatabaseInfo returns the metadata of the DB. DBs built before schema versioning get a legacy version and a zero BuiltAt.
+// It returns ErrIncompleteDatabase if the DB's load didn't complete.
+func (f Fetcher) DatabaseInfo() (DatabaseInfo, error) {
+	if f.db == nil {
+		return DatabaseInfo{}, ErrNoDatabase
+	}
+	if !f.db.Migrator().HasTable(&DatabaseInfo{}) {
+		return DatabaseInfo{SchemaVersion: legacySchemaVersion}, nil
+	}
+	var infos []DatabaseInfo
+	err := f.db.Where("id = ?", databaseInfoId).Limit(1).Find(&infos).Error
+	if err != nil {
+		return DatabaseInfo{}, err
+	}
+	if len(infos) == 0 {
+		//the table is created when the load starts, and the row written once it's done
+		return DatabaseInfo{}, ErrIncompleteDatabase
+	}
+	return infos[0], nil
+}
+
+// GetFeedSources returns the source file info of every loaded feed.
+func (f Fetcher) GetFeedSources() ([]FeedSource, error) {
+	if f.db == nil {
+		return nil, ErrNoDatabase
+	}
+	var feedSources []FeedSource
+	err := f.db.Order("feed_id").Find(&feedSources).Error
+	return feedSources, err
+}
+
+// writeDatabaseInfo records that the DB was just built with the current schema.
+func (f Fetcher) writeDatabaseInfo() error {
+	info := DatabaseInfo{Id: databaseInfoId, SchemaVersion: SchemaVersion, LibraryVersion: libraryVersion(), BuiltAt: time.Now()}
+	return f.db.Save(&info).Error
+}
+
+// checkSchema makes sure the DB can be used by this version of the library, migrating it if allowed.
+// Empty DBs are always fine, LoadDatabase creates the schema.
+func (f Fetcher) checkSchema() error {
+	if !f.db.Migrator().HasTable(&Trip{}) {
+		return nil
+	}
+	info, err := f.DatabaseInfo()
+	if errors.Is(err, ErrIncompleteDatabase) && f.Config.AllowIncompleteDatabase {
+		return nil //resuming the load migrates the schema
+	}
+	if err != nil {
+		return err
+	}
+	if info.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("%w (version %d, expected at most %d, built by %s)", ErrSchemaTooRecent, info.SchemaVersion, SchemaVersion, info.LibraryVersion)
+	}
+	if info.SchemaVersion == SchemaVersion {
+		return nil
+	}
+	if !f.Config.MigrateSchema {
+		return fmt.Errorf("%w (version %d, expected %d), set MigrateSchema in the FetcherConfig to upgrade it in place, or rebuild it", ErrSchemaOutdated, info.SchemaVersion, SchemaVersion)
+	}
+	return f.migrateSchema()
+}
+
+// migrateSchema upgrades the DB to the current SchemaVersion in place, running every missing migration step.
+// This may take a while on big DBs, as some steps rebuild indexes.
+func (f Fetcher) migrateSchema() error {
+	info, err := f.DatabaseInfo()
+	if err != nil {
+		return err
+	}
+	if info.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("%w (version %d, expected at most %d)", ErrSchemaTooRecent, info.SchemaVersion, SchemaVersion)
+	}
+	err = f.db.AutoMigrate(&DatabaseInfo{}, &FeedSource{})
+	if err != nil {
+		return err
+	}
+	for _, step := range schemaMigrations {
+		if step.version <= info.SchemaVersion {
+			continue
+		}
+		f.emit(LoadEvent{Type: LoadEventPhase, Phase: LoadPhaseSchemaMigration, Detail: fmt.Sprintf("version %d: %s", step.version, step.description)})
+		err = step.migrate(f)
+		if err != nil {
+			return fmt.Errorf("error when migrating schema to version %d: %s", step.version, err.Error())
+		}
+		info.SchemaVersion = step.version
+		info.Id = databaseInfoId
+		info.MigratedAt = time.Now()
+		info.LibraryVersion = libraryVersion()
+		err = f.db.Save(&info).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package trainmapdb
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// siriRoot represents the parts of a SIRI document we care about.
+// NOTE: tags are matched without namespaces, so both "siri:" prefixed and plain documents are accepted.
+type siriRoot struct {
+	XMLName         xml.Name `xml:"Siri"`
+	ServiceDelivery struct {
+		EstimatedTimetableDeliveries []struct {
+			Frames []struct {
+				Journeys []siriEstimatedVehicleJourney `xml:"EstimatedVehicleJourney"`
+			} `xml:"EstimatedJourneyVersionFrame"`
+		} `xml:"EstimatedTimetableDelivery"`
+		VehicleMonitoringDeliveries []struct {
+			Activities []struct {
+				RecordedAtTime string                      `xml:"RecordedAtTime"`
+				Journey        siriMonitoredVehicleJourney `xml:"MonitoredVehicleJourney"`
+			} `xml:"VehicleActivity"`
+		} `xml:"VehicleMonitoringDelivery"`
+	} `xml:"ServiceDelivery"`
+}
+
+type siriFramedVehicleJourneyRef struct {
+	DataFrameRef           string `xml:"DataFrameRef"`
+	DatedVehicleJourneyRef string `xml:"DatedVehicleJourneyRef"`
+}
+
+type siriCall struct {
+	StopPointRef          string `xml:"StopPointRef"`
+	Order                 uint   `xml:"Order"`
+	Cancellation          bool   `xml:"Cancellation"`
+	AimedArrivalTime      string `xml:"AimedArrivalTime"`
+	ExpectedArrivalTime   string `xml:"ExpectedArrivalTime"`
+	ActualArrivalTime     string `xml:"ActualArrivalTime"`
+	AimedDepartureTime    string `xml:"AimedDepartureTime"`
+	ExpectedDepartureTime string `xml:"ExpectedDepartureTime"`
+	ActualDepartureTime   string `xml:"ActualDepartureTime"`
+}
+
+type siriEstimatedVehicleJourney struct {
+	LineRef                 string                      `xml:"LineRef"`
+	DatedVehicleJourneyRef  string                      `xml:"DatedVehicleJourneyRef"`
+	FramedVehicleJourneyRef siriFramedVehicleJourneyRef `xml:"FramedVehicleJourneyRef"`
+	Cancellation            bool                        `xml:"Cancellation"`
+	RecordedCalls           []siriCall                  `xml:"RecordedCalls>RecordedCall"`
+	EstimatedCalls          []siriCall                  `xml:"EstimatedCalls>EstimatedCall"`
+}
+
+type siriMonitoredVehicleJourney struct {
+	LineRef                  string                      `xml:"LineRef"`
+	FramedVehicleJourneyRef  siriFramedVehicleJourneyRef `xml:"FramedVehicleJourneyRef"`
+	VehicleJourneyRef        string                      `xml:"VehicleJourneyRef"`
+	Delay                    string                      `xml:"Delay"` //xs:duration, e.g. PT2M30S
+	OriginAimedDepartureTime string                      `xml:"OriginAimedDepartureTime"`
+	MonitoredCall            *siriCall                   `xml:"MonitoredCall"`
+}
+
+// A SiriMatchRule describes how SIRI references are mapped onto the trips and routes loaded in the DB.
+// Patterns are regular expressions, templates are expanded using their capture groups (e.g. "$1").
+type SiriMatchRule struct {
+	FeedId             string `json:"feed_id"`
+	LineRefPattern     string `json:"line_ref_pattern"`      //empty matches every line
+	RouteIdTemplate    string `json:"route_id_template"`     //empty = do not restrict on the route
+	JourneyRefPattern  string `json:"journey_ref_pattern"`   //empty = "^(.*)$"
+	TripIdTemplate     string `json:"trip_id_template"`      //empty = "$1"
+	MatchTripShortName bool   `json:"match_trip_short_name"` //match the expanded journey ref against trip_short_name instead of trip_id
+	StopRefPattern     string `json:"stop_ref_pattern"`      //empty = "^(.*)$"
+	StopIdTemplate     string `json:"stop_id_template"`      //empty = "$1"
+}
+
+type compiledSiriMatchRule struct {
+	SiriMatchRule
+	lineRef    *regexp.Regexp
+	journeyRef *regexp.Regexp
+	stopRef    *regexp.Regexp
+}
+
+func compileOrDefault(pattern string, defaultPattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		pattern = defaultPattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func expandTemplate(re *regexp.Regexp, template string, input string) (string, bool) {
+	match := re.FindStringSubmatchIndex(input)
+	if match == nil {
+		return "", false
+	}
+	if template == "" {
+		template = "$1"
+	}
+	return string(re.ExpandString(nil, template, input, match)), true
+}
+
+// A SiriConsumer maps SIRI-ET and SIRI-VM deliveries onto trips and stores the result as adjustments in the Fetcher's RealtimeState.
+// It is safe for concurrent use.
+type SiriConsumer struct {
+	fetcher         *Fetcher
+	rules           []compiledSiriMatchRule
+	tripPoolMutex   sync.Mutex
+	tripPool        map[string][]FeededTrip //cache of already resolved refs, misses aren't cached since their trips may come with the next load
+	tripPoolVersion int64                   //network version the cached trips were resolved against, see Fetcher.networkVersion
+	findTrips       func(rule compiledSiriMatchRule, routeId string, tripRef string, date time.Time) ([]FeededTrip, error)
+}
+
+// A SiriConsumeResult summarizes what was done with a SIRI delivery.
+type SiriConsumeResult struct {
+	Journeys     int      `json:"journeys"`
+	Matched      int      `json:"matched"`
+	Cancelled    int      `json:"cancelled"`
+	UnmatchedRef []string `json:"unmatched_refs"`
+}
+
+func NewSiriConsumer(fetcher *Fetcher, rules []SiriMatchRule) (*SiriConsumer, error) {
+	if fetcher.Realtime == nil {
+		fetcher.Realtime = NewRealtimeState()
+	}
+	compiledRules := make([]compiledSiriMatchRule, 0, len(rules))
+	for i, rule := range rules {
+		var compiled compiledSiriMatchRule
+		var err error
+		compiled.SiriMatchRule = rule
+		compiled.lineRef, err = compileOrDefault(rule.LineRefPattern, "^(.*)$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid line ref pattern: %s", i, err.Error())
+		}
+		compiled.journeyRef, err = compileOrDefault(rule.JourneyRefPattern, "^(.*)$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid journey ref pattern: %s", i, err.Error())
+		}
+		compiled.stopRef, err = compileOrDefault(rule.StopRefPattern, "^(.*)$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid stop ref pattern: %s", i, err.Error())
+		}
+		compiledRules = append(compiledRules, compiled)
+	}
+	sc := &SiriConsumer{fetcher: fetcher, rules: compiledRules, tripPool: make(map[string][]FeededTrip), tripPoolVersion: fetcher.networkVersion()}
+	sc.findTrips = sc.queryTrips
+	return sc, nil
+}
+
+// ConsumeFile reads a recorded SIRI document (ET and/or VM) from disk.
+func (sc *SiriConsumer) ConsumeFile(path string) (SiriConsumeResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return SiriConsumeResult{}, err
+	}
+	defer file.Close()
+	return sc.Consume(file)
+}
+
+// Consume reads a SIRI document and applies every EstimatedVehicleJourney and VehicleActivity it contains.
+func (sc *SiriConsumer) Consume(r io.Reader) (SiriConsumeResult, error) {
+	var root siriRoot
+	err := xml.NewDecoder(r).Decode(&root)
+	if err != nil {
+		return SiriConsumeResult{}, fmt.Errorf("could not decode SIRI document: %s", err.Error())
+	}
+	var result SiriConsumeResult
+	for _, delivery := range root.ServiceDelivery.EstimatedTimetableDeliveries {
+		for _, frame := range delivery.Frames {
+			for _, journey := range frame.Journeys {
+				err = sc.consumeEstimatedJourney(journey, &result)
+				if err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+	for _, delivery := range root.ServiceDelivery.VehicleMonitoringDeliveries {
+		for _, activity := range delivery.Activities {
+			err = sc.consumeMonitoredJourney(activity.Journey, &result)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (sc *SiriConsumer) consumeEstimatedJourney(journey siriEstimatedVehicleJourney, result *SiriConsumeResult) error {
+	result.Journeys++
+	journeyRef := journey.FramedVehicleJourneyRef.DatedVehicleJourneyRef
+	if journeyRef == "" {
+		journeyRef = journey.DatedVehicleJourneyRef
+	}
+	calls := append(append([]siriCall{}, journey.RecordedCalls...), journey.EstimatedCalls...)
+	date, err := siriServiceDate(journey.FramedVehicleJourneyRef.DataFrameRef, calls)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range sc.rules {
+		feededTrips, err := sc.resolveTrips(rule, journey.LineRef, journeyRef, date)
+		if err != nil {
+			return err
+		}
+		if len(feededTrips) == 0 {
+			continue
+		}
+		adjustment := TripAdjustment{
+			Date:           date,
+			Cancelled:      journey.Cancellation,
+			StopDelays:     make(map[string]time.Duration),
+			CancelledStops: make(map[string]bool),
+			UpdatedAt:      time.Now(),
+		}
+		hasTripDelay := false
+		servedCalls := 0
+		for i, call := range calls {
+			stopId, hasStopId := expandTemplate(rule.stopRef, rule.StopIdTemplate, call.StopPointRef)
+			if call.Cancellation {
+				//partial cancellation, the whole trip is only cancelled if every call is
+				if hasStopId {
+					adjustment.CancelledStops[stopId] = true
+				}
+				continue
+			}
+			servedCalls++
+			delay, hasDelay, err := call.getDelay()
+			if err != nil {
+				return err
+			}
+			if !hasDelay {
+				continue
+			}
+			//the trip delay is the one of the latest recorded call, or of the next estimated one if the trip didn't start yet
+			if i < len(journey.RecordedCalls) || !hasTripDelay {
+				adjustment.Delay = delay
+				hasTripDelay = true
+			}
+			if hasStopId {
+				adjustment.StopDelays[stopId] = delay
+			}
+		}
+		if len(calls) > 0 && servedCalls == 0 {
+			adjustment.Cancelled = true
+		}
+		sc.storeAdjustments(feededTrips, adjustment, result)
+		return nil
+	}
+	result.UnmatchedRef = append(result.UnmatchedRef, journeyRef)
+	return nil
+}
+
+func (sc *SiriConsumer) consumeMonitoredJourney(journey siriMonitoredVehicleJourney, result *SiriConsumeResult) error {
+	result.Journeys++
+	journeyRef := journey.FramedVehicleJourneyRef.DatedVehicleJourneyRef
+	if journeyRef == "" {
+		journeyRef = journey.VehicleJourneyRef
+	}
+	var calls []siriCall
+	if journey.MonitoredCall != nil {
+		calls = append(calls, *journey.MonitoredCall)
+	}
+	if journey.OriginAimedDepartureTime != "" {
+		calls = append(calls, siriCall{AimedDepartureTime: journey.OriginAimedDepartureTime})
+	}
+	date, err := siriServiceDate(journey.FramedVehicleJourneyRef.DataFrameRef, calls)
+	if err != nil {
+		return err
+	}
+	//without any Delay, the activity tells nothing about the schedule (not even that the trip is on time)
+	hasDelay := strings.TrimSpace(journey.Delay) != ""
+	delay, err := parseXsdDuration(journey.Delay)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range sc.rules {
+		feededTrips, err := sc.resolveTrips(rule, journey.LineRef, journeyRef, date)
+		if err != nil {
+			return err
+		}
+		if len(feededTrips) == 0 {
+			continue
+		}
+		result.Matched++
+		if !hasDelay {
+			return nil
+		}
+		for _, feededTrip := range feededTrips {
+			//only the trip delay is known, keep what an ET delivery said about cancellations and stops
+			sc.fetcher.Realtime.UpdateAdjustment(feededTrip.FeedId, feededTrip.TripId, date, func(adjustment *TripAdjustment) {
+				adjustment.Delay = delay
+				adjustment.UpdatedAt = time.Now()
+			})
+		}
+		return nil
+	}
+	result.UnmatchedRef = append(result.UnmatchedRef, journeyRef)
+	return nil
+}
+
+func (sc *SiriConsumer) storeAdjustments(feededTrips []FeededTrip, adjustment TripAdjustment, result *SiriConsumeResult) {
+	for _, feededTrip := range feededTrips {
+		adjustment.FeedId = feededTrip.FeedId
+		adjustment.TripId = feededTrip.TripId
+		sc.fetcher.Realtime.SetAdjustment(adjustment)
+	}
+	result.Matched++
+	if adjustment.Cancelled {
+		result.Cancelled++
+	}
+}
+
+// resolveTrips returns the trips matching the given refs according to the rule (or none if the rule doesn't apply).
+func (sc *SiriConsumer) resolveTrips(rule compiledSiriMatchRule, lineRef string, journeyRef string, date time.Time) ([]FeededTrip, error) {
+	if !rule.lineRef.MatchString(lineRef) {
+		return nil, nil
+	}
+	tripRef, ok := expandTemplate(rule.journeyRef, rule.TripIdTemplate, journeyRef)
+	if !ok {
+		return nil, nil
+	}
+	routeId := ""
+	if rule.RouteIdTemplate != "" {
+		routeId, _ = expandTemplate(rule.lineRef, rule.RouteIdTemplate, lineRef)
+	}
+
+	cacheKey := strings.Join([]string{rule.FeedId, routeId, tripRef, date.Format(time.DateOnly), strconv.FormatBool(rule.MatchTripShortName)}, "\x00")
+	version := sc.fetcher.networkVersion()
+	sc.tripPoolMutex.Lock()
+	if sc.tripPoolVersion != version {
+		//the network changed since the refs were resolved
+		sc.tripPool = make(map[string][]FeededTrip)
+		sc.tripPoolVersion = version
+	}
+	feededTrips, ok := sc.tripPool[cacheKey]
+	sc.tripPoolMutex.Unlock()
+	if ok {
+		return feededTrips, nil
+	}
+
+	feededTrips, err := sc.findTrips(rule, routeId, tripRef, date)
+	if err != nil {
+		return nil, err
+	}
+	if len(feededTrips) > 0 {
+		sc.tripPoolMutex.Lock()
+		if sc.tripPoolVersion == version {
+			sc.tripPool[cacheKey] = feededTrips
+		}
+		sc.tripPoolMutex.Unlock()
+	}
+	return feededTrips, nil
+}
+
+// queryTrips looks the trips matching the expanded refs up in the DB.
+func (sc *SiriConsumer) queryTrips(rule compiledSiriMatchRule, routeId string, tripRef string, date time.Time) ([]FeededTrip, error) {
+	if sc.fetcher.db == nil {
+		return nil, ErrNoDatabase
+	}
+	query := sc.fetcher.db.Model(&Trip{}).Where("trips.feed_id = ?", rule.FeedId)
+	if rule.MatchTripShortName {
+		//several trips may share a train number, only keep the ones running on that date
+		query = query.Where("trips.trip_short_name = ?", tripRef).
+			Joins("JOIN service_days sd ON sd.feed_id = trips.feed_id AND sd.service_id = trips.ref_service_id").
+			Where("sd.date = ?", date)
+	} else {
+		query = query.Where("trips.trip_id = ?", tripRef)
+	}
+	if routeId != "" {
+		query = query.Where("trips.ref_route_id = ?", routeId)
+	}
+	var trips []Trip
+	err := query.Select("trips.feed_id", "trips.trip_id").Find(&trips).Error
+	if err != nil {
+		return nil, err
+	}
+	feededTrips := make([]FeededTrip, 0, len(trips))
+	for _, trip := range trips {
+		feededTrips = append(feededTrips, FeededTrip{FeedId: trip.FeedId, TripId: trip.TripId})
+	}
+	return feededTrips, nil
+}
+
+// getDelay returns the difference between expected (or actual) and aimed times of the call.
+func (call siriCall) getDelay() (time.Duration, bool, error) {
+	pairs := [][2]string{
+		{call.AimedDepartureTime, firstNonEmpty(call.ActualDepartureTime, call.ExpectedDepartureTime)},
+		{call.AimedArrivalTime, firstNonEmpty(call.ActualArrivalTime, call.ExpectedArrivalTime)},
+	}
+	for _, pair := range pairs {
+		if pair[0] == "" || pair[1] == "" {
+			continue
+		}
+		aimed, err := time.Parse(time.RFC3339, pair[0])
+		if err != nil {
+			return 0, false, err
+		}
+		expected, err := time.Parse(time.RFC3339, pair[1])
+		if err != nil {
+			return 0, false, err
+		}
+		return expected.Sub(aimed), true, nil
+	}
+	return 0, false, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// siriServiceDate returns the service date as stored in ServiceDay, using DataFrameRef if possible
+// and falling back on the first aimed time of the journey.
+func siriServiceDate(dataFrameRef string, calls []siriCall) (time.Time, error) {
+	if dataFrameRef != "" {
+		date, err := time.Parse(time.DateOnly, dataFrameRef)
+		if err == nil {
+			return date, nil
+		}
+	}
+	for _, call := range calls {
+		aimed := firstNonEmpty(call.AimedDepartureTime, call.AimedArrivalTime)
+		if aimed == "" {
+			continue
+		}
+		aimedTime, err := time.Parse(time.RFC3339, aimed)
+		if err != nil {
+			return time.Time{}, err
+		}
+		//keep the local date, not the UTC one
+		return time.Parse(time.DateOnly, aimedTime.Format(time.DateOnly))
+	}
+	return time.Time{}, fmt.Errorf("could not determine service date (no DataFrameRef and no aimed times)")
+}
+
+// parseXsdDuration parses the subset of xs:duration used by SIRI (e.g. "PT1M30S", "-PT45S").
+// An empty string is parsed as a zero duration.
+func parseXsdDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+		value = value[1:]
+	}
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid xs:duration %s", value)
+	}
+	value = value[1:]
+	var total time.Duration
+	inTime := false
+	number := ""
+	for _, char := range value {
+		switch {
+		case char == 'T':
+			inTime = true
+		case (char >= '0' && char <= '9') || char == '.':
+			number += string(char)
+		default:
+			amount, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid xs:duration %s", value)
+			}
+			var unit time.Duration
+			switch {
+			case char == 'D' && !inTime:
+				unit = 24 * time.Hour
+			case char == 'H' && inTime:
+				unit = time.Hour
+			case char == 'M' && inTime:
+				unit = time.Minute
+			case char == 'S' && inTime:
+				unit = time.Second
+			default:
+				return 0, fmt.Errorf("unsupported xs:duration component %c in %s", char, value)
+			}
+			total += time.Duration(amount * float64(unit))
+			number = ""
+		}
+	}
+	return sign * total, nil
+}
@@ -0,0 +1,230 @@
+package trainmapdb
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestSiriConsumer returns a consumer resolving the TER journeys of the fixtures to the trips of feed 1,
+// without any DB: the trips are named after the train number and the service date.
+func newTestSiriConsumer(t *testing.T) (*SiriConsumer, *Fetcher) {
+	t.Helper()
+	fetcher := &Fetcher{}
+	sc, err := NewSiriConsumer(fetcher, []SiriMatchRule{{
+		FeedId:            "1",
+		LineRefPattern:    `^SNCF:Line::C01742:$`,
+		JourneyRefPattern: `^SNCF:ServiceJourney::TER(\d+):LOC$`,
+		StopRefPattern:    `^StopPoint:OCE(\d+)$`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.findTrips = func(rule compiledSiriMatchRule, routeId string, tripRef string, date time.Time) ([]FeededTrip, error) {
+		return []FeededTrip{{FeedId: rule.FeedId, TripId: tripRef + "-" + date.Format(time.DateOnly)}}, nil
+	}
+	return sc, fetcher
+}
+
+func serviceDate(t *testing.T, value string) time.Time {
+	t.Helper()
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return date
+}
+
+func TestSiriEstimatedTimetable(t *testing.T) {
+	sc, fetcher := newTestSiriConsumer(t)
+	result, err := sc.ConsumeFile("testdata/siri_et.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Journeys != 4 || result.Matched != 3 || result.Cancelled != 1 {
+		t.Errorf("got %d journeys, %d matched and %d cancelled, expected 4, 3 and 1", result.Journeys, result.Matched, result.Cancelled)
+	}
+	if len(result.UnmatchedRef) != 1 || result.UnmatchedRef[0] != "SNCF:ServiceJourney::TER999999:LOC" {
+		t.Errorf("unexpected unmatched refs %v", result.UnmatchedRef)
+	}
+	if len(fetcher.Realtime.GetAdjustments()) != 3 {
+		t.Errorf("got %d adjustments, expected 3", len(fetcher.Realtime.GetAdjustments()))
+	}
+
+	//dates read back from the DB may not be in UTC
+	localDate := serviceDate(t, "2024-05-14").In(time.FixedZone("UTC-4", -4*3600))
+
+	running, ok := fetcher.Realtime.GetAdjustment("1", "847012-2024-05-14", localDate)
+	if !ok {
+		t.Fatal("no adjustment for the running trip")
+	}
+	if running.Delay != 5*time.Minute {
+		t.Errorf("got a %s trip delay, expected the one of the latest recorded call (5m0s)", running.Delay)
+	}
+	expectedStopDelays := map[string]time.Duration{
+		"87581009": 2 * time.Minute,
+		"87583005": 5 * time.Minute,
+		"87584003": 4 * time.Minute,
+		"87584052": 3 * time.Minute,
+	}
+	for stopId, expected := range expectedStopDelays {
+		if running.StopDelays[stopId] != expected {
+			t.Errorf("got a %s delay at %s, expected %s", running.StopDelays[stopId], stopId, expected)
+		}
+	}
+	if running.Cancelled || len(running.CancelledStops) != 0 {
+		t.Errorf("the running trip shouldn't be cancelled")
+	}
+
+	partial, ok := fetcher.Realtime.GetAdjustment("1", "847016-2024-05-14", localDate)
+	if !ok {
+		t.Fatal("no adjustment for the partially cancelled trip")
+	}
+	if partial.Delay != time.Minute {
+		t.Errorf("got a %s trip delay, expected the one of the next call (1m0s)", partial.Delay)
+	}
+	if partial.Cancelled || !partial.CancelledStops["87584003"] || !partial.CancelledStops["87584052"] || len(partial.CancelledStops) != 2 {
+		t.Errorf("unexpected cancellation of the partially cancelled trip: %t, %v", partial.Cancelled, partial.CancelledStops)
+	}
+	stopTimes := []StopTime{{StopId: "87581009", StopSequence: 1}, {StopId: "87583005", StopSequence: 2}, {StopId: "87584003", StopSequence: 3}, {StopId: "87584052", StopSequence: 4}}
+	if !partial.runsBetween(stopTimes, stopTimes[0], stopTimes[1]) || partial.runsBetween(stopTimes, stopTimes[1], stopTimes[2]) {
+		t.Errorf("the partially cancelled trip should only run between its first two stops")
+	}
+
+	cancelled, ok := fetcher.Realtime.GetAdjustment("1", "847020-2024-05-15", serviceDate(t, "2024-05-15"))
+	if !ok || !cancelled.Cancelled {
+		t.Errorf("the cancelled trip should have a cancelled adjustment")
+	}
+}
+
+func TestSiriVehicleMonitoring(t *testing.T) {
+	sc, fetcher := newTestSiriConsumer(t)
+	result, err := sc.ConsumeFile("testdata/siri_vm.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Journeys != 2 || result.Matched != 2 || result.Cancelled != 0 {
+		t.Errorf("got %d journeys, %d matched and %d cancelled, expected 2, 2 and 0", result.Journeys, result.Matched, result.Cancelled)
+	}
+
+	//the DataFrameRef gives the service date, even after midnight
+	lateTrain, ok := fetcher.Realtime.GetAdjustment("1", "847090-2024-05-14", serviceDate(t, "2024-05-14"))
+	if !ok {
+		t.Fatal("no adjustment for the late evening trip")
+	}
+	if lateTrain.Delay != 2*time.Minute+30*time.Second {
+		t.Errorf("got a %s delay, expected 2m30s", lateTrain.Delay)
+	}
+
+	//without DataFrameRef, the local date of the origin departure is used
+	earlyTrain, ok := fetcher.Realtime.GetAdjustment("1", "847024-2024-05-15", serviceDate(t, "2024-05-15"))
+	if !ok {
+		t.Fatal("no adjustment for the early trip")
+	}
+	if earlyTrain.Delay != -45*time.Second {
+		t.Errorf("got a %s delay, expected -45s", earlyTrain.Delay)
+	}
+
+	fetcher.Realtime.PruneBefore(serviceDate(t, "2024-05-15"))
+	if len(fetcher.Realtime.GetAdjustments()) != 1 {
+		t.Errorf("got %d adjustments after pruning, expected 1", len(fetcher.Realtime.GetAdjustments()))
+	}
+}
+
+func TestSiriVehicleMonitoringKeepsEstimatedTimetable(t *testing.T) {
+	sc, fetcher := newTestSiriConsumer(t)
+	_, err := sc.ConsumeFile("testdata/siri_et.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := sc.ConsumeFile("testdata/siri_vm_daytime.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Journeys != 2 || result.Matched != 2 {
+		t.Errorf("got %d journeys and %d matched, expected 2 and 2", result.Journeys, result.Matched)
+	}
+	date := serviceDate(t, "2024-05-14")
+
+	running, ok := fetcher.Realtime.GetAdjustment("1", "847012-2024-05-14", date)
+	if !ok {
+		t.Fatal("no adjustment for the running trip")
+	}
+	if running.Delay != 6*time.Minute {
+		t.Errorf("got a %s trip delay, expected the VM one (6m0s)", running.Delay)
+	}
+	if len(running.StopDelays) != 4 || running.StopDelays["87584003"] != 4*time.Minute {
+		t.Errorf("the ET stop delays should be kept, got %v", running.StopDelays)
+	}
+
+	partial, ok := fetcher.Realtime.GetAdjustment("1", "847016-2024-05-14", date)
+	if !ok {
+		t.Fatal("no adjustment for the partially cancelled trip")
+	}
+	if partial.Delay != time.Minute {
+		t.Errorf("got a %s trip delay, a VM activity without delay shouldn't change the ET one (1m0s)", partial.Delay)
+	}
+	if len(partial.CancelledStops) != 2 {
+		t.Errorf("the ET cancelled stops should be kept, got %v", partial.CancelledStops)
+	}
+}
+
+func TestSiriQueryTrips(t *testing.T) {
+	fetcher := newTestFetcher(t)
+	insertTestRows(t, fetcher,
+		Trip{FeedId: "1", TripId: "847012", RefServiceId: "tuesday", TripShortName: "847012"},
+		Trip{FeedId: "1", TripId: "847012-wednesday", RefServiceId: "wednesday", TripShortName: "847012"},
+		Trip{FeedId: "2", TripId: "847012", RefServiceId: "tuesday", TripShortName: "847012"},
+	)
+	insertTestRows(t, fetcher,
+		ServiceDay{FeedId: "1", ServiceId: "tuesday", Date: serviceDate(t, "2024-05-14")},
+		ServiceDay{FeedId: "1", ServiceId: "wednesday", Date: serviceDate(t, "2024-05-15")},
+	)
+
+	for _, matchShortName := range []bool{false, true} {
+		sc, err := NewSiriConsumer(fetcher, []SiriMatchRule{{
+			FeedId:             "1",
+			JourneyRefPattern:  `^SNCF:ServiceJourney::TER(\d+):LOC$`,
+			MatchTripShortName: matchShortName,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		trips, err := sc.resolveTrips(sc.rules[0], "", "SNCF:ServiceJourney::TER847012:LOC", serviceDate(t, "2024-05-14"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trips) != 1 || trips[0] != (FeededTrip{FeedId: "1", TripId: "847012"}) {
+			t.Errorf("got trips %v matching short names: %t, expected the tuesday trip of feed 1", trips, matchShortName)
+		}
+	}
+
+	sc, err := NewSiriConsumer(fetcher, []SiriMatchRule{{FeedId: "1", JourneyRefPattern: `^SNCF:ServiceJourney::TER(\d+):LOC$`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trips, err := sc.resolveTrips(sc.rules[0], "", "SNCF:ServiceJourney::TER847016:LOC", serviceDate(t, "2024-05-14"))
+	if err != nil || len(trips) != 0 {
+		t.Fatalf("got trips %v and error %v for a trip not in the DB", trips, err)
+	}
+	//misses aren't cached, the trip is found once loaded
+	insertTestRows(t, fetcher, Trip{FeedId: "1", TripId: "847016", RefServiceId: "tuesday"})
+	trips, err = sc.resolveTrips(sc.rules[0], "", "SNCF:ServiceJourney::TER847016:LOC", serviceDate(t, "2024-05-14"))
+	if err != nil || len(trips) != 1 {
+		t.Errorf("got trips %v and error %v once the trip is in the DB", trips, err)
+	}
+
+	//hits are cached until the network changes
+	err = fetcher.db.Where("feed_id = ? AND trip_id = ?", "1", "847016").Delete(&Trip{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	trips, _ = sc.resolveTrips(sc.rules[0], "", "SNCF:ServiceJourney::TER847016:LOC", serviceDate(t, "2024-05-14"))
+	if len(trips) != 1 {
+		t.Errorf("got trips %v, expected the cached trip", trips)
+	}
+	fetcher.networkChanged()
+	trips, _ = sc.resolveTrips(sc.rules[0], "", "SNCF:ServiceJourney::TER847016:LOC", serviceDate(t, "2024-05-14"))
+	if len(trips) != 0 {
+		t.Errorf("got trips %v, the cache should be cleared when the network changes", trips)
+	}
+}
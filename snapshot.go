@@ -0,0 +1,684 @@
+package trainmapdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A Snapshot is a read-only in-memory copy of the network, answering the Fetcher's queries without hitting the DB.
+// Everything is kept in flat arrays referencing each other by index, and structs are only rebuilt for query results.
+// Build it with Fetcher.BuildSnapshot and install it with Fetcher.UseSnapshot; a new one can be swapped in at any time.
+//
+// Pointers in the returned structs (Feed, Route, Stop) are shared between results and must not be modified.
+type Snapshot struct {
+	BuiltAt time.Time
+
+	feeds         []Feed
+	agencies      []Agency
+	routes        []Route
+	stops         []Stop
+	calendars     []Calendar
+	calendarDates []CalendarDate //sorted by feed, service and date
+	services      []snapshotService
+	trips         []snapshotTrip
+	stopTimes     []snapshotStopTime //stop times of every trip, contiguous and sorted by stop sequence for each trip
+	index         rtreeNode          //trip segments
+
+	feedIndex      map[string]int32
+	routeIndex     map[feedKey]int32
+	stopIndex      map[feedKey]int32
+	tripIndex      map[feedKey]int32
+	serviceIndex   map[feedKey]int32
+	childStops     map[int32][]int32
+	tripsByRoute   map[int32][]int32
+	stopTimesAt    map[int32][]int32 //stop index -> stop time indexes
+	tripsByService map[int32][]int32
+}
+
+const noSnapshotIndex int32 = -1
+
+type snapshotTrip struct {
+	feed          int32
+	route         int32
+	service       int32
+	tripId        string
+	refRouteId    string
+	headsign      string
+	shortName     string
+	box           BoundingBox
+	firstStopTime int32
+	stopTimeCount int32
+}
+
+// a snapshotStopTime stores times as seconds since the Unix epoch (GTFS times are stored as epoch + time of day).
+type snapshotStopTime struct {
+	trip         int32
+	stop         int32
+	stopSequence uint32
+	arrival      int32
+	departure    int32
+	headsign     string
+	pickupType   uint8
+	dropOffType  uint8
+}
+
+const noStopTime = math.MinInt32
+
+// a snapshotService stores the running days of a service as a bitmap starting at firstDay (days since the Unix epoch).
+type snapshotService struct {
+	feed          int32
+	serviceId     string
+	calendar      int32
+	calendarDates []CalendarDate
+	firstDay      int64
+	days          []uint64
+}
+
+func (ss *snapshotService) setDay(day int64) {
+	if len(ss.days) == 0 {
+		ss.firstDay = day
+	}
+	if day < ss.firstDay {
+		//days are read in order, this only happens with inconsistent data: shift the bitmap
+		shift := ss.firstDay - day
+		shifted := make([]uint64, (int64(len(ss.days))*64+shift+63)/64)
+		for i := int64(0); i < int64(len(ss.days))*64; i++ {
+			if ss.days[i/64]&(1<<(i%64)) != 0 {
+				shifted[(i+shift)/64] |= 1 << ((i + shift) % 64)
+			}
+		}
+		ss.days = shifted
+		ss.firstDay = day
+	}
+	offset := day - ss.firstDay
+	for int64(len(ss.days)) <= offset/64 {
+		ss.days = append(ss.days, 0)
+	}
+	ss.days[offset/64] |= 1 << (offset % 64)
+}
+
+func (ss *snapshotService) runsOn(day int64) bool {
+	offset := day - ss.firstDay
+	if offset < 0 || offset >= int64(len(ss.days))*64 {
+		return false
+	}
+	return ss.days[offset/64]&(1<<(offset%64)) != 0
+}
+
+const secondsPerDay = 24 * 60 * 60
+
+func dayNumber(date time.Time) int64 {
+	return int64(math.Floor(float64(date.Unix()) / secondsPerDay))
+}
+
+func toSnapshotTime(t time.Time) int32 {
+	if t.IsZero() {
+		return noStopTime
+	}
+	return int32(t.Unix())
+}
+
+func fromSnapshotTime(t int32) time.Time {
+	if t == noStopTime {
+		return time.Time{}
+	}
+	return time.Unix(int64(t), 0).UTC()
+}
+
+// A snapshotHolder is shared between the copies of a Fetcher, so that swapping the snapshot affects all of them.
+type snapshotHolder struct {
+	current atomic.Pointer[Snapshot]
+	version atomic.Int64 //bumped whenever the network may have changed, see networkVersion
+}
+
+// UseSnapshot atomically replaces the snapshot used to answer queries, nil goes back to querying the DB.
+// Queries already running keep using the previous snapshot.
+// A Fetcher opened from a snapshot file has no DB to go back to, so nil is ignored.
+func (f Fetcher) UseSnapshot(snapshot *Snapshot) {
+	if snapshot == nil && f.db == nil {
+		return
+	}
+	f.snapshot.current.Store(snapshot)
+	f.networkChanged()
+}
+
+// networkVersion changes whenever the network may have changed (loads, prunes and snapshot swaps),
+// so that what was cached from the previous network can be dropped.
+func (f Fetcher) networkVersion() int64 {
+	if f.snapshot == nil {
+		return 0
+	}
+	return f.snapshot.version.Load()
+}
+
+func (f Fetcher) networkChanged() {
+	if f.snapshot != nil {
+		f.snapshot.version.Add(1)
+	}
+}
+
+// CurrentSnapshot returns the snapshot currently used to answer queries, if any.
+func (f Fetcher) CurrentSnapshot() *Snapshot {
+	return f.snapshot.current.Load()
+}
+
+// ReloadSnapshot builds a new snapshot from the DB and swaps it in.
+func (f Fetcher) ReloadSnapshot() error {
+	snapshot, err := f.BuildSnapshot()
+	if err != nil {
+		return err
+	}
+	f.UseSnapshot(snapshot)
+	return nil
+}
+
+// BuildSnapshot reads the whole network from the DB into a new Snapshot (this ignores the current snapshot).
+func (f Fetcher) BuildSnapshot() (*Snapshot, error) {
+	if f.db == nil {
+		return nil, ErrNoDatabase
+	}
+	db := f.db
+	s := &Snapshot{
+		BuiltAt:        time.Now(),
+		feedIndex:      make(map[string]int32),
+		routeIndex:     make(map[feedKey]int32),
+		stopIndex:      make(map[feedKey]int32),
+		tripIndex:      make(map[feedKey]int32),
+		serviceIndex:   make(map[feedKey]int32),
+		childStops:     make(map[int32][]int32),
+		tripsByRoute:   make(map[int32][]int32),
+		stopTimesAt:    make(map[int32][]int32),
+		tripsByService: make(map[int32][]int32),
+	}
+	for _, load := range []struct {
+		name  string
+		query func() error
+	}{
+		{"feeds", func() error { return db.Order("feed_id").Find(&s.feeds).Error }},
+		{"agencies", func() error { return db.Order("feed_id, agency_id").Find(&s.agencies).Error }},
+		{"routes", func() error { return db.Order("feed_id, route_id").Find(&s.routes).Error }},
+		{"stops", func() error { return db.Order("feed_id, stop_id").Find(&s.stops).Error }},
+		{"calendars", func() error { return db.Order("feed_id, service_id").Find(&s.calendars).Error }},
+		{"calendar dates", func() error { return db.Order("feed_id, service_id, date").Find(&s.calendarDates).Error }},
+	} {
+		err := load.query()
+		if err != nil {
+			return nil, fmt.Errorf("could not load %s: %s", load.name, err.Error())
+		}
+	}
+	s.indexRows()
+
+	err := s.loadServiceDays(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not load service days: %s", err.Error())
+	}
+	it := f.IterateTrips(TripLoadOptions{})
+	for it.Next() {
+		s.addTrip(it.Trip())
+	}
+	if it.Err() != nil {
+		return nil, fmt.Errorf("could not load trips: %s", it.Err().Error())
+	}
+	err = s.loadStopTimes(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not load stop times: %s", err.Error())
+	}
+	err = s.checkFeeds()
+	if err != nil {
+		return nil, err
+	}
+	s.buildSpatialIndex()
+	return s, nil
+}
+
+func (s *Snapshot) indexRows() {
+	for i, feed := range s.feeds {
+		s.feedIndex[feed.FeedId] = int32(i)
+	}
+	for i, route := range s.routes {
+		s.routeIndex[feedKey{feedId: route.FeedId, id: route.RouteId}] = int32(i)
+	}
+	for i, stop := range s.stops {
+		s.stopIndex[feedKey{feedId: stop.FeedId, id: stop.StopId}] = int32(i)
+	}
+	for i, stop := range s.stops {
+		if stop.ParentStationId == nil {
+			continue
+		}
+		if parent, ok := s.stopIndex[feedKey{feedId: stop.FeedId, id: *stop.ParentStationId}]; ok {
+			s.childStops[parent] = append(s.childStops[parent], int32(i))
+		}
+	}
+	//NOTE: s.service may grow s.services, so it must be called before indexing it
+	for i, calendar := range s.calendars {
+		service := s.service(calendar.FeedId, calendar.ServiceId)
+		s.services[service].calendar = int32(i)
+	}
+	for _, calendarDate := range s.calendarDates {
+		service := s.service(calendarDate.FeedId, calendarDate.ServiceId)
+		s.services[service].calendarDates = append(s.services[service].calendarDates, calendarDate)
+	}
+}
+
+// service returns the index of the given service, adding it if needed.
+func (s *Snapshot) service(feedId string, serviceId string) int32 {
+	key := feedKey{feedId: feedId, id: serviceId}
+	if i, ok := s.serviceIndex[key]; ok {
+		return i
+	}
+	feed, ok := s.feedIndex[feedId]
+	if !ok {
+		feed = noSnapshotIndex
+	}
+	s.services = append(s.services, snapshotService{feed: feed, serviceId: serviceId, calendar: noSnapshotIndex})
+	i := int32(len(s.services) - 1)
+	s.serviceIndex[key] = i
+	return i
+}
+
+func (s *Snapshot) loadServiceDays(db *gorm.DB) error {
+	rows, err := db.Model(&ServiceDay{}).Order("feed_id, service_id, date").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var serviceDay ServiceDay
+		err = db.ScanRows(rows, &serviceDay)
+		if err != nil {
+			return err
+		}
+		service := s.service(serviceDay.FeedId, serviceDay.ServiceId)
+		s.services[service].setDay(dayNumber(serviceDay.Date))
+	}
+	return rows.Err()
+}
+
+func (s *Snapshot) addTrip(trip Trip) {
+	feed, ok := s.feedIndex[trip.FeedId]
+	if !ok {
+		feed = noSnapshotIndex
+	}
+	route, ok := s.routeIndex[feedKey{feedId: trip.FeedId, id: trip.RefRouteId}]
+	if !ok {
+		route = noSnapshotIndex
+	}
+	service := s.service(trip.FeedId, trip.RefServiceId)
+	s.trips = append(s.trips, snapshotTrip{
+		feed:       feed,
+		route:      route,
+		service:    service,
+		tripId:     trip.TripId,
+		refRouteId: trip.RefRouteId,
+		headsign:   trip.Headsign,
+		shortName:  trip.TripShortName,
+		box:        BoundingBox{MinLat: trip.MinLat, MaxLat: trip.MaxLat, MinLon: trip.MinLon, MaxLon: trip.MaxLon},
+	})
+	i := int32(len(s.trips) - 1)
+	s.tripIndex[feedKey{feedId: trip.FeedId, id: trip.TripId}] = i
+	if route != noSnapshotIndex {
+		s.tripsByRoute[route] = append(s.tripsByRoute[route], i)
+	}
+	s.tripsByService[service] = append(s.tripsByService[service], i)
+}
+
+func (s *Snapshot) loadStopTimes(db *gorm.DB) error {
+	rows, err := db.Model(&StopTime{}).Order("feed_id, trip_id, stop_sequence").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stopTime StopTime
+		err = db.ScanRows(rows, &stopTime)
+		if err != nil {
+			return err
+		}
+		trip, ok := s.tripIndex[feedKey{feedId: stopTime.FeedId, id: stopTime.TripId}]
+		if !ok {
+			continue
+		}
+		stop, ok := s.stopIndex[feedKey{feedId: stopTime.FeedId, id: stopTime.StopId}]
+		if !ok {
+			stop = noSnapshotIndex
+		}
+		i := int32(len(s.stopTimes))
+		if s.trips[trip].stopTimeCount == 0 {
+			s.trips[trip].firstStopTime = i
+		}
+		s.trips[trip].stopTimeCount++
+		s.stopTimes = append(s.stopTimes, snapshotStopTime{
+			trip:         trip,
+			stop:         stop,
+			stopSequence: uint32(stopTime.StopSequence),
+			arrival:      toSnapshotTime(stopTime.ArrivalTime),
+			departure:    toSnapshotTime(stopTime.DepartureTime),
+			headsign:     stopTime.StopHeadsign,
+			pickupType:   uint8(stopTime.PickupType),
+			dropOffType:  uint8(stopTime.DropOffType),
+		})
+		if stop != noSnapshotIndex {
+			s.stopTimesAt[stop] = append(s.stopTimesAt[stop], i)
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Snapshot) buildSpatialIndex() {
+	var entries []rtreeEntry
+	for _, trip := range s.trips {
+		stopTimes := s.stopTimes[trip.firstStopTime : trip.firstStopTime+trip.stopTimeCount]
+		for i := 0; i+1 < len(stopTimes); i++ {
+			if stopTimes[i].stop == noSnapshotIndex || stopTimes[i+1].stop == noSnapshotIndex {
+				continue
+			}
+			minLat, maxLat, minLon, maxLon := pointsToBoundingBox(s.stops[stopTimes[i].stop].GetPoint(), s.stops[stopTimes[i+1].stop].GetPoint())
+			entries = append(entries, rtreeEntry{
+				box:     BoundingBox{MinLat: minLat, MaxLat: maxLat, MinLon: minLon, MaxLon: maxLon},
+				segment: TripSegment{FeedId: s.feedId(trip.feed), TripId: trip.tripId, StopSequence: uint(stopTimes[i].stopSequence)},
+			})
+		}
+	}
+	s.index = buildRTree(entries)
+}
+
+// checkFeeds makes sure every service and trip belongs to a known feed, since they only keep the feed's index.
+// Without it, they would lose their feed ID (and couldn't be written to a snapshot file).
+func (s *Snapshot) checkFeeds() error {
+	for _, service := range s.services {
+		if service.feed == noSnapshotIndex {
+			return fmt.Errorf("service %s belongs to a feed missing from the DB", service.serviceId)
+		}
+	}
+	for _, trip := range s.trips {
+		if trip.feed == noSnapshotIndex {
+			return fmt.Errorf("trip %s belongs to a feed missing from the DB", trip.tripId)
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) feedId(feed int32) string {
+	if feed == noSnapshotIndex {
+		return ""
+	}
+	return s.feeds[feed].FeedId
+}
+
+func (s *Snapshot) feed(feed int32) *Feed {
+	if feed == noSnapshotIndex {
+		return nil
+	}
+	return &s.feeds[feed]
+}
+
+// trip rebuilds the given trip, with its associations selected by the options.
+func (s *Snapshot) trip(i int32, options TripLoadOptions) Trip {
+	st := s.trips[i]
+	service := s.services[st.service]
+	trip := Trip{
+		FeedId:        s.feedId(st.feed),
+		TripId:        st.tripId,
+		RefRouteId:    st.refRouteId,
+		RefServiceId:  service.serviceId,
+		Headsign:      st.headsign,
+		TripShortName: st.shortName,
+		MinLat:        st.box.MinLat,
+		MaxLat:        st.box.MaxLat,
+		MinLon:        st.box.MinLon,
+		MaxLon:        st.box.MaxLon,
+	}
+	if options.Feed {
+		trip.Feed = s.feed(st.feed)
+	}
+	if options.Route && st.route != noSnapshotIndex {
+		trip.Route = &s.routes[st.route]
+	}
+	if options.Calendar && service.calendar != noSnapshotIndex {
+		trip.Calendar = s.calendars[service.calendar]
+	}
+	if options.CalendarDates {
+		trip.CalendarDates = append([]CalendarDate{}, service.calendarDates...)
+	}
+	if options.StopTimes || options.Stops {
+		trip.StopTimes = make([]StopTime, st.stopTimeCount)
+		for j := range trip.StopTimes {
+			trip.StopTimes[j] = s.stopTime(st.firstStopTime+int32(j), options.Stops)
+		}
+	}
+	return trip
+}
+
+func (s *Snapshot) stopTime(i int32, withStop bool) StopTime {
+	sst := s.stopTimes[i]
+	trip := s.trips[sst.trip]
+	stopTime := StopTime{
+		FeedId:        s.feedId(trip.feed),
+		TripId:        trip.tripId,
+		ArrivalTime:   fromSnapshotTime(sst.arrival),
+		DepartureTime: fromSnapshotTime(sst.departure),
+		StopSequence:  uint(sst.stopSequence),
+		StopHeadsign:  sst.headsign,
+		PickupType:    ServiceType(sst.pickupType),
+		DropOffType:   ServiceType(sst.dropOffType),
+	}
+	if sst.stop != noSnapshotIndex {
+		stopTime.StopId = s.stops[sst.stop].StopId
+		if withStop {
+			stopTime.Stop = &s.stops[sst.stop]
+		}
+	}
+	return stopTime
+}
+
+// GetAllTrips returns every trip with all its associations.
+func (s *Snapshot) GetAllTrips(ctx context.Context) ([]Trip, error) {
+	trips := make([]Trip, len(s.trips))
+	for i := range s.trips {
+		trips[i] = s.trip(int32(i), FullTripLoadOptions())
+	}
+	return trips, nil
+}
+
+// GetAllStops returns every stop with its feed and parent/child stations.
+func (s *Snapshot) GetAllStops(ctx context.Context) ([]Stop, error) {
+	stops := make([]Stop, len(s.stops))
+	for i := range s.stops {
+		stops[i] = s.stop(int32(i))
+	}
+	return stops, nil
+}
+
+func (s *Snapshot) stop(i int32) Stop {
+	stop := s.stops[i]
+	if feed, ok := s.feedIndex[stop.FeedId]; ok {
+		stop.Feed = s.feeds[feed]
+	}
+	if stop.ParentStationId != nil {
+		if parent, ok := s.stopIndex[feedKey{feedId: stop.FeedId, id: *stop.ParentStationId}]; ok {
+			stop.ParentStation = &s.stops[parent]
+		}
+	}
+	for _, child := range s.childStops[i] {
+		stop.ChildStations = append(stop.ChildStations, s.stops[child])
+	}
+	return stop
+}
+
+// GetServicesBetweenDates returns all services running between the given dates (both included).
+func (s *Snapshot) GetServicesBetweenDates(ctx context.Context, startDate time.Time, endDate time.Time) ([]ServiceDay, error) {
+	//same semantics as SQL BETWEEN on the dates at midnight UTC
+	firstDay := dayNumber(startDate)
+	if time.Unix(firstDay*secondsPerDay, 0).Before(startDate) {
+		firstDay++
+	}
+	lastDay := dayNumber(endDate)
+	var serviceDays []ServiceDay
+	for _, service := range s.services {
+		for day := max(firstDay, service.firstDay); day <= lastDay; day++ {
+			if day >= service.firstDay+int64(len(service.days))*64 {
+				break
+			}
+			if service.runsOn(day) {
+				serviceDays = append(serviceDays, ServiceDay{
+					Date:      time.Unix(day*secondsPerDay, 0).UTC(),
+					FeedId:    s.feedId(service.feed),
+					ServiceId: service.serviceId,
+				})
+			}
+		}
+	}
+	return serviceDays, nil
+}
+
+// GetFeededServiceIdTrips returns all trips that run on the given service.
+func (s *Snapshot) GetFeededServiceIdTrips(ctx context.Context, feededService FeededService) ([]Trip, error) {
+	service, ok := s.serviceIndex[feedKey{feedId: feededService.FeedId, id: feededService.ServiceId}]
+	if !ok {
+		return nil, nil
+	}
+	var trips []Trip
+	for _, i := range s.tripsByService[service] {
+		trips = append(trips, s.trip(i, TripLoadOptions{}))
+	}
+	return trips, nil
+}
+
+// GetTrip returns the given trip with all its associations.
+func (s *Snapshot) GetTrip(ctx context.Context, feedId string, tripId string) (Trip, error) {
+	i, ok := s.tripIndex[feedKey{feedId: feedId, id: tripId}]
+	if !ok {
+		return Trip{FeedId: feedId, TripId: tripId}, gorm.ErrRecordNotFound
+	}
+	trip := s.trip(i, FullTripLoadOptions())
+	tripWithoutStopTimes := trip
+	tripWithoutStopTimes.StopTimes = nil
+	for j := range trip.StopTimes {
+		trip.StopTimes[j].Trip = &tripWithoutStopTimes
+	}
+	return trip, nil
+}
+
+// GetRoute returns the given route, with its trips.
+func (s *Snapshot) GetRoute(ctx context.Context, feedId string, routeId string) (Route, error) {
+	i, ok := s.routeIndex[feedKey{feedId: feedId, id: routeId}]
+	if !ok {
+		return Route{FeedId: feedId, RouteId: routeId}, gorm.ErrRecordNotFound
+	}
+	route := s.routes[i]
+	if feed, ok := s.feedIndex[feedId]; ok {
+		route.Feed = s.feeds[feed]
+	}
+	for _, agency := range s.agencies {
+		if agency.FeedId == route.FeedId && agency.AgencyId == route.AgencyId {
+			route.Agency = agency
+			break
+		}
+	}
+	for _, trip := range s.tripsByRoute[i] {
+		route.Trips = append(route.Trips, s.trip(trip, TripLoadOptions{StopTimes: true, Stops: true}))
+	}
+	return route, nil
+}
+
+// GetFeed returns the given feed.
+func (s *Snapshot) GetFeed(ctx context.Context, feedId string) (Feed, error) {
+	i, ok := s.feedIndex[feedId]
+	if !ok {
+		return Feed{FeedId: feedId}, gorm.ErrRecordNotFound
+	}
+	return s.feeds[i], nil
+}
+
+// GetFeeds returns every feed.
+func (s *Snapshot) GetFeeds(ctx context.Context) ([]Feed, error) {
+	return append([]Feed{}, s.feeds...), nil
+}
+
+// GetAllAgencies returns every agency.
+func (s *Snapshot) GetAllAgencies(ctx context.Context) ([]Agency, error) {
+	return append([]Agency{}, s.agencies...), nil
+}
+
+// GetStop returns the given stop, with its stop times.
+func (s *Snapshot) GetStop(ctx context.Context, feedId string, stopId string) (Stop, error) {
+	i, ok := s.stopIndex[feedKey{feedId: feedId, id: stopId}]
+	if !ok {
+		return Stop{FeedId: feedId, StopId: stopId}, gorm.ErrRecordNotFound
+	}
+	stop := s.stop(i)
+	for _, stopTimeIndex := range s.stopTimesAt[i] {
+		stopTime := s.stopTime(stopTimeIndex, false)
+		trip := s.trip(s.stopTimes[stopTimeIndex].trip, TripLoadOptions{})
+		stopTime.Trip = &trip
+		stop.StopTimes = append(stop.StopTimes, stopTime)
+	}
+	return stop, nil
+}
+
+// GetStopTimesAtStop returns all the StopTimes at the given stop.
+func (s *Snapshot) GetStopTimesAtStop(ctx context.Context, feedId string, stopId string) ([]StopTime, error) {
+	i, ok := s.stopIndex[feedKey{feedId: feedId, id: stopId}]
+	if !ok {
+		return nil, nil
+	}
+	var stopTimes []StopTime
+	for _, stopTimeIndex := range s.stopTimesAt[i] {
+		stopTimes = append(stopTimes, s.stopTime(stopTimeIndex, false))
+	}
+	return stopTimes, nil
+}
+
+// GetStopsLike returns the stops whose name contains the given string, see Fetcher.GetStopsLike.
+func (s *Snapshot) GetStopsLike(ctx context.Context, name string) ([]Stop, error) {
+	name = strings.ToUpper(name)
+	var stops []Stop
+	for _, stop := range s.stops {
+		if !strings.Contains(strings.ToUpper(stop.StopName), name) {
+			continue
+		}
+		if feed, ok := s.feedIndex[stop.FeedId]; ok {
+			stop.Feed = s.feeds[feed]
+		}
+		stops = append(stops, stop)
+		if len(stops) == stopsLikeMaxResults*5 {
+			break
+		}
+	}
+	return uniqueStationStops(stops), nil
+}
+
+// GetTripSegmentsWithIntersection returns the trips having segments in the given box, see Backend.
+func (s *Snapshot) GetTripSegmentsWithIntersection(ctx context.Context, box BoundingBox, options TripLoadOptions) ([]TripMatch, error) {
+	stopSequences := make(map[int32]map[uint]bool)
+	var tripIndexes []int32
+	s.index.search(box, func(entry rtreeEntry) {
+		i := s.tripIndex[feedKey{feedId: entry.segment.FeedId, id: entry.segment.TripId}]
+		if stopSequences[i] == nil {
+			stopSequences[i] = make(map[uint]bool)
+			tripIndexes = append(tripIndexes, i)
+		}
+		stopSequences[i][entry.segment.StopSequence] = true
+	})
+	sort.Slice(tripIndexes, func(a, b int) bool { return tripIndexes[a] < tripIndexes[b] })
+
+	options.StopTimes = true
+	matches := make([]TripMatch, 0, len(tripIndexes))
+	for _, i := range tripIndexes {
+		match := TripMatch{Trip: s.trip(i, options)}
+		for j, stopTime := range match.Trip.StopTimes[:max(len(match.Trip.StopTimes)-1, 0)] {
+			if stopSequences[i][stopTime.StopSequence] {
+				match.Segments = append(match.Segments, j)
+			}
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
@@ -0,0 +1,638 @@
+package trainmapdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot file layout (all integers are varints unless stated otherwise):
+//
+//	magic "TMDBSNAP", format version
+//	string table: count, then every string's length, then all the bytes
+//	body: every section of the Snapshot, strings being indexes in the string table
+//	CRC-32 (Castagnoli) of everything above, as a little endian uint32
+//
+// Strings are deduplicated and decoded as substrings of a single allocation, which keeps loading fast.
+
+const (
+	snapshotMagic         = "TMDBSNAP"
+	snapshotFormatVersion = 1
+)
+
+var snapshotCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrNoDatabase is returned by the methods needing a DB when the Fetcher was opened from a snapshot file.
+var ErrNoDatabase = errors.New("this Fetcher has no database (opened from a snapshot file)")
+
+// NewSnapshotFetcher returns a Fetcher answering queries from the given snapshot file, without any DB.
+// Methods that need a DB (loading, station matching, exports...) return ErrNoDatabase.
+func NewSnapshotFetcher(path string, config *FetcherConfig) (*Fetcher, error) {
+	var fetcherConfig FetcherConfig
+	if config != nil {
+		fetcherConfig = *config
+	} else {
+		fetcherConfig = NewDefaultConfig()
+	}
+	snapshot, err := ReadSnapshotFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fetcher := &Fetcher{Config: fetcherConfig, Realtime: NewRealtimeState(), snapshot: &snapshotHolder{}}
+	fetcher.snapshot.current.Store(snapshot)
+	return fetcher, nil
+}
+
+// ExportSnapshotFile builds a snapshot of the DB and writes it to the given file.
+func (f Fetcher) ExportSnapshotFile(path string) error {
+	snapshot, err := f.BuildSnapshot()
+	if err != nil {
+		return err
+	}
+	return snapshot.WriteFile(path)
+}
+
+// WriteFile writes the snapshot to the given file. The file is replaced atomically, so readers never see a partial one.
+func (s *Snapshot) WriteFile(path string) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) //no-op once renamed
+	_, err = s.WriteTo(tempFile)
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// WriteTo writes the snapshot in the binary snapshot format.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	body := &snapshotEncoder{strings: make(map[string]uint64)}
+	s.encode(body)
+
+	header := &snapshotEncoder{}
+	header.buffer.WriteString(snapshotMagic)
+	header.uvarint(snapshotFormatVersion)
+	header.uvarint(uint64(len(body.stringTable)))
+	for _, str := range body.stringTable {
+		header.uvarint(uint64(len(str)))
+	}
+	for _, str := range body.stringTable {
+		header.buffer.WriteString(str)
+	}
+
+	crc := crc32.New(snapshotCrcTable)
+	bufferedWriter := bufio.NewWriter(io.MultiWriter(w, crc))
+	var written int64
+	for _, part := range [][]byte{header.buffer.Bytes(), body.buffer.Bytes()} {
+		n, err := bufferedWriter.Write(part)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	err := bufferedWriter.Flush()
+	if err != nil {
+		return written, err
+	}
+	n, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return written + int64(n), err
+}
+
+// ReadSnapshotFile reads a snapshot written by Snapshot.WriteFile.
+func ReadSnapshotFile(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return snapshot, nil
+}
+
+// ReadSnapshot reads a snapshot written by Snapshot.WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(data)
+}
+
+func decodeSnapshot(data []byte) (*Snapshot, error) {
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("not a snapshot file")
+	}
+	content := data[:len(data)-4]
+	if crc32.Checksum(content, snapshotCrcTable) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("snapshot file is corrupted (checksum mismatch)")
+	}
+	d := &snapshotDecoder{data: content, position: len(snapshotMagic)}
+	version := d.uvarint()
+	if d.err == nil && version != snapshotFormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot format version %d (expected %d)", version, snapshotFormatVersion)
+	}
+	stringLengths := make([]uint64, d.length())
+	var totalLength uint64
+	for i := range stringLengths {
+		stringLengths[i] = d.uvarint()
+		totalLength += stringLengths[i]
+	}
+	blob := string(d.bytes(totalLength))
+	d.stringTable = make([]string, len(stringLengths))
+	var offset uint64
+	for i, length := range stringLengths {
+		d.stringTable[i] = blob[offset : offset+length]
+		offset += length
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	s := decodeSnapshotBody(d)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.position != len(d.data) {
+		return nil, fmt.Errorf("unexpected data after the snapshot")
+	}
+	return s, nil
+}
+
+type snapshotEncoder struct {
+	buffer      bytes.Buffer
+	strings     map[string]uint64
+	stringTable []string
+}
+
+func (e *snapshotEncoder) uvarint(value uint64) {
+	e.buffer.Write(binary.AppendUvarint(nil, value))
+}
+
+func (e *snapshotEncoder) varint(value int64) {
+	e.buffer.Write(binary.AppendVarint(nil, value))
+}
+
+func (e *snapshotEncoder) float(value float64) {
+	e.buffer.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func (e *snapshotEncoder) str(value string) {
+	index, ok := e.strings[value]
+	if !ok {
+		index = uint64(len(e.stringTable))
+		e.strings[value] = index
+		e.stringTable = append(e.stringTable, value)
+	}
+	e.uvarint(index)
+}
+
+// optionalStr encodes a presence flag, followed by the string if present.
+func (e *snapshotEncoder) optionalStr(value *string) {
+	if value == nil {
+		e.uvarint(0)
+		return
+	}
+	e.uvarint(1)
+	e.str(*value)
+}
+
+func (e *snapshotEncoder) date(value time.Time) {
+	e.varint(value.Unix())
+}
+
+// A snapshotDecoder reads values until the first error, then only returns zero values (check err at the end).
+type snapshotDecoder struct {
+	data        []byte
+	position    int
+	stringTable []string
+	err         error
+}
+
+var errTruncatedSnapshot = errors.New("snapshot file is truncated")
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(d.data[d.position:])
+	if n <= 0 {
+		d.err = errTruncatedSnapshot
+		return 0
+	}
+	d.position += n
+	return value
+}
+
+func (d *snapshotDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(d.data[d.position:])
+	if n <= 0 {
+		d.err = errTruncatedSnapshot
+		return 0
+	}
+	d.position += n
+	return value
+}
+
+// length reads a collection length, making sure it can't be absurdly large on corrupted data.
+func (d *snapshotDecoder) length() int {
+	length := d.uvarint()
+	if length > uint64(len(d.data)-d.position) {
+		if d.err == nil {
+			d.err = errTruncatedSnapshot
+		}
+		return 0
+	}
+	return int(length)
+}
+
+func (d *snapshotDecoder) bytes(length uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if length > uint64(len(d.data)-d.position) {
+		d.err = errTruncatedSnapshot
+		return nil
+	}
+	value := d.data[d.position : d.position+int(length)]
+	d.position += int(length)
+	return value
+}
+
+func (d *snapshotDecoder) float() float64 {
+	value := d.bytes(8)
+	if value == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(value))
+}
+
+func (d *snapshotDecoder) str() string {
+	index := d.uvarint()
+	if index >= uint64(len(d.stringTable)) {
+		if d.err == nil {
+			d.err = fmt.Errorf("invalid string reference in snapshot")
+		}
+		return ""
+	}
+	return d.stringTable[index]
+}
+
+func (d *snapshotDecoder) optionalStr() *string {
+	if d.uvarint() == 0 {
+		return nil
+	}
+	value := d.str()
+	return &value
+}
+
+func (d *snapshotDecoder) date() time.Time {
+	return time.Unix(d.varint(), 0).UTC()
+}
+
+// index reads a reference to another element, checking that it's valid.
+func (d *snapshotDecoder) index(count int) int32 {
+	value := d.varint()
+	if value < int64(noSnapshotIndex) || value >= int64(count) {
+		if d.err == nil {
+			d.err = fmt.Errorf("invalid reference in snapshot")
+		}
+		return noSnapshotIndex
+	}
+	return int32(value)
+}
+
+// requiredIndex reads a reference to another element that must exist.
+func (d *snapshotDecoder) requiredIndex(count int, what string) int32 {
+	value := d.index(count)
+	if value == noSnapshotIndex && d.err == nil {
+		d.err = fmt.Errorf("missing %s reference in snapshot", what)
+	}
+	return value
+}
+
+func (s *Snapshot) encode(e *snapshotEncoder) {
+	e.date(s.BuiltAt)
+
+	e.uvarint(uint64(len(s.feeds)))
+	for _, feed := range s.feeds {
+		for _, value := range []string{feed.DisplayName, feed.FeedId, feed.PublisherName, feed.PublisherUrl, feed.FeedLang,
+			feed.DefaultLang, feed.Version, feed.ContactEmail, feed.ContactUrl} {
+			e.str(value)
+		}
+	}
+
+	e.uvarint(uint64(len(s.agencies)))
+	for _, agency := range s.agencies {
+		for _, value := range []string{agency.FeedId, agency.AgencyId, agency.AgencyName, agency.AgencyUrl, agency.AgencyTimezone, agency.AgencyLang} {
+			e.str(value)
+		}
+	}
+
+	e.uvarint(uint64(len(s.routes)))
+	for _, route := range s.routes {
+		for _, value := range []string{route.FeedId, route.RouteId, route.RouteShortName, route.RouteLongName, route.RouteDesc,
+			route.RouteColor, route.RouteTextColor, route.AgencyId} {
+			e.str(value)
+		}
+		e.varint(int64(route.RouteType))
+	}
+
+	e.uvarint(uint64(len(s.stops)))
+	for _, stop := range s.stops {
+		for _, value := range []string{stop.FeedId, stop.StopId, stop.StopCode, stop.StopName, stop.TtsStopName, stop.StopDesc, stop.StopUrl} {
+			e.str(value)
+		}
+		e.float(stop.StopLat)
+		e.float(stop.StopLon)
+		if stop.LocationType == nil {
+			e.varint(-1)
+		} else {
+			e.varint(int64(*stop.LocationType))
+		}
+		e.optionalStr(stop.ParentStationId)
+		e.optionalStr(stop.StationId)
+	}
+
+	e.uvarint(uint64(len(s.calendars)))
+	for _, calendar := range s.calendars {
+		e.str(calendar.FeedId)
+		e.str(calendar.ServiceId)
+		var weekdays uint64
+		for i, runs := range []bool{calendar.Monday, calendar.Tuesday, calendar.Wednesday, calendar.Thursday, calendar.Friday, calendar.Saturday, calendar.Sunday} {
+			if runs {
+				weekdays |= 1 << i
+			}
+		}
+		e.uvarint(weekdays)
+		e.date(calendar.StartDate)
+		e.date(calendar.EndDate)
+	}
+
+	e.uvarint(uint64(len(s.calendarDates)))
+	for _, calendarDate := range s.calendarDates {
+		e.str(calendarDate.FeedId)
+		e.str(calendarDate.ServiceId)
+		e.date(calendarDate.Date)
+		e.uvarint(uint64(calendarDate.ExceptionType))
+	}
+
+	e.uvarint(uint64(len(s.services)))
+	for _, service := range s.services {
+		e.varint(int64(service.feed))
+		e.str(service.serviceId)
+		e.varint(int64(service.calendar))
+		e.varint(service.firstDay)
+		e.uvarint(uint64(len(service.days)))
+		for _, days := range service.days {
+			e.uvarint(days)
+		}
+	}
+
+	e.uvarint(uint64(len(s.trips)))
+	for _, trip := range s.trips {
+		e.varint(int64(trip.feed))
+		e.varint(int64(trip.route))
+		e.varint(int64(trip.service))
+		e.str(trip.tripId)
+		e.str(trip.refRouteId)
+		e.str(trip.headsign)
+		e.str(trip.shortName)
+		e.float(trip.box.MinLat)
+		e.float(trip.box.MaxLat)
+		e.float(trip.box.MinLon)
+		e.float(trip.box.MaxLon)
+		e.uvarint(uint64(trip.stopTimeCount))
+	}
+
+	//stop times are stored in trip order, so their trip and position are implied
+	e.uvarint(uint64(len(s.stopTimes)))
+	for _, trip := range s.trips {
+		for _, stopTime := range s.stopTimes[trip.firstStopTime : trip.firstStopTime+trip.stopTimeCount] {
+			e.varint(int64(stopTime.stop))
+			e.uvarint(uint64(stopTime.stopSequence))
+			e.varint(int64(stopTime.arrival))
+			e.varint(int64(stopTime.departure))
+			e.str(stopTime.headsign)
+			e.uvarint(uint64(stopTime.pickupType))
+			e.uvarint(uint64(stopTime.dropOffType))
+		}
+	}
+
+	s.encodeRTreeNode(e, &s.index)
+}
+
+func (s *Snapshot) encodeRTreeNode(e *snapshotEncoder, node *rtreeNode) {
+	e.float(node.box.MinLat)
+	e.float(node.box.MaxLat)
+	e.float(node.box.MinLon)
+	e.float(node.box.MaxLon)
+	e.uvarint(uint64(len(node.entries)))
+	for _, entry := range node.entries {
+		e.float(entry.box.MinLat)
+		e.float(entry.box.MaxLat)
+		e.float(entry.box.MinLon)
+		e.float(entry.box.MaxLon)
+		e.varint(int64(s.tripIndex[feedKey{feedId: entry.segment.FeedId, id: entry.segment.TripId}]))
+		e.uvarint(uint64(entry.segment.StopSequence))
+	}
+	e.uvarint(uint64(len(node.children)))
+	for i := range node.children {
+		s.encodeRTreeNode(e, &node.children[i])
+	}
+}
+
+func decodeSnapshotBody(d *snapshotDecoder) *Snapshot {
+	s := &Snapshot{BuiltAt: d.date()}
+
+	s.feeds = make([]Feed, d.length())
+	for i := range s.feeds {
+		feed := &s.feeds[i]
+		for _, value := range []*string{&feed.DisplayName, &feed.FeedId, &feed.PublisherName, &feed.PublisherUrl, &feed.FeedLang,
+			&feed.DefaultLang, &feed.Version, &feed.ContactEmail, &feed.ContactUrl} {
+			*value = d.str()
+		}
+	}
+
+	s.agencies = make([]Agency, d.length())
+	for i := range s.agencies {
+		agency := &s.agencies[i]
+		for _, value := range []*string{&agency.FeedId, &agency.AgencyId, &agency.AgencyName, &agency.AgencyUrl, &agency.AgencyTimezone, &agency.AgencyLang} {
+			*value = d.str()
+		}
+	}
+
+	s.routes = make([]Route, d.length())
+	for i := range s.routes {
+		route := &s.routes[i]
+		for _, value := range []*string{&route.FeedId, &route.RouteId, &route.RouteShortName, &route.RouteLongName, &route.RouteDesc,
+			&route.RouteColor, &route.RouteTextColor, &route.AgencyId} {
+			*value = d.str()
+		}
+		route.RouteType = RouteType(d.varint())
+	}
+
+	s.stops = make([]Stop, d.length())
+	for i := range s.stops {
+		stop := &s.stops[i]
+		for _, value := range []*string{&stop.FeedId, &stop.StopId, &stop.StopCode, &stop.StopName, &stop.TtsStopName, &stop.StopDesc, &stop.StopUrl} {
+			*value = d.str()
+		}
+		stop.StopLat = d.float()
+		stop.StopLon = d.float()
+		if locationType := d.varint(); locationType >= 0 {
+			value := LocationType(locationType)
+			stop.LocationType = &value
+		}
+		stop.ParentStationId = d.optionalStr()
+		stop.StationId = d.optionalStr()
+	}
+
+	s.calendars = make([]Calendar, d.length())
+	for i := range s.calendars {
+		calendar := &s.calendars[i]
+		calendar.FeedId = d.str()
+		calendar.ServiceId = d.str()
+		weekdays := d.uvarint()
+		for j, runs := range []*bool{&calendar.Monday, &calendar.Tuesday, &calendar.Wednesday, &calendar.Thursday, &calendar.Friday, &calendar.Saturday, &calendar.Sunday} {
+			*runs = weekdays&(1<<j) != 0
+		}
+		calendar.StartDate = d.date()
+		calendar.EndDate = d.date()
+	}
+
+	s.calendarDates = make([]CalendarDate, d.length())
+	for i := range s.calendarDates {
+		calendarDate := &s.calendarDates[i]
+		calendarDate.FeedId = d.str()
+		calendarDate.ServiceId = d.str()
+		calendarDate.Date = d.date()
+		calendarDate.ExceptionType = ExceptionType(d.uvarint())
+	}
+
+	s.services = make([]snapshotService, d.length())
+	for i := range s.services {
+		service := &s.services[i]
+		service.feed = d.requiredIndex(len(s.feeds), "service feed")
+		service.serviceId = d.str()
+		service.calendar = d.index(len(s.calendars))
+		service.firstDay = d.varint()
+		service.days = make([]uint64, d.length())
+		for j := range service.days {
+			service.days[j] = d.uvarint()
+		}
+	}
+
+	s.trips = make([]snapshotTrip, d.length())
+	for i := range s.trips {
+		trip := &s.trips[i]
+		trip.feed = d.requiredIndex(len(s.feeds), "trip feed")
+		trip.route = d.index(len(s.routes))
+		trip.service = d.requiredIndex(len(s.services), "trip service")
+		trip.tripId = d.str()
+		trip.refRouteId = d.str()
+		trip.headsign = d.str()
+		trip.shortName = d.str()
+		trip.box = BoundingBox{MinLat: d.float(), MaxLat: d.float(), MinLon: d.float(), MaxLon: d.float()}
+		trip.stopTimeCount = int32(d.length())
+	}
+
+	s.stopTimes = make([]snapshotStopTime, d.length())
+	var position int32
+	for i := range s.trips {
+		s.trips[i].firstStopTime = position
+		for j := int32(0); j < s.trips[i].stopTimeCount; j++ {
+			if int(position) >= len(s.stopTimes) {
+				if d.err == nil {
+					d.err = fmt.Errorf("inconsistent stop time count in snapshot")
+				}
+				return nil
+			}
+			stopTime := &s.stopTimes[position]
+			stopTime.trip = int32(i)
+			stopTime.stop = d.index(len(s.stops))
+			stopTime.stopSequence = uint32(d.uvarint())
+			stopTime.arrival = int32(d.varint())
+			stopTime.departure = int32(d.varint())
+			stopTime.headsign = d.str()
+			stopTime.pickupType = uint8(d.uvarint())
+			stopTime.dropOffType = uint8(d.uvarint())
+			position++
+		}
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	s.rebuildIndexes()
+	s.index = s.decodeRTreeNode(d)
+	return s
+}
+
+func (s *Snapshot) decodeRTreeNode(d *snapshotDecoder) rtreeNode {
+	node := rtreeNode{box: BoundingBox{MinLat: d.float(), MaxLat: d.float(), MinLon: d.float(), MaxLon: d.float()}}
+	node.entries = make([]rtreeEntry, d.length())
+	for i := range node.entries {
+		entry := &node.entries[i]
+		entry.box = BoundingBox{MinLat: d.float(), MaxLat: d.float(), MinLon: d.float(), MaxLon: d.float()}
+		trip := d.requiredIndex(len(s.trips), "segment trip")
+		if trip == noSnapshotIndex {
+			return node
+		}
+		entry.segment = TripSegment{FeedId: s.feedId(s.trips[trip].feed), TripId: s.trips[trip].tripId, StopSequence: uint(d.uvarint())}
+	}
+	node.children = make([]rtreeNode, d.length())
+	for i := range node.children {
+		node.children[i] = s.decodeRTreeNode(d)
+	}
+	return node
+}
+
+// rebuildIndexes recomputes the lookup maps of a decoded snapshot.
+func (s *Snapshot) rebuildIndexes() {
+	s.feedIndex = make(map[string]int32, len(s.feeds))
+	s.routeIndex = make(map[feedKey]int32, len(s.routes))
+	s.stopIndex = make(map[feedKey]int32, len(s.stops))
+	s.tripIndex = make(map[feedKey]int32, len(s.trips))
+	s.serviceIndex = make(map[feedKey]int32, len(s.services))
+	s.childStops = make(map[int32][]int32)
+	s.tripsByRoute = make(map[int32][]int32)
+	s.stopTimesAt = make(map[int32][]int32)
+	s.tripsByService = make(map[int32][]int32)
+
+	for i, service := range s.services {
+		s.serviceIndex[feedKey{feedId: s.feedId(service.feed), id: service.serviceId}] = int32(i)
+	}
+	//services are already known, so this only fills the other indexes
+	s.indexRows()
+	for i, trip := range s.trips {
+		s.tripIndex[feedKey{feedId: s.feedId(trip.feed), id: trip.tripId}] = int32(i)
+		if trip.route != noSnapshotIndex {
+			s.tripsByRoute[trip.route] = append(s.tripsByRoute[trip.route], int32(i))
+		}
+		s.tripsByService[trip.service] = append(s.tripsByService[trip.service], int32(i))
+	}
+	for i, stopTime := range s.stopTimes {
+		if stopTime.stop != noSnapshotIndex {
+			s.stopTimesAt[stopTime.stop] = append(s.stopTimesAt[stopTime.stop], int32(i))
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package trainmapdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	fetcher := loadTestDatabase(t, testFeed("netex", "testdata/netex.xml"), testFeed("hrdf", zipTestFeed(t, "testdata/hrdf")))
+	snapshot, err := fetcher.BuildSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	_, err = snapshot.WriteTo(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadSnapshot(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.BuiltAt.Equal(snapshot.BuiltAt.Truncate(time.Second)) {
+		t.Errorf("got a snapshot built at %s, expected %s", decoded.BuiltAt, snapshot.BuiltAt)
+	}
+
+	ctx := context.Background()
+	for _, query := range []struct {
+		name string
+		run  func(backend Backend) (any, error)
+	}{
+		{"trips", func(backend Backend) (any, error) { return backend.GetAllTrips(ctx) }},
+		{"stops", func(backend Backend) (any, error) { return backend.GetAllStops(ctx) }},
+		{"agencies", func(backend Backend) (any, error) { return backend.GetAllAgencies(ctx) }},
+		{"feeds", func(backend Backend) (any, error) { return backend.GetFeeds(ctx) }},
+		{"services", func(backend Backend) (any, error) {
+			return backend.GetServicesBetweenDates(ctx, serviceDate(t, "2024-05-13"), serviceDate(t, "2024-05-19"))
+		}},
+		{"segments", func(backend Backend) (any, error) {
+			return backend.GetTripSegmentsWithIntersection(ctx, BoundingBox{MinLat: -90, MaxLat: 90, MinLon: -180, MaxLon: 180}, FullTripLoadOptions())
+		}},
+	} {
+		expected, err := query.run(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := query.run(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.ValueOf(expected).Len() == 0 {
+			t.Errorf("no %s in the snapshot", query.name)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("the %s of the decoded snapshot differ from the original ones", query.name)
+		}
+	}
+}
+
+// reencode returns the snapshot data with its checksum recomputed, after applying the given change.
+func reencode(data []byte, change func(content []byte) []byte) []byte {
+	content := change(append([]byte{}, data[:len(data)-4]...))
+	return binary.LittleEndian.AppendUint32(content, crc32.Checksum(content, snapshotCrcTable))
+}
+
+func TestSnapshotRejectsInvalidFiles(t *testing.T) {
+	fetcher := loadTestDatabase(t, testFeed("netex", "testdata/netex.xml"))
+	snapshot, err := fetcher.BuildSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	_, err = snapshot.WriteTo(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+
+	var orphanBuffer bytes.Buffer
+	orphan := *snapshot
+	orphan.trips = append([]snapshotTrip{}, snapshot.trips...)
+	orphan.trips[0].feed = noSnapshotIndex
+	_, err = orphan.WriteTo(&orphanBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		data          []byte
+		expectedError string
+	}{
+		{"not a snapshot", []byte("PK\x03\x04 not a snapshot"), "not a snapshot file"},
+		{"flipped bit", func() []byte {
+			corrupted := append([]byte{}, data...)
+			corrupted[len(corrupted)/2] ^= 1
+			return corrupted
+		}(), "checksum mismatch"},
+		{"newer version", reencode(data, func(content []byte) []byte {
+			content[len(snapshotMagic)] = snapshotFormatVersion + 1
+			return content
+		}), "unsupported snapshot format version"},
+		{"truncated", reencode(data, func(content []byte) []byte { return content[:len(content)-10] }), "truncated"},
+		{"trailing data", reencode(data, func(content []byte) []byte { return append(content, 0) }), "unexpected data"},
+		{"trip without feed", orphanBuffer.Bytes(), "missing trip feed reference"},
+	} {
+		_, err := ReadSnapshot(bytes.NewReader(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.expectedError)
+		}
+	}
+}
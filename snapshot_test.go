@@ -0,0 +1,16 @@
+package trainmapdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildSnapshotRejectsTripsWithoutFeed(t *testing.T) {
+	fetcher := newTestFetcher(t)
+	insertTestRows(t, fetcher, Feed{FeedId: "1"})
+	insertTestRows(t, fetcher, Trip{FeedId: "2", TripId: "orphan", RefServiceId: "daily"})
+	_, err := fetcher.BuildSnapshot()
+	if err == nil || !strings.Contains(err.Error(), "missing from the DB") {
+		t.Errorf("got error %v, expected the trip of the missing feed to be reported", err)
+	}
+}
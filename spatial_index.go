@@ -0,0 +1,396 @@
+package trainmapdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// A SpatialIndexType selects how trips are looked up by location.
+type SpatialIndexType string
+
+const (
+	SpatialIndexAuto        SpatialIndexType = "auto"         //best one available for the DB (the zero value means the same)
+	SpatialIndexColumns     SpatialIndexType = "columns"      //plain composite index on the segments' bounding box columns
+	SpatialIndexSQLiteRTree SpatialIndexType = "sqlite_rtree" //SQLite R*Tree virtual table
+	SpatialIndexPostGIS     SpatialIndexType = "postgis"      //PostGIS geometry with a GiST index
+	SpatialIndexMemory      SpatialIndexType = "memory"       //pure Go R-tree, built in memory on first use
+)
+
+// name of the table backing the DB side spatial indexes
+const spatialIndexTable = "trip_spatial_index"
+
+// A TripSegment represents the part of a trip between 2 consecutive stops,
+// identified by the stop sequence of the stop it starts at.
+type TripSegment struct {
+	FeedId       string
+	TripId       string
+	StopSequence uint
+}
+
+// A SpatialIndex finds the trip segments whose bounding box intersects a given bounding box.
+// Indexing segments rather than whole trips keeps long distance trips (whose bounding box may cover
+// half a country) out of the results for places they don't go near.
+type SpatialIndex interface {
+	Type() SpatialIndexType
+	// Build (re)builds the index from the trips' stop times, it must be called after every load.
+	Build(ctx context.Context) error
+	// Search returns every trip segment whose bounding box intersects the given one.
+	Search(ctx context.Context, box BoundingBox) ([]TripSegment, error)
+}
+
+// the bounding box of every segment between 2 consecutive stops, joined on the full (feed_id, stop_id) key.
+// window functions need SQLite 3.25+, MySQL 8+ or MariaDB 10.2+
+const tripSegmentsQuery = `
+	SELECT
+		feed_id,
+		trip_id,
+		stop_sequence,
+		CASE WHEN lat < next_lat THEN lat ELSE next_lat END AS min_lat,
+		CASE WHEN lat < next_lat THEN next_lat ELSE lat END AS max_lat,
+		CASE WHEN lon < next_lon THEN lon ELSE next_lon END AS min_lon,
+		CASE WHEN lon < next_lon THEN next_lon ELSE lon END AS max_lon
+	FROM (
+		SELECT
+			st.feed_id AS feed_id,
+			st.trip_id AS trip_id,
+			st.stop_sequence AS stop_sequence,
+			s.stop_lat AS lat,
+			s.stop_lon AS lon,
+			LEAD(s.stop_lat) OVER (PARTITION BY st.feed_id, st.trip_id ORDER BY st.stop_sequence) AS next_lat,
+			LEAD(s.stop_lon) OVER (PARTITION BY st.feed_id, st.trip_id ORDER BY st.stop_sequence) AS next_lon
+		FROM stop_times AS st
+		JOIN stops AS s ON s.feed_id = st.feed_id AND s.stop_id = st.stop_id
+	) AS segments
+	WHERE next_lat IS NOT NULL`
+
+// newSpatialIndex returns the spatial index of the given type, checking that the DB supports it.
+func newSpatialIndex(db *gorm.DB, indexType SpatialIndexType) (SpatialIndex, error) {
+	if indexType == "" || indexType == SpatialIndexAuto {
+		indexType = detectSpatialIndexType(db)
+	}
+	dialect := db.Dialector.Name()
+	switch indexType {
+	case SpatialIndexColumns:
+		return columnSpatialIndex{db: db}, nil
+	case SpatialIndexSQLiteRTree:
+		if dialect != "sqlite" {
+			return nil, fmt.Errorf("spatial index %s is not available on %s", indexType, dialect)
+		}
+		return sqliteRTreeIndex{db: db}, nil
+	case SpatialIndexPostGIS:
+		if dialect != "postgres" {
+			return nil, fmt.Errorf("spatial index %s is not available on %s", indexType, dialect)
+		}
+		return postgisIndex{db: db}, nil
+	case SpatialIndexMemory:
+		return &memorySpatialIndex{db: db}, nil
+	}
+	return nil, fmt.Errorf("unknown spatial index type %s", indexType)
+}
+
+// detectSpatialIndexType picks the DB side index if it's already built, or if the DB is empty and supports it.
+// Existing DBs without the index use the in-memory one rather than the slow column index.
+func detectSpatialIndexType(db *gorm.DB) SpatialIndexType {
+	migrator := db.Migrator()
+	isEmpty := !migrator.HasTable(&Trip{})
+	switch db.Dialector.Name() {
+	case "sqlite":
+		var hasRTree bool
+		err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_RTREE')").Scan(&hasRTree).Error
+		if migrator.HasTable(spatialIndexTable) || (err == nil && hasRTree && isEmpty) {
+			return SpatialIndexSQLiteRTree
+		}
+	case "postgres":
+		var hasPostGIS bool
+		err := db.Raw("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'postgis')").Scan(&hasPostGIS).Error
+		if migrator.HasTable(spatialIndexTable) || (err == nil && hasPostGIS && isEmpty) {
+			return SpatialIndexPostGIS
+		}
+	}
+	return SpatialIndexMemory
+}
+
+// BuildSpatialIndex (re)builds the spatial index used for trip lookups.
+// LoadDatabase already does it, this is only needed for DBs built by older versions.
+func (f Fetcher) BuildSpatialIndex() error {
+	if f.db == nil {
+		return ErrNoDatabase
+	}
+	return f.spatialIndex.Build(f.context())
+}
+
+type columnSpatialIndex struct {
+	db *gorm.DB
+}
+
+func (idx columnSpatialIndex) Type() SpatialIndexType {
+	return SpatialIndexColumns
+}
+
+func (idx columnSpatialIndex) Build(ctx context.Context) error {
+	return idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, statement := range []string{
+			"DROP TABLE IF EXISTS " + spatialIndexTable,
+			"CREATE TABLE " + spatialIndexTable + " (feed_id varchar(191) NOT NULL, trip_id varchar(191) NOT NULL, stop_sequence integer NOT NULL, " +
+				"min_lat double precision NOT NULL, max_lat double precision NOT NULL, min_lon double precision NOT NULL, max_lon double precision NOT NULL)",
+			"INSERT INTO " + spatialIndexTable + " (feed_id, trip_id, stop_sequence, min_lat, max_lat, min_lon, max_lon) " + tripSegmentsQuery,
+			"CREATE INDEX idx_" + spatialIndexTable + "_bounds ON " + spatialIndexTable + " (min_lat, max_lat, min_lon, max_lon)",
+		} {
+			err := tx.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (idx columnSpatialIndex) Search(ctx context.Context, box BoundingBox) ([]TripSegment, error) {
+	var segments []TripSegment
+	err := idx.db.WithContext(ctx).Raw("SELECT feed_id, trip_id, stop_sequence FROM "+spatialIndexTable+" WHERE max_lat >= ? AND min_lat <= ? AND max_lon >= ? AND min_lon <= ?",
+		box.MinLat, box.MaxLat, box.MinLon, box.MaxLon).
+		Scan(&segments).Error
+	return segments, err
+}
+
+type sqliteRTreeIndex struct {
+	db *gorm.DB
+}
+
+func (idx sqliteRTreeIndex) Type() SpatialIndexType {
+	return SpatialIndexSQLiteRTree
+}
+
+func (idx sqliteRTreeIndex) Build(ctx context.Context) error {
+	return idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, statement := range []string{
+			"DROP TABLE IF EXISTS " + spatialIndexTable,
+			//the segment key is stored as auxiliary columns, so that searches don't need to join on stop_times
+			"CREATE VIRTUAL TABLE " + spatialIndexTable + " USING rtree(id, min_lat, max_lat, min_lon, max_lon, +feed_id, +trip_id, +stop_sequence)",
+			"INSERT INTO " + spatialIndexTable + " (feed_id, trip_id, stop_sequence, min_lat, max_lat, min_lon, max_lon) " + tripSegmentsQuery,
+		} {
+			err := tx.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (idx sqliteRTreeIndex) Search(ctx context.Context, box BoundingBox) ([]TripSegment, error) {
+	var segments []TripSegment
+	err := idx.db.WithContext(ctx).Raw("SELECT feed_id, trip_id, stop_sequence FROM "+spatialIndexTable+" WHERE max_lat >= ? AND min_lat <= ? AND max_lon >= ? AND min_lon <= ?",
+		box.MinLat, box.MaxLat, box.MinLon, box.MaxLon).
+		Scan(&segments).Error
+	return segments, err
+}
+
+type postgisIndex struct {
+	db *gorm.DB
+}
+
+func (idx postgisIndex) Type() SpatialIndexType {
+	return SpatialIndexPostGIS
+}
+
+func (idx postgisIndex) Build(ctx context.Context) error {
+	return idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, statement := range []string{
+			"DROP TABLE IF EXISTS " + spatialIndexTable,
+			"CREATE TABLE " + spatialIndexTable + " (feed_id text NOT NULL, trip_id text NOT NULL, stop_sequence bigint NOT NULL, bounds geometry(Geometry, 4326) NOT NULL)",
+			"INSERT INTO " + spatialIndexTable + " (feed_id, trip_id, stop_sequence, bounds) " +
+				"SELECT feed_id, trip_id, stop_sequence, ST_MakeEnvelope(min_lon, min_lat, max_lon, max_lat, 4326) FROM (" + tripSegmentsQuery + ") AS s",
+			"CREATE INDEX idx_" + spatialIndexTable + "_bounds ON " + spatialIndexTable + " USING GIST (bounds)",
+			"ANALYZE " + spatialIndexTable,
+		} {
+			err := tx.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (idx postgisIndex) Search(ctx context.Context, box BoundingBox) ([]TripSegment, error) {
+	var segments []TripSegment
+	err := idx.db.WithContext(ctx).Raw("SELECT feed_id, trip_id, stop_sequence FROM "+spatialIndexTable+" WHERE bounds && ST_MakeEnvelope(?, ?, ?, ?, 4326)",
+		box.MinLon, box.MinLat, box.MaxLon, box.MaxLat).
+		Scan(&segments).Error
+	return segments, err
+}
+
+// A memorySpatialIndex keeps an R-tree of the trip segments in memory.
+// It's lazily built on the first search, as loading every segment takes a while on large DBs.
+type memorySpatialIndex struct {
+	db         *gorm.DB
+	buildMutex sync.Mutex //held during builds, so that concurrent first searches only build the index once
+	mutex      sync.RWMutex
+	root       *rtreeNode
+}
+
+func (idx *memorySpatialIndex) Type() SpatialIndexType {
+	return SpatialIndexMemory
+}
+
+func (idx *memorySpatialIndex) Build(ctx context.Context) error {
+	idx.buildMutex.Lock()
+	defer idx.buildMutex.Unlock()
+	return idx.build(ctx)
+}
+
+// getRoot returns the root of the R-tree, or nil if it wasn't built yet.
+func (idx *memorySpatialIndex) getRoot() *rtreeNode {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	return idx.root
+}
+
+// buildOnce builds the R-tree, unless another search built it while this one waited.
+func (idx *memorySpatialIndex) buildOnce(ctx context.Context) (*rtreeNode, error) {
+	idx.buildMutex.Lock()
+	defer idx.buildMutex.Unlock()
+	root := idx.getRoot()
+	if root != nil {
+		return root, nil
+	}
+	err := idx.build(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.getRoot(), nil
+}
+
+// build loads every segment into a new R-tree, the caller must hold buildMutex.
+func (idx *memorySpatialIndex) build(ctx context.Context) error {
+	rows, err := idx.db.WithContext(ctx).Raw(tripSegmentsQuery).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	//there are a lot more segments than trips, share the ID strings between them
+	knownIds := make(map[string]string)
+	intern := func(id string) string {
+		if known, ok := knownIds[id]; ok {
+			return known
+		}
+		knownIds[id] = id
+		return id
+	}
+	var entries []rtreeEntry
+	for rows.Next() {
+		var entry rtreeEntry
+		err = rows.Scan(&entry.segment.FeedId, &entry.segment.TripId, &entry.segment.StopSequence,
+			&entry.box.MinLat, &entry.box.MaxLat, &entry.box.MinLon, &entry.box.MaxLon)
+		if err != nil {
+			return err
+		}
+		entry.segment.FeedId = intern(entry.segment.FeedId)
+		entry.segment.TripId = intern(entry.segment.TripId)
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	root := buildRTree(entries)
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.root = &root
+	return nil
+}
+
+func (idx *memorySpatialIndex) Search(ctx context.Context, box BoundingBox) ([]TripSegment, error) {
+	root := idx.getRoot()
+	if root == nil {
+		var err error
+		root, err = idx.buildOnce(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var segments []TripSegment
+	root.search(box, func(entry rtreeEntry) {
+		segments = append(segments, entry.segment)
+	})
+	return segments, nil
+}
+
+const rtreeNodeCapacity = 16
+
+type rtreeEntry struct {
+	box     BoundingBox
+	segment TripSegment
+}
+
+// an rtreeNode either has children (inner node) or entries (leaf).
+type rtreeNode struct {
+	box      BoundingBox
+	children []rtreeNode
+	entries  []rtreeEntry
+}
+
+// buildRTree bulk loads a static R-tree using the Sort-Tile-Recursive algorithm.
+func buildRTree(entries []rtreeEntry) rtreeNode {
+	nodes := strPack(entries, func(entry rtreeEntry) BoundingBox { return entry.box }, func(group []rtreeEntry) rtreeNode {
+		node := rtreeNode{box: group[0].box, entries: group}
+		for _, entry := range group[1:] {
+			node.box = node.box.union(entry.box)
+		}
+		return node
+	})
+	for len(nodes) > 1 {
+		nodes = strPack(nodes, func(node rtreeNode) BoundingBox { return node.box }, func(group []rtreeNode) rtreeNode {
+			node := rtreeNode{box: group[0].box, children: group}
+			for _, child := range group[1:] {
+				node.box = node.box.union(child.box)
+			}
+			return node
+		})
+	}
+	if len(nodes) == 0 {
+		return rtreeNode{}
+	}
+	return nodes[0]
+}
+
+// strPack groups the items into nodes of at most rtreeNodeCapacity items: items are sorted into vertical slices
+// by longitude, then each slice is sorted by latitude and cut into nodes.
+func strPack[T any](items []T, getBox func(T) BoundingBox, makeNode func([]T) rtreeNode) []rtreeNode {
+	nodeCount := int(math.Ceil(float64(len(items)) / rtreeNodeCapacity))
+	sliceSize := int(math.Ceil(math.Sqrt(float64(nodeCount)))) * rtreeNodeCapacity
+	sort.Slice(items, func(i, j int) bool {
+		return getBox(items[i]).center().Lon < getBox(items[j]).center().Lon
+	})
+	nodes := make([]rtreeNode, 0, nodeCount)
+	for sliceStart := 0; sliceStart < len(items); sliceStart += sliceSize {
+		slice := items[sliceStart:min(sliceStart+sliceSize, len(items))]
+		sort.Slice(slice, func(i, j int) bool {
+			return getBox(slice[i]).center().Lat < getBox(slice[j]).center().Lat
+		})
+		for start := 0; start < len(slice); start += rtreeNodeCapacity {
+			nodes = append(nodes, makeNode(slice[start:min(start+rtreeNodeCapacity, len(slice))]))
+		}
+	}
+	return nodes
+}
+
+func (n *rtreeNode) search(box BoundingBox, found func(rtreeEntry)) {
+	if !n.box.intersects(box) {
+		return
+	}
+	for _, entry := range n.entries {
+		if entry.box.intersects(box) {
+			found(entry)
+		}
+	}
+	for i := range n.children {
+		n.children[i].search(box, found)
+	}
+}
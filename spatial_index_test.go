@@ -0,0 +1,119 @@
+package trainmapdb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// sortedSegments returns the segments as sorted strings, to compare search results.
+func sortedSegments(segments []TripSegment) []string {
+	keys := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		keys = append(keys, fmt.Sprintf("%s/%s/%d", segment.FeedId, segment.TripId, segment.StopSequence))
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestRTreeSearch(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomBox := func(size float64) BoundingBox {
+		lat, lon := 45+random.Float64()*5, 5+random.Float64()*5
+		return BoundingBox{MinLat: lat, MaxLat: lat + random.Float64()*size, MinLon: lon, MaxLon: lon + random.Float64()*size}
+	}
+	var entries []rtreeEntry
+	for i := range 5000 {
+		entries = append(entries, rtreeEntry{box: randomBox(0.2), segment: TripSegment{FeedId: "1", TripId: fmt.Sprint(i / 10), StopSequence: uint(i % 10)}})
+	}
+	allEntries := slices.Clone(entries) //buildRTree sorts its entries
+	root := buildRTree(entries)
+
+	for range 100 {
+		box := randomBox(1)
+		var expected, got []TripSegment
+		for _, entry := range allEntries {
+			if entry.box.intersects(box) {
+				expected = append(expected, entry.segment)
+			}
+		}
+		root.search(box, func(entry rtreeEntry) {
+			got = append(got, entry.segment)
+		})
+		if !slices.Equal(sortedSegments(got), sortedSegments(expected)) {
+			t.Fatalf("got %d segments in %+v, expected %d", len(got), box, len(expected))
+		}
+	}
+
+	empty := buildRTree(nil)
+	empty.search(randomBox(1), func(entry rtreeEntry) {
+		t.Errorf("found %+v in an empty tree", entry)
+	})
+}
+
+func TestSpatialIndexes(t *testing.T) {
+	fetcher := loadTestDatabase(t, testFeed(FeedFormatHRDF, zipTestFeed(t, "testdata/hrdf")))
+	//around Liestal: the segments from and to Liestal, and the Basel - Olten ones passing by, but not Olten - Zürich
+	box := BoundingBox{MinLat: 47.48, MaxLat: 47.49, MinLon: 7.73, MaxLon: 7.74}
+	expected := []string{
+		"1/002345:000011:1/1",
+		"1/002345:000011:1/2",
+		"1/002347:000011:1/1",
+		"1/002347:000011:2/1",
+		"1/002349:000011:1/2",
+	}
+	for _, indexType := range []SpatialIndexType{SpatialIndexColumns, SpatialIndexSQLiteRTree, SpatialIndexMemory} {
+		index, err := newSpatialIndex(fetcher.db, indexType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = index.Build(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %s", indexType, err.Error())
+		}
+		segments, err := index.Search(context.Background(), box)
+		if err != nil {
+			t.Fatalf("%s: %s", indexType, err.Error())
+		}
+		if got := sortedSegments(segments); !slices.Equal(got, expected) {
+			t.Errorf("%s: got segments %v, expected %v", indexType, got, expected)
+		}
+	}
+}
+
+func TestMemorySpatialIndexBuildsOnce(t *testing.T) {
+	fetcher := loadTestDatabase(t, testFeed(FeedFormatHRDF, zipTestFeed(t, "testdata/hrdf")))
+	var builds atomic.Int32
+	err := fetcher.db.Callback().Row().Before("gorm:row").Register("count_builds", func(db *gorm.DB) {
+		if strings.Contains(db.Statement.SQL.String(), "LEAD(") {
+			builds.Add(1)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := &memorySpatialIndex{db: fetcher.db}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			segments, err := index.Search(context.Background(), BoundingBox{MinLat: 47, MaxLat: 48, MinLon: 7, MaxLon: 9})
+			if err != nil || len(segments) == 0 {
+				t.Errorf("got %d segments and error %v", len(segments), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if builds.Load() != 1 {
+		t.Errorf("the index was built %d times by concurrent searches, expected once", builds.Load())
+	}
+}
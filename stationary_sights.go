@@ -36,9 +36,11 @@ type TrainSight struct {
 }
 
 type RealTrainSight struct {
-	TrainSight TrainSight `json:"sight"`
-	Timestamp  time.Time  `json:"timestamp"`
-	Date       time.Time  `json:"date"`
+	TrainSight TrainSight    `json:"sight"`
+	Timestamp  time.Time     `json:"timestamp"`
+	Date       time.Time     `json:"date"`
+	Delay      time.Duration `json:"delay"`   //realtime delay already included in Timestamp
+	Sources    []FeededTrip  `json:"sources"` //every feed trip this sight was seen in (several for cross-feed duplicates)
 }
 
 func (rts *RealTrainSight) updateInnerDates(tz *time.Location) {
@@ -145,50 +147,45 @@ func (st StopTime) getPassingTime(obsPoint Point, other StopTime) (time.Duration
 }
 
 // Checks if the trip in question is a sight at the coords given.
-func (f *Fetcher) getPossibleTrainSight(obsPoint Point, trip Trip) (sight TrainSight, hasSight bool, err error) {
+// Only the given segments (indexes of the StopTimes starting them, as found by the spatial index) are checked.
+func (f *Fetcher) getPossibleTrainSight(obsPoint Point, trip Trip, segments []int) (sight TrainSight, hasSight bool, err error) {
 	// first, exclude all routes that aren't rail (looking at you buses)
 	if !trip.Route.RouteType.isRailType() {
 		return TrainSight{}, false, nil
 	}
 
-	var stBefore StopTime
-	for i, stopTime := range trip.StopTimes {
+	for _, segment := range segments {
+		stBefore := trip.StopTimes[segment]
+		stopTime := trip.StopTimes[segment+1]
 		hasCloseStop := stopTime.Stop.GetPoint().getDistTo(obsPoint) < f.Config.CloseHeavyRailStationThreshold
-		// if not first, check diffs
-		if i != 0 {
-			//handle source once if we're at the very start
-			hasCloseStop = hasCloseStop || trip.StopTimes[0].Stop.GetPoint().getDistTo(obsPoint) < f.Config.CloseHeavyRailStationThreshold
-			startPoint := stBefore.Stop.GetPoint()
-			endPoint := stopTime.Stop.GetPoint()
-			startBearing := startPoint.GetBearingFrom(obsPoint)
-			endBearing := endPoint.GetBearingFrom(obsPoint)
-			// min threshold (be gracious for now)
-			hasCloseStop = hasCloseStop || stopTime.Stop.GetPoint().getDistTo(obsPoint) < f.Config.CloseHeavyRailStationThreshold
-			hasBearing := !endBearing.isDiffLessThan(startBearing, f.Config.BearingMaxThreshold)
-			if hasBearing || hasCloseStop {
-				passingTime, err := stBefore.getPassingTime(obsPoint, stopTime)
-				if err != nil {
-					return TrainSight{}, false, err
-				}
-				ts := TrainSight{
-					ServiceId:   trip.RefServiceId,
-					TripId:      trip.TripId,
-					FeedId:      trip.FeedId,
-					Feed:        trip.Feed,
-					StBefore:    stBefore,
-					StAfter:     stopTime,
-					FirstSt:     trip.StopTimes[0],
-					LastSt:      trip.StopTimes[len(trip.StopTimes)-1],
-					Trip:        trip,
-					RouteName:   trip.Route.RouteShortName,
-					passingTime: passingTime,
-				}
-				return ts, true, nil
+		//handle source once if we're at the very start
+		hasCloseStop = hasCloseStop || (segment == 0 && stBefore.Stop.GetPoint().getDistTo(obsPoint) < f.Config.CloseHeavyRailStationThreshold)
+		startPoint := stBefore.Stop.GetPoint()
+		endPoint := stopTime.Stop.GetPoint()
+		startBearing := startPoint.GetBearingFrom(obsPoint)
+		endBearing := endPoint.GetBearingFrom(obsPoint)
+		// min threshold (be gracious for now)
+		hasBearing := !endBearing.isDiffLessThan(startBearing, f.Config.BearingMaxThreshold)
+		if hasBearing || hasCloseStop {
+			passingTime, err := stBefore.getPassingTime(obsPoint, stopTime)
+			if err != nil {
+				return TrainSight{}, false, err
+			}
+			ts := TrainSight{
+				ServiceId:   trip.RefServiceId,
+				TripId:      trip.TripId,
+				FeedId:      trip.FeedId,
+				Feed:        trip.Feed,
+				StBefore:    stBefore,
+				StAfter:     stopTime,
+				FirstSt:     trip.StopTimes[0],
+				LastSt:      trip.StopTimes[len(trip.StopTimes)-1],
+				Trip:        trip,
+				RouteName:   trip.Route.RouteShortName,
+				passingTime: passingTime,
 			}
+			return ts, true, nil
 		}
-
-		//shift previous values
-		stBefore = stopTime
 	}
 	return TrainSight{}, false, nil
 }
@@ -201,13 +198,15 @@ func NewDate(day time.Time) Date {
 
 // Fetches train sights at an observation point between starting at startDate's services and endDate (including endDate's GTFS services)
 func (f Fetcher) GetRealTrainSights(obsPoint Point, startDate Date, endDate Date) ([]RealTrainSight, error) {
+	defer f.observeQuery("GetRealTrainSights", time.Now())
 	dateToServices := make(map[time.Time][]FeededService, 0)
 
 	//get all date possibilities
 	startDateAsTime := time.Time(startDate)
 	endDateAsTime := time.Time(endDate)
 
-	servicesInInterval, err := f.GetServicesBetweenDates(startDateAsTime, endDateAsTime)
+	backend := f.Backend()
+	servicesInInterval, err := backend.GetServicesBetweenDates(f.context(), startDateAsTime, endDateAsTime)
 	if err != nil {
 		return nil, err
 	}
@@ -220,22 +219,28 @@ func (f Fetcher) GetRealTrainSights(obsPoint Point, startDate Date, endDate Date
 
 	//fetch all trips matching our coords
 
-	possibleTrips, err := f.GetTripsContaining(obsPoint)
+	obsBox := BoundingBox{MinLat: obsPoint.Lat, MaxLat: obsPoint.Lat, MinLon: obsPoint.Lon, MaxLon: obsPoint.Lon}
+	possibleTrips, err := backend.GetTripSegmentsWithIntersection(f.context(), obsBox.withMargin(f.Config.DatabaseOutOfBoundsGraceDegrees), sightTripLoadOptions())
 	if err != nil {
 		return nil, err
 	}
+	f.metrics().Observe("query.candidate_trips.GetRealTrainSights", float64(len(possibleTrips)))
 
 	serviceToSights := make(map[FeededService][]TrainSight)
 
 	for _, possibleTrip := range possibleTrips {
-		possibleTrainSight, hasSight, err := f.getPossibleTrainSight(obsPoint, possibleTrip)
+		err = f.context().Err() //the client may have given up
+		if err != nil {
+			return nil, err
+		}
+		possibleTrainSight, hasSight, err := f.getPossibleTrainSight(obsPoint, possibleTrip.Trip, possibleTrip.Segments)
 		if err != nil {
 			return nil, err
 		}
 		if !hasSight {
 			continue //skip if not a sight
 		}
-		feededService := FeededService{FeedId: possibleTrip.FeedId, ServiceId: possibleTrip.RefServiceId}
+		feededService := FeededService{FeedId: possibleTrip.Trip.FeedId, ServiceId: possibleTrip.Trip.RefServiceId}
 
 		//if it is, add to our map
 		serviceToSights[feededService] = append(serviceToSights[feededService], possibleTrainSight)
@@ -251,10 +256,19 @@ func (f Fetcher) GetRealTrainSights(obsPoint Point, startDate Date, endDate Date
 	for date, feededServices := range dateToServices {
 		for _, feededService := range feededServices {
 			for _, trainSight := range serviceToSights[feededService] {
+				adjustment, hasAdjustment := f.Realtime.GetAdjustment(trainSight.FeedId, trainSight.TripId, date)
+				if hasAdjustment && (adjustment.Cancelled || !adjustment.runsBetween(trainSight.Trip.StopTimes, trainSight.StBefore, trainSight.StAfter)) {
+					continue
+				}
 				realTrainSight := RealTrainSight{
 					TrainSight: trainSight,
 					Date:       date,
 					Timestamp:  date.Add(trainSight.passingTime),
+					Sources:    []FeededTrip{{FeedId: trainSight.FeedId, TripId: trainSight.TripId}},
+				}
+				if hasAdjustment {
+					realTrainSight.Delay = adjustment.delayAt(trainSight.StBefore.StopId)
+					realTrainSight.Timestamp = realTrainSight.Timestamp.Add(realTrainSight.Delay)
 				}
 				realTrainSight.updateInnerDates(tz)
 				realTrainSights = append(realTrainSights, realTrainSight)
@@ -266,5 +280,8 @@ func (f Fetcher) GetRealTrainSights(obsPoint Point, startDate Date, endDate Date
 		return realTrainSights[i].Timestamp.Before(realTrainSights[j].Timestamp)
 	})
 
+	realTrainSights = mergeDuplicateTrainSights(realTrainSights, f.Config.DuplicateTripTimeTolerance)
+	f.metrics().Observe("query.sights.GetRealTrainSights", float64(len(realTrainSights)))
+
 	return realTrainSights, nil
 }
@@ -0,0 +1,401 @@
+package trainmapdb
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// A Station is a physical station, grouping the stops of every feed that refer to it.
+// Stations are built after loading by MatchStations.
+type Station struct {
+	StationId string  `gorm:"primaryKey;size:191" json:"station_id"`
+	Name      string  `json:"name"`
+	Lat       float64 `json:"lat"`
+	Lon       float64 `json:"lon"`
+	UicCode   string  `gorm:"index" json:"uic_code"`
+	IfoptId   string  `gorm:"index" json:"ifopt_id"`
+	Stops     []Stop  `gorm:"foreignKey:StationId;references:StationId" json:"stops"`
+}
+
+func (s Station) GetPoint() Point {
+	return Point{Lat: s.Lat, Lon: s.Lon}
+}
+
+// A StationMatchingConfig represents the parameters used to cluster stops into stations.
+type StationMatchingConfig struct {
+	NameMatchDistance float64 //kilometers, max distance between stops with matching names
+	CodeMatchDistance float64 //kilometers, max distance between stops with the same UIC/IFOPT code
+}
+
+func NewDefaultStationMatchingConfig() StationMatchingConfig {
+	return StationMatchingConfig{
+		NameMatchDistance: 0.4,
+		CodeMatchDistance: 2,
+	}
+}
+
+var (
+	//stop codes made of a 7 digit UIC code, optionally followed by a check digit (e.g. "8500010")
+	uicCodeRegexp = regexp.MustCompile(`^([1-9][0-9]{6})[0-9]?$`)
+	//stop ID schemes known to carry a UIC code, other IDs may well contain unrelated 7 digit numbers
+	uicStopIdRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`^(?:Parent)?([1-9][0-9]{6})(?::[0-9A-Za-z:]*)?$`),          //bare codes (e.g. DB "8000105"), Swiss "Parent8503000" and "8503000:0:7"
+		regexp.MustCompile(`^Stop(?:Area|Point):OCE(?:[^-]*-)?([1-9][0-9]{6})[0-9]?$`), //SNCF, e.g. "StopArea:OCE87686006" or "StopPoint:OCETrain TER-87686006"
+	}
+	//IFOPT identifiers of stop places, followed by the area and quay levels for the stops inside them
+	ifoptRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`^(ch:[0-9]+:sloid:[0-9]+)(?::|$)`),       //Swiss SLOIDs, e.g. "ch:1:sloid:7000" or "ch:1:sloid:7000:3:4"
+		regexp.MustCompile(`^([a-z]{2}:[0-9]+:[0-9A-Za-z]+)(?::|$)`), //e.g. "de:08111:6115" or "de:08111:6115:1:2"
+	}
+)
+
+// extractStationCodes looks for UIC and IFOPT codes in the stop's code, and in its ID if it follows a known scheme.
+// IFOPT identifiers are cut at the stop place level, so that every stop of a stop place gets the same one.
+func extractStationCodes(stop Stop) (uicCode string, ifoptId string) {
+	for _, candidate := range []string{stop.StopCode, stop.StopId} {
+		for _, re := range ifoptRegexps {
+			if match := re.FindStringSubmatch(candidate); match != nil {
+				return "", match[1]
+			}
+		}
+	}
+	if match := uicCodeRegexp.FindStringSubmatch(stop.StopCode); match != nil {
+		return match[1], ""
+	}
+	for _, re := range uicStopIdRegexps {
+		if match := re.FindStringSubmatch(stop.StopId); match != nil {
+			return match[1], ""
+		}
+	}
+	return "", ""
+}
+
+var accentReplacer = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y",
+	"ß", "ss", "œ", "oe", "æ", "ae",
+)
+
+// common abbreviations and words that don't help telling stations apart
+var stationNameWords = map[string]string{
+	"hbf":     "hauptbahnhof",
+	"bhf":     "",
+	"bahnhof": "",
+	"gare":    "",
+	"station": "",
+	"st":      "saint",
+	"ste":     "sainte",
+	"sncf":    "",
+	"sbb":     "",
+	"cff":     "",
+	"ffs":     "",
+	"db":      "",
+}
+
+// normalizeStationName lowercases the name and removes accents, punctuation and noise words.
+func normalizeStationName(name string) string {
+	name = accentReplacer.Replace(strings.ToLower(name))
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	normalizedWords := make([]string, 0, len(words))
+	for _, word := range words {
+		if replacement, ok := stationNameWords[word]; ok {
+			word = replacement
+		}
+		if word != "" {
+			normalizedWords = append(normalizedWords, word)
+		}
+	}
+	return strings.Join(normalizedWords, " ")
+}
+
+// namesMatch checks whether two normalized names refer to the same station ("basel" and "basel" or "basel bad")
+func namesMatch(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || strings.HasPrefix(a, b+" ") || strings.HasPrefix(b, a+" ")
+}
+
+type stationCandidate struct {
+	stop           Stop
+	normalizedName string
+	uicCode        string
+	ifoptId        string
+	cell           [2]int
+}
+
+// a unionFind is a basic disjoint set structure used for clustering.
+type unionFind []int
+
+func newUnionFind(size int) unionFind {
+	uf := make(unionFind, size)
+	for i := range uf {
+		uf[i] = i
+	}
+	return uf
+}
+
+func (uf unionFind) find(i int) int {
+	for uf[i] != i {
+		uf[i] = uf[uf[i]]
+		i = uf[i]
+	}
+	return i
+}
+
+func (uf unionFind) union(i int, j int) {
+	uf[uf.find(i)] = uf.find(j)
+}
+
+// MatchStations clusters the stops of every feed into Stations (by distance, normalized name and UIC/IFOPT codes)
+// and links every stop to its station. Existing stations are replaced.
+func (f Fetcher) MatchStations(config StationMatchingConfig) ([]Station, error) {
+	if f.db == nil {
+		return nil, ErrNoDatabase
+	}
+	//only match top level stops, children get the station of their parent
+	//stops are sorted so that clusters, and the IDs of their stations, don't depend on the order rows come in
+	var stops []Stop
+	err := f.db.Where("parent_station_id IS NULL OR parent_station_id = ''").Order("feed_id, stop_id").Find(&stops).Error
+	if err != nil {
+		return nil, err
+	}
+
+	//bucket stops in a grid so that only neighbouring stops get compared
+	const KM_PER_DEGREE = 111.0
+	maxDistance := max(config.NameMatchDistance, config.CodeMatchDistance)
+	cellSize := maxDistance / KM_PER_DEGREE
+	candidates := make([]stationCandidate, len(stops))
+	grid := make(map[[2]int][]int)
+	for i, stop := range stops {
+		uicCode, ifoptId := extractStationCodes(stop)
+		cell := [2]int{int(math.Floor(stop.StopLat / cellSize)), int(math.Floor(stop.StopLon / cellSize))}
+		candidates[i] = stationCandidate{
+			stop:           stop,
+			normalizedName: normalizeStationName(stop.StopName),
+			uicCode:        uicCode,
+			ifoptId:        ifoptId,
+			cell:           cell,
+		}
+		grid[cell] = append(grid[cell], i)
+	}
+
+	uf := newUnionFind(len(candidates))
+	for i, candidate := range candidates {
+		//a degree of longitude is only cos(lat) times as long as a degree of latitude, so look as many more cells east and west,
+		//using the latitude of the neighbouring cells farthest from the equator (capped, cells get too narrow near the poles)
+		maxLat := min((math.Abs(candidate.stop.StopLat)+cellSize)*math.Pi/180, 89*math.Pi/180)
+		lonCells := int(math.Ceil(1 / math.Cos(maxLat)))
+		for dLat := -1; dLat <= 1; dLat++ {
+			for dLon := -lonCells; dLon <= lonCells; dLon++ {
+				for _, j := range grid[[2]int{candidate.cell[0] + dLat, candidate.cell[1] + dLon}] {
+					if j <= i {
+						continue
+					}
+					if candidatesMatch(candidate, candidates[j], config) {
+						uf.union(i, j)
+					}
+				}
+			}
+		}
+	}
+
+	//clusters are ordered by their first stop, members are in the order of the stops
+	clusterIndexes := make(map[int]int)
+	var clusters [][]int
+	for i := range candidates {
+		root := uf.find(i)
+		clusterIndex, ok := clusterIndexes[root]
+		if !ok {
+			clusterIndex = len(clusters)
+			clusterIndexes[root] = clusterIndex
+			clusters = append(clusters, nil)
+		}
+		clusters[clusterIndex] = append(clusters[clusterIndex], i)
+	}
+
+	stations := make([]Station, 0, len(clusters))
+	for _, members := range clusters {
+		stations = append(stations, buildStation(candidates, members))
+	}
+	uniqueStationIds(stations)
+	stationMembers := make(map[string][]Stop)
+	for clusterIndex, members := range clusters {
+		stationId := stations[clusterIndex].StationId
+		for _, i := range members {
+			stationMembers[stationId] = append(stationMembers[stationId], candidates[i].stop)
+		}
+	}
+	sort.Slice(stations, func(i, j int) bool {
+		return stations[i].StationId < stations[j].StationId
+	})
+
+	err = f.saveStations(stations, stationMembers)
+	if err != nil {
+		return nil, err
+	}
+	return stations, nil
+}
+
+// uniqueStationIds suffixes the IDs shared by several stations (codes may in theory be shared by distant clusters)
+// with "-2", "-3"..., skipping the suffixed IDs another station already has. The first station keeps its ID.
+func uniqueStationIds(stations []Station) {
+	baseIds := make(map[string]bool, len(stations))
+	for _, station := range stations {
+		baseIds[station.StationId] = true
+	}
+	usedIds := make(map[string]bool, len(stations))
+	for i := range stations {
+		baseId := stations[i].StationId
+		stationId := baseId
+		for n := 2; usedIds[stationId] || (stationId != baseId && baseIds[stationId]); n++ {
+			stationId = fmt.Sprintf("%s-%d", baseId, n)
+		}
+		usedIds[stationId] = true
+		stations[i].StationId = stationId
+	}
+}
+
+func candidatesMatch(a stationCandidate, b stationCandidate, config StationMatchingConfig) bool {
+	sameCode := (a.uicCode != "" && a.uicCode == b.uicCode) || (a.ifoptId != "" && a.ifoptId == b.ifoptId)
+	//stops of the same feed are distinct stations by definition, unless they share a code
+	if a.stop.FeedId == b.stop.FeedId && !sameCode {
+		return false
+	}
+	distance := a.stop.GetPoint().getDistTo(b.stop.GetPoint())
+	if sameCode {
+		return distance <= config.CodeMatchDistance
+	}
+	return distance <= config.NameMatchDistance && namesMatch(a.normalizedName, b.normalizedName)
+}
+
+// buildStation computes the canonical station of a cluster.
+func buildStation(candidates []stationCandidate, members []int) Station {
+	var station Station
+	var latSum, lonSum float64
+	nameCounts := make(map[string]int)
+	for _, i := range members {
+		candidate := candidates[i]
+		latSum += candidate.stop.StopLat
+		lonSum += candidate.stop.StopLon
+		nameCounts[candidate.stop.StopName]++
+		if station.UicCode == "" {
+			station.UicCode = candidate.uicCode
+		}
+		if station.IfoptId == "" {
+			station.IfoptId = candidate.ifoptId
+		}
+	}
+	//most common name wins, shortest one on ties (usually the least decorated)
+	for name, count := range nameCounts {
+		bestCount := nameCounts[station.Name]
+		if count > bestCount || (count == bestCount && (station.Name == "" || len(name) < len(station.Name) || (len(name) == len(station.Name) && name < station.Name))) {
+			station.Name = name
+		}
+	}
+	station.Lat = latSum / float64(len(members))
+	station.Lon = lonSum / float64(len(members))
+
+	switch {
+	case station.UicCode != "":
+		station.StationId = "uic:" + station.UicCode
+	case station.IfoptId != "":
+		station.StationId = station.IfoptId
+	default:
+		first := candidates[members[0]].stop
+		for _, i := range members {
+			stop := candidates[i].stop
+			if stop.FeedId+stop.StopId < first.FeedId+first.StopId {
+				first = stop
+			}
+		}
+		station.StationId = first.FeedId + ":" + first.StopId
+	}
+	return station
+}
+
+func (f Fetcher) saveStations(stations []Station, stationMembers map[string][]Stop) error {
+	return f.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Stop{}).Where("station_id IS NOT NULL").Update("station_id", nil).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("1 = 1").Delete(&Station{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.CreateInBatches(stations, 1000).Error
+		if err != nil {
+			return err
+		}
+		for _, station := range stations {
+			stopIdsByFeed := make(map[string][]string)
+			for _, stop := range stationMembers[station.StationId] {
+				stopIdsByFeed[stop.FeedId] = append(stopIdsByFeed[stop.FeedId], stop.StopId)
+			}
+			for feedId, stopIds := range stopIdsByFeed {
+				err = tx.Model(&Stop{}).
+					Where("feed_id = ? AND (stop_id IN ? OR parent_station_id IN ?)", feedId, stopIds, stopIds).
+					Update("station_id", station.StationId).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetStation returns the station with the given ID, with all its stops.
+func (f Fetcher) GetStation(stationId string) (Station, error) {
+	defer f.observeQuery("GetStation", time.Now())
+	if f.db == nil {
+		return Station{StationId: stationId}, ErrNoDatabase
+	}
+	station := Station{StationId: stationId}
+	err := f.db.Preload("Stops.Feed").Where(&station).First(&station).Error
+	return station, err
+}
+
+// GetStationsLike returns the stations whose name contains the given string.
+func (f Fetcher) GetStationsLike(name string) ([]Station, error) {
+	defer f.observeQuery("GetStationsLike", time.Now())
+	if f.db == nil {
+		return nil, ErrNoDatabase
+	}
+	var stations []Station
+	err := f.db.
+		Preload("Stops.Feed").
+		Where("UPPER(name) LIKE ?", "%"+strings.ToUpper(name)+"%").
+		Limit(20).
+		Find(&stations).
+		Error
+	return stations, err
+}
+
+// GetStopTimesAtStation returns all the StopTimes at any stop of the given station, whatever the feed.
+func (f Fetcher) GetStopTimesAtStation(stationId string) ([]StopTime, error) {
+	defer f.observeQuery("GetStopTimesAtStation", time.Now())
+	if f.db == nil {
+		return nil, ErrNoDatabase
+	}
+	var stopTimes []StopTime
+	err := f.db.
+		Joins("JOIN stops s ON s.feed_id = stop_times.feed_id AND s.stop_id = stop_times.stop_id").
+		Where("s.station_id = ?", stationId).
+		Find(&stopTimes).
+		Error
+	return stopTimes, err
+}
@@ -0,0 +1,91 @@
+package trainmapdb
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExtractStationCodes(t *testing.T) {
+	tests := []struct {
+		stop    Stop
+		uicCode string
+		ifoptId string
+	}{
+		{Stop{StopId: "8500010"}, "8500010", ""},
+		{Stop{StopId: "Parent8503000"}, "8503000", ""},
+		{Stop{StopId: "8503000:0:7"}, "8503000", ""},
+		{Stop{StopId: "StopArea:OCE87686006"}, "8768600", ""},
+		{Stop{StopId: "StopPoint:OCETrain TER-87686006"}, "8768600", ""},
+		{Stop{StopId: "1234", StopCode: "85000109"}, "8500010", ""},
+		{Stop{StopId: "bus-1234567"}, "", ""},
+		{Stop{StopId: "de:08111:6115"}, "", "de:08111:6115"},
+		{Stop{StopId: "de:08111:6115:1:2"}, "", "de:08111:6115"},
+		{Stop{StopId: "42", StopCode: "de:08111:6115:1"}, "", "de:08111:6115"},
+		{Stop{StopId: "ch:1:sloid:7000"}, "", "ch:1:sloid:7000"},
+		{Stop{StopId: "ch:1:sloid:7000:3:4"}, "", "ch:1:sloid:7000"},
+	}
+	for _, test := range tests {
+		uicCode, ifoptId := extractStationCodes(test.stop)
+		if uicCode != test.uicCode || ifoptId != test.ifoptId {
+			t.Errorf("got codes %q and %q for %s/%s, expected %q and %q", uicCode, ifoptId, test.stop.StopId, test.stop.StopCode, test.uicCode, test.ifoptId)
+		}
+	}
+}
+
+func TestUniqueStationIds(t *testing.T) {
+	stations := []Station{{StationId: "uic:8500010"}, {StationId: "uic:8500010"}, {StationId: "uic:8500010-2"}, {StationId: "uic:8500010"}}
+	uniqueStationIds(stations)
+	var stationIds []string
+	for _, station := range stations {
+		stationIds = append(stationIds, station.StationId)
+	}
+	expected := []string{"uic:8500010", "uic:8500010-3", "uic:8500010-2", "uic:8500010-4"}
+	if !slices.Equal(stationIds, expected) {
+		t.Errorf("got station IDs %v, expected %v", stationIds, expected)
+	}
+}
+
+func TestMatchStations(t *testing.T) {
+	stops := []Stop{
+		//the same station in two feeds
+		{FeedId: "1", StopId: "8500010", StopName: "Basel SBB", StopLat: 47.5474, StopLon: 7.5896},
+		{FeedId: "2", StopId: "StopArea:OCE85000109", StopName: "Bâle", StopLat: 47.5470, StopLon: 7.5900},
+		//stops of another station sharing the code, far away
+		{FeedId: "2", StopId: "StopArea:OCE85000117", StopCode: "8500010", StopName: "Elsewhere", StopLat: 48.5, StopLon: 7.5},
+		//matched by name
+		{FeedId: "1", StopId: "olten", StopName: "Olten", StopLat: 47.3519, StopLon: 7.9077},
+		{FeedId: "2", StopId: "OLT", StopName: "Olten Bahnhof", StopLat: 47.3521, StopLon: 7.9080},
+	}
+	var stationIds [][]string
+	//whatever the order the stops come in, the stations are the same
+	for _, order := range [][]int{{0, 1, 2, 3, 4}, {4, 3, 2, 1, 0}} {
+		fetcher := newTestFetcher(t)
+		for _, i := range order {
+			insertTestRows(t, fetcher, stops[i])
+		}
+		stations, err := fetcher.MatchStations(NewDefaultStationMatchingConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, station := range stations {
+			ids = append(ids, station.StationId)
+		}
+		stationIds = append(stationIds, ids)
+
+		var elsewhere Stop
+		err = fetcher.db.Where("feed_id = ? AND stop_id = ?", "2", "StopArea:OCE85000117").Take(&elsewhere).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elsewhere.StationId == nil || *elsewhere.StationId != "uic:8500010-2" {
+			t.Errorf("the distant stop sharing a code should get the suffixed station, got %v", elsewhere.StationId)
+		}
+	}
+	expected := []string{"1:olten", "uic:8500010", "uic:8500010-2"}
+	for _, ids := range stationIds {
+		if !slices.Equal(ids, expected) {
+			t.Errorf("got stations %v, expected %v", ids, expected)
+		}
+	}
+}
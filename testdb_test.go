@@ -0,0 +1,52 @@
+package trainmapdb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm/clause"
+)
+
+// newTestFetcher returns a Fetcher on an empty SQLite DB with the schema migrated.
+func newTestFetcher(t *testing.T) *Fetcher {
+	t.Helper()
+	fetcher, err := NewFetcher(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrate(fetcher.db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+// testFeed returns the config entry loading the given feed file from disk (never downloading it).
+func testFeed(format string, fileName string) LoaderConfigEntry {
+	return LoaderConfigEntry{Active: true, DatabaseFileName: fileName, DisplayName: filepath.Base(fileName), Format: format}
+}
+
+// loadTestDatabase loads the given feeds into a new SQLite DB.
+func loadTestDatabase(t *testing.T, feeds ...LoaderConfigEntry) *Fetcher {
+	t.Helper()
+	databasePath := filepath.Join(t.TempDir(), "test.db")
+	fetcher, err := NewFetcher(sqlite.Open(databasePath), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fetcher.LoadDatabase(LoaderConfig{DatabasePath: databasePath, Contents: feeds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+// insertTestRows writes the rows to the DB of the fetcher, without their associations.
+func insertTestRows[T any](t *testing.T, fetcher *Fetcher, rows ...T) {
+	t.Helper()
+	err := fetcher.db.Omit(clause.Associations).Create(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,231 @@
+package trainmapdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A FeedTransformer fixes known quirks of a feed while it's loaded, see LoaderConfigEntry.Transformers.
+// Its methods are called on every entity once parsed (times and locations converted, extended route types simplified),
+// before any filtering: they may modify the entity, or return false to drop it.
+// Embed NopTransformer to only implement some of the methods.
+// Feeds are loaded concurrently, so transformers must be safe for concurrent use.
+type FeedTransformer interface {
+	TransformAgency(feed *FeedContext, agency *Agency) bool
+	TransformRoute(feed *FeedContext, route *Route) bool
+	TransformTrip(feed *FeedContext, trip *Trip) bool
+	TransformStop(feed *FeedContext, stop *Stop) bool
+	TransformStopTime(feed *FeedContext, stopTime *StopTime) bool
+}
+
+// A FeedContext describes the feed being transformed.
+type FeedContext struct {
+	FeedId      string
+	DisplayName string
+	Agencies    []Agency //every agency of the feed, already transformed, set before any other entity is transformed
+}
+
+// NopTransformer keeps every entity unchanged, embed it in transformers only fixing some entities.
+type NopTransformer struct{}
+
+func (NopTransformer) TransformAgency(feed *FeedContext, agency *Agency) bool       { return true }
+func (NopTransformer) TransformRoute(feed *FeedContext, route *Route) bool          { return true }
+func (NopTransformer) TransformTrip(feed *FeedContext, trip *Trip) bool             { return true }
+func (NopTransformer) TransformStop(feed *FeedContext, stop *Stop) bool             { return true }
+func (NopTransformer) TransformStopTime(feed *FeedContext, stopTime *StopTime) bool { return true }
+
+var (
+	transformersMutex sync.RWMutex
+	transformers      = map[string]FeedTransformer{
+		"unpad_ids":       unpadIdsTransformer{},
+		"swap_lat_lon":    swapLatLonTransformer{},
+		"all_routes_rail": allRoutesRailTransformer{},
+		"single_agency":   singleAgencyTransformer{},
+	}
+)
+
+// RegisterTransformer makes a transformer selectable by name in LoaderConfigEntry.Transformers.
+// Names are unique, built-in ones included.
+func RegisterTransformer(name string, transformer FeedTransformer) error {
+	transformersMutex.Lock()
+	defer transformersMutex.Unlock()
+	if _, ok := transformers[name]; ok {
+		return fmt.Errorf("transformer %s is already registered", name)
+	}
+	transformers[name] = transformer
+	return nil
+}
+
+// TransformerNames returns the name of every registered transformer, built-in ones included.
+func TransformerNames() []string {
+	transformersMutex.RLock()
+	defer transformersMutex.RUnlock()
+	names := make([]string, 0, len(transformers))
+	for name := range transformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// feedTransformers runs the transformers selected for a feed, in order.
+type feedTransformers struct {
+	transformers []FeedTransformer
+	feed         *FeedContext
+}
+
+func newFeedTransformers(feedId string, configEntry LoaderConfigEntry) (feedTransformers, error) {
+	ft := feedTransformers{feed: &FeedContext{FeedId: feedId, DisplayName: configEntry.DisplayName}}
+	for _, name := range configEntry.Transformers {
+		transformersMutex.RLock()
+		transformer, ok := transformers[name]
+		transformersMutex.RUnlock()
+		if !ok {
+			return feedTransformers{}, fmt.Errorf("unknown transformer %s (known ones: %s)", name, strings.Join(TransformerNames(), ", "))
+		}
+		ft.transformers = append(ft.transformers, transformer)
+	}
+	return ft, nil
+}
+
+func (ft feedTransformers) agency(agency *Agency) bool {
+	for _, transformer := range ft.transformers {
+		if !transformer.TransformAgency(ft.feed, agency) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ft feedTransformers) route(route *Route) bool {
+	for _, transformer := range ft.transformers {
+		if !transformer.TransformRoute(ft.feed, route) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ft feedTransformers) trip(trip *Trip) bool {
+	for _, transformer := range ft.transformers {
+		if !transformer.TransformTrip(ft.feed, trip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ft feedTransformers) stop(stop *Stop) bool {
+	for _, transformer := range ft.transformers {
+		if !transformer.TransformStop(ft.feed, stop) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ft feedTransformers) stopTime(stopTime *StopTime) bool {
+	for _, transformer := range ft.transformers {
+		if !transformer.TransformStopTime(ft.feed, stopTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// agencies transforms the agencies, and makes them available to the transformers of the other entities.
+func (ft feedTransformers) agencies(agencies []Agency) []Agency {
+	agencies = transformEach(agencies, ft.agency)
+	ft.feed.Agencies = agencies
+	return agencies
+}
+
+// transformFeed transforms every entity of a feed, agencies first.
+func (ft feedTransformers) transformFeed(agencies []Agency, routes []Route, trips []Trip, stopTimes []StopTime, stops []Stop) ([]Agency, []Route, []Trip, []StopTime, []Stop) {
+	if len(ft.transformers) == 0 {
+		return agencies, routes, trips, stopTimes, stops
+	}
+	agencies = ft.agencies(agencies)
+	return agencies, transformEach(routes, ft.route), transformEach(trips, ft.trip), transformEach(stopTimes, ft.stopTime), transformEach(stops, ft.stop)
+}
+
+// transformEach transforms every item in place, dropping the ones the transform rejects.
+func transformEach[T any](items []T, transform func(*T) bool) []T {
+	kept := items[:0]
+	for i := range items {
+		if transform(&items[i]) {
+			kept = append(kept, items[i])
+		}
+	}
+	return kept
+}
+
+// unpadIdsTransformer removes the leading zeros of numeric IDs, for feeds padding them in some files only.
+type unpadIdsTransformer struct{ NopTransformer }
+
+func unpadId(id string) string {
+	for _, char := range id {
+		if char < '0' || char > '9' {
+			return id
+		}
+	}
+	unpadded := strings.TrimLeft(id, "0")
+	if unpadded == "" && id != "" {
+		return "0"
+	}
+	return unpadded
+}
+
+func (unpadIdsTransformer) TransformRoute(feed *FeedContext, route *Route) bool {
+	route.RouteId = unpadId(route.RouteId)
+	return true
+}
+
+func (unpadIdsTransformer) TransformTrip(feed *FeedContext, trip *Trip) bool {
+	trip.TripId = unpadId(trip.TripId)
+	trip.RefRouteId = unpadId(trip.RefRouteId)
+	return true
+}
+
+func (unpadIdsTransformer) TransformStop(feed *FeedContext, stop *Stop) bool {
+	stop.StopId = unpadId(stop.StopId)
+	if stop.ParentStationId != nil {
+		parentStationId := unpadId(*stop.ParentStationId)
+		stop.ParentStationId = &parentStationId
+	}
+	return true
+}
+
+func (unpadIdsTransformer) TransformStopTime(feed *FeedContext, stopTime *StopTime) bool {
+	stopTime.TripId = unpadId(stopTime.TripId)
+	stopTime.StopId = unpadId(stopTime.StopId)
+	return true
+}
+
+// swapLatLonTransformer swaps the coordinates of every stop, for feeds giving them in the wrong order.
+type swapLatLonTransformer struct{ NopTransformer }
+
+func (swapLatLonTransformer) TransformStop(feed *FeedContext, stop *Stop) bool {
+	stop.StopLat, stop.StopLon = stop.StopLon, stop.StopLat
+	return true
+}
+
+// allRoutesRailTransformer marks every route as heavy rail, for rail only feeds with wrong route types.
+type allRoutesRailTransformer struct{ NopTransformer }
+
+func (allRoutesRailTransformer) TransformRoute(feed *FeedContext, route *Route) bool {
+	route.RouteType = RouteTypeHeavyRail
+	return true
+}
+
+// singleAgencyTransformer sets the agency of the routes without one, for feeds with a single agency (as allowed by GTFS).
+type singleAgencyTransformer struct{ NopTransformer }
+
+func (singleAgencyTransformer) TransformRoute(feed *FeedContext, route *Route) bool {
+	if route.AgencyId == "" && len(feed.Agencies) == 1 {
+		route.AgencyId = feed.Agencies[0].AgencyId
+	}
+	return true
+}
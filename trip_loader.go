@@ -0,0 +1,315 @@
+package trainmapdb
+
+import (
+	"gorm.io/gorm"
+)
+
+// A TripLoadOptions selects what gets loaded along with the trips returned by the bulk fetchers.
+// Associations shared by many trips (feeds, routes, calendars, stops) are only loaded once per call.
+type TripLoadOptions struct {
+	Feed          bool
+	Route         bool
+	Calendar      bool
+	CalendarDates bool
+	StopTimes     bool //sorted by stop sequence
+	Stops         bool //the stop of every stop time, implies StopTimes
+	BatchSize     int  //trips per query, 0 = default
+}
+
+const defaultTripBatchSize = 1000
+
+// FullTripLoadOptions loads every association of the trips.
+func FullTripLoadOptions() TripLoadOptions {
+	return TripLoadOptions{
+		Feed:          true,
+		Route:         true,
+		Calendar:      true,
+		CalendarDates: true,
+		StopTimes:     true,
+		Stops:         true,
+	}
+}
+
+// what the sight engines need to know about a trip
+func sightTripLoadOptions() TripLoadOptions {
+	return TripLoadOptions{
+		Feed:      true,
+		Route:     true,
+		StopTimes: true,
+		Stops:     true,
+	}
+}
+
+type feedKey struct {
+	feedId string
+	id     string
+}
+
+// A tripLoader fills the associations of trips, caching the shared ones between batches.
+type tripLoader struct {
+	db            *gorm.DB
+	options       TripLoadOptions
+	feeds         map[string]*Feed
+	routes        map[feedKey]*Route
+	calendars     map[feedKey]*Calendar
+	calendarDates map[feedKey][]CalendarDate
+	stops         map[feedKey]*Stop
+}
+
+func newTripLoader(db *gorm.DB, options TripLoadOptions) *tripLoader {
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultTripBatchSize
+	}
+	options.StopTimes = options.StopTimes || options.Stops
+	return &tripLoader{
+		db:            db,
+		options:       options,
+		feeds:         make(map[string]*Feed),
+		routes:        make(map[feedKey]*Route),
+		calendars:     make(map[feedKey]*Calendar),
+		calendarDates: make(map[feedKey][]CalendarDate),
+		stops:         make(map[feedKey]*Stop),
+	}
+}
+
+// loadIntoCache loads the rows of the given feed whose column matches one of the IDs, unless they're already cached.
+// IDs without any matching row are cached as nil so they only get looked up once.
+func loadIntoCache[T any](db *gorm.DB, cache map[feedKey]*T, feedId string, column string, ids []string, getId func(T) string) error {
+	var missingIds []string
+	for _, id := range ids {
+		key := feedKey{feedId: feedId, id: id}
+		if _, ok := cache[key]; ok {
+			continue
+		}
+		cache[key] = nil
+		missingIds = append(missingIds, id)
+	}
+	return forEachIdChunk(missingIds, func(chunk []string) error {
+		var rows []T
+		err := db.Where("feed_id = ? AND "+column+" IN ?", feedId, chunk).Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		for i := range rows {
+			cache[feedKey{feedId: feedId, id: getId(rows[i])}] = &rows[i]
+		}
+		return nil
+	})
+}
+
+// complete fills the associations selected in the options.
+func (tl *tripLoader) complete(trips []Trip) error {
+	tripsByFeed := make(map[string][]*Trip)
+	for i := range trips {
+		tripsByFeed[trips[i].FeedId] = append(tripsByFeed[trips[i].FeedId], &trips[i])
+	}
+	for _, feedId := range mapKeys(tripsByFeed) {
+		err := tl.completeFeedTrips(feedId, tripsByFeed[feedId])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tl *tripLoader) completeFeedTrips(feedId string, trips []*Trip) error {
+	var tripIds, routeIds, serviceIds []string
+	for _, trip := range trips {
+		tripIds = append(tripIds, trip.TripId)
+		routeIds = append(routeIds, trip.RefRouteId)
+		serviceIds = append(serviceIds, trip.RefServiceId)
+	}
+
+	if tl.options.Feed {
+		feed, ok := tl.feeds[feedId]
+		if !ok {
+			var feeds []Feed
+			err := tl.db.Where("feed_id = ?", feedId).Limit(1).Find(&feeds).Error
+			if err != nil {
+				return err
+			}
+			if len(feeds) > 0 {
+				feed = &feeds[0]
+			}
+			tl.feeds[feedId] = feed
+		}
+		for _, trip := range trips {
+			trip.Feed = feed
+		}
+	}
+
+	if tl.options.Route {
+		err := loadIntoCache(tl.db, tl.routes, feedId, "route_id", routeIds, func(route Route) string { return route.RouteId })
+		if err != nil {
+			return err
+		}
+		for _, trip := range trips {
+			trip.Route = tl.routes[feedKey{feedId: feedId, id: trip.RefRouteId}]
+		}
+	}
+
+	if tl.options.Calendar {
+		err := loadIntoCache(tl.db, tl.calendars, feedId, "service_id", serviceIds, func(calendar Calendar) string { return calendar.ServiceId })
+		if err != nil {
+			return err
+		}
+		for _, trip := range trips {
+			if calendar := tl.calendars[feedKey{feedId: feedId, id: trip.RefServiceId}]; calendar != nil {
+				trip.Calendar = *calendar
+			}
+		}
+	}
+
+	if tl.options.CalendarDates {
+		err := tl.loadCalendarDates(feedId, serviceIds)
+		if err != nil {
+			return err
+		}
+		for _, trip := range trips {
+			trip.CalendarDates = tl.calendarDates[feedKey{feedId: feedId, id: trip.RefServiceId}]
+		}
+	}
+
+	if tl.options.StopTimes {
+		err := tl.loadStopTimes(feedId, tripIds, trips)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tl *tripLoader) loadCalendarDates(feedId string, serviceIds []string) error {
+	var missingIds []string
+	for _, serviceId := range serviceIds {
+		key := feedKey{feedId: feedId, id: serviceId}
+		if _, ok := tl.calendarDates[key]; ok {
+			continue
+		}
+		tl.calendarDates[key] = []CalendarDate{}
+		missingIds = append(missingIds, serviceId)
+	}
+	return forEachIdChunk(missingIds, func(chunk []string) error {
+		var calendarDates []CalendarDate
+		err := tl.db.Where("feed_id = ? AND service_id IN ?", feedId, chunk).Order("date").Find(&calendarDates).Error
+		if err != nil {
+			return err
+		}
+		for _, calendarDate := range calendarDates {
+			key := feedKey{feedId: feedId, id: calendarDate.ServiceId}
+			tl.calendarDates[key] = append(tl.calendarDates[key], calendarDate)
+		}
+		return nil
+	})
+}
+
+func (tl *tripLoader) loadStopTimes(feedId string, tripIds []string, trips []*Trip) error {
+	stopTimesByTrip := make(map[string][]StopTime, len(tripIds))
+	var stopIds []string
+	err := forEachIdChunk(tripIds, func(chunk []string) error {
+		var stopTimes []StopTime
+		err := tl.db.Where("feed_id = ? AND trip_id IN ?", feedId, chunk).Order("trip_id, stop_sequence").Find(&stopTimes).Error
+		if err != nil {
+			return err
+		}
+		for _, stopTime := range stopTimes {
+			stopTimesByTrip[stopTime.TripId] = append(stopTimesByTrip[stopTime.TripId], stopTime)
+			stopIds = append(stopIds, stopTime.StopId)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if tl.options.Stops {
+		err = loadIntoCache(tl.db, tl.stops, feedId, "stop_id", stopIds, func(stop Stop) string { return stop.StopId })
+		if err != nil {
+			return err
+		}
+	}
+	for _, trip := range trips {
+		trip.StopTimes = stopTimesByTrip[trip.TripId]
+		if !tl.options.Stops {
+			continue
+		}
+		for i := range trip.StopTimes {
+			trip.StopTimes[i].Stop = tl.stops[feedKey{feedId: feedId, id: trip.StopTimes[i].StopId}]
+		}
+	}
+	return nil
+}
+
+// A TripIterator streams trips by batches (using keyset pagination), so that callers don't need to hold them all in memory.
+//
+//	it := fetcher.IterateTrips(options)
+//	for it.Next() {
+//		trip := it.Trip()
+//	}
+//	err := it.Err()
+type TripIterator struct {
+	db     *gorm.DB
+	loader *tripLoader
+	batch  []Trip
+	index  int
+	done   bool
+	err    error
+}
+
+// IterateTrips returns an iterator over every trip in the DB, ordered by feed ID and trip ID.
+func (f Fetcher) IterateTrips(options TripLoadOptions) *TripIterator {
+	if f.db == nil {
+		return &TripIterator{err: ErrNoDatabase}
+	}
+	return newTripIterator(f.db, options)
+}
+
+func newTripIterator(db *gorm.DB, options TripLoadOptions) *TripIterator {
+	return &TripIterator{db: db, loader: newTripLoader(db, options)}
+}
+
+// Next advances to the next trip, it returns false once every trip was read or an error occurred.
+func (it *TripIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.index+1 < len(it.batch) {
+		it.index++
+		return true
+	}
+	if it.done {
+		return false
+	}
+	batchSize := it.loader.options.BatchSize
+	query := it.db.Order("feed_id, trip_id").Limit(batchSize)
+	if len(it.batch) > 0 {
+		last := it.batch[len(it.batch)-1]
+		query = query.Where("feed_id > ? OR (feed_id = ? AND trip_id > ?)", last.FeedId, last.FeedId, last.TripId)
+	}
+	var batch []Trip
+	it.err = query.Find(&batch).Error
+	if it.err != nil {
+		return false
+	}
+	it.done = len(batch) < batchSize
+	if len(batch) == 0 {
+		return false
+	}
+	it.err = it.loader.complete(batch)
+	if it.err != nil {
+		return false
+	}
+	it.batch = batch
+	it.index = 0
+	return true
+}
+
+// Trip returns the current trip.
+func (it *TripIterator) Trip() Trip {
+	return it.batch[it.index]
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *TripIterator) Err() error {
+	return it.err
+}